@@ -1,5 +1,17 @@
-CREATE TABLE image (id serial PRIMARY KEY, name VARCHAR, fullpath VARCHAR, thumbnailpath VARCHAR, resolution_x INT, resolution_y INT);
+CREATE TABLE image (id serial PRIMARY KEY, name VARCHAR, fullpath VARCHAR, thumbnailpath VARCHAR, resolution_x INT, resolution_y INT, hash VARCHAR(64), format VARCHAR(16), mime_type VARCHAR(32), size BIGINT, phash BIGINT, average_color INT, blurhash VARCHAR(64), lqip TEXT, watermarked BOOLEAN NOT NULL DEFAULT false);
+CREATE UNIQUE INDEX image_hash ON image (hash) WHERE NOT watermarked;
 CREATE TABLE "user" (id serial PRIMARY KEY, username VARCHAR, password VARCHAR);
 INSERT INTO "user" values (1, 'bojan', '49c765a9dc9c3a3fc40ec8afed40167d3d9cf0d5');
 INSERT INTO "user" values (2, 'bojan2', '49c765a9dc9c3a3fc40ec8afed40167d3d9cf0d5');
-CREATE TABLE user_images (user_id INT NOT NULL, image_id INT NOT NULL, PRIMARY KEY (user_id, image_id), FOREIGN KEY (user_id) REFERENCES "user"(id), FOREIGN KEY (image_id) REFERENCES image(id));
\ No newline at end of file
+CREATE TABLE user_images (user_id INT NOT NULL, image_id INT NOT NULL, created_at TIMESTAMP NOT NULL DEFAULT now(), version_of INT, PRIMARY KEY (user_id, image_id), FOREIGN KEY (user_id) REFERENCES "user"(id), FOREIGN KEY (image_id) REFERENCES image(id) ON DELETE CASCADE);
+CREATE TABLE image_renditions (image_id INT NOT NULL, name VARCHAR NOT NULL, path VARCHAR NOT NULL, width INT, height INT, mime_type VARCHAR(32), size BIGINT, PRIMARY KEY (image_id, name), FOREIGN KEY (image_id) REFERENCES image(id) ON DELETE CASCADE);
+CREATE TABLE image_metadata (image_id INT PRIMARY KEY, orientation INT, camera_make VARCHAR, camera_model VARCHAR, lens VARCHAR, exposure_time VARCHAR, f_number REAL, iso INT, focal_length REAL, date_taken TIMESTAMP, gps_latitude DOUBLE PRECISION, gps_longitude DOUBLE PRECISION, gps_altitude DOUBLE PRECISION, FOREIGN KEY (image_id) REFERENCES image(id) ON DELETE CASCADE);
+CREATE TABLE album (id serial PRIMARY KEY, user_id INT NOT NULL, name VARCHAR NOT NULL, description VARCHAR, cover_image_id INT, created_at TIMESTAMP NOT NULL DEFAULT now(), FOREIGN KEY (user_id) REFERENCES "user"(id), FOREIGN KEY (cover_image_id) REFERENCES image(id) ON DELETE SET NULL);
+CREATE TABLE album_images (album_id INT NOT NULL, image_id INT NOT NULL, added_at TIMESTAMP NOT NULL DEFAULT now(), PRIMARY KEY (album_id, image_id), FOREIGN KEY (album_id) REFERENCES album(id) ON DELETE CASCADE, FOREIGN KEY (image_id) REFERENCES image(id) ON DELETE CASCADE);
+CREATE TABLE image_tags (user_id INT NOT NULL, image_id INT NOT NULL, tag VARCHAR(64) NOT NULL, PRIMARY KEY (user_id, image_id, tag), FOREIGN KEY (user_id, image_id) REFERENCES user_images(user_id, image_id) ON DELETE CASCADE);
+CREATE TABLE image_colors (image_id INT NOT NULL, position INT NOT NULL, red SMALLINT NOT NULL, green SMALLINT NOT NULL, blue SMALLINT NOT NULL, weight REAL NOT NULL, PRIMARY KEY (image_id, position), FOREIGN KEY (image_id) REFERENCES image(id) ON DELETE CASCADE);
+CREATE INDEX image_tags_tag ON image_tags (user_id, tag);
+CREATE INDEX user_images_created_at ON user_images (user_id, created_at, image_id);
+CREATE TABLE user_watermark (user_id INT PRIMARY KEY, text VARCHAR(100), logo BYTEA, position VARCHAR(16) NOT NULL, opacity REAL NOT NULL, scale REAL NOT NULL, apply_on VARCHAR(16) NOT NULL, FOREIGN KEY (user_id) REFERENCES "user"(id));
+CREATE TABLE job (id serial PRIMARY KEY, user_id INT NOT NULL, album_id INT, status VARCHAR(16) NOT NULL, error VARCHAR, created_at TIMESTAMP NOT NULL DEFAULT now(), updated_at TIMESTAMP NOT NULL DEFAULT now(), FOREIGN KEY (user_id) REFERENCES "user"(id), FOREIGN KEY (album_id) REFERENCES album(id) ON DELETE SET NULL);
+CREATE TABLE job_files (job_id INT NOT NULL, position INT NOT NULL, name VARCHAR NOT NULL, status VARCHAR(16) NOT NULL, code VARCHAR(16), error VARCHAR, image_id INT, PRIMARY KEY (job_id, position), FOREIGN KEY (job_id) REFERENCES job(id) ON DELETE CASCADE, FOREIGN KEY (image_id) REFERENCES image(id) ON DELETE SET NULL);
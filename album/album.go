@@ -0,0 +1,276 @@
+package album
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/ele7ija/go-pipelines/image"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var ErrAlbumNotFound = fmt.Errorf("album not found")
+
+type Album struct {
+	Id           int          `json:"id"`
+	Name         string       `json:"name"`
+	Description  string       `json:"description"`
+	CoverImageId *int         `json:"coverImageId"` // Chosen by the user, otherwise the first image added is the cover
+	ImageCount   int          `json:"imageCount"`
+	CreatedAt    time.Time    `json:"createdAt"`
+	Cover        *image.Image `json:"-"`
+}
+
+type AlbumBase64 struct {
+	Id           int       `json:"id"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	CoverImageId *int      `json:"coverImageId"`
+	ImageCount   int       `json:"imageCount"`
+	CreatedAt    time.Time `json:"createdAt"`
+	CoverBase64  string    `json:"cover,omitempty"`
+}
+
+func NewAlbumBase64(album *Album) *AlbumBase64 {
+
+	coverBase64 := ""
+	if album.Cover != nil {
+		coverBase64 = image.NewImageBase64(album.Cover).ThumbnailBase64
+	}
+	return &AlbumBase64{
+		Id:           album.Id,
+		Name:         album.Name,
+		Description:  album.Description,
+		CoverImageId: album.CoverImageId,
+		ImageCount:   album.ImageCount,
+		CreatedAt:    album.CreatedAt,
+		CoverBase64:  coverBase64,
+	}
+}
+
+// Service manages the albums of the user from the context
+type Service interface {
+	Create(ctx context.Context, album *Album) error
+	GetAll(ctx context.Context) ([]*Album, error)
+	Get(ctx context.Context, albumId int) (*Album, error)
+	Update(ctx context.Context, album *Album) error
+	Delete(ctx context.Context, albumId int) error
+	GetImageIds(ctx context.Context, albumId int) ([]int, error)
+	AddImages(ctx context.Context, albumId int, imageIds []int) error
+	RemoveImage(ctx context.Context, albumId int, imageId int) error
+}
+
+func NewService(db *sql.DB) Service {
+	return service{db: db}
+}
+
+type service struct {
+	db *sql.DB
+}
+
+// The cover is the chosen image if it's still in the album, otherwise the first one added
+const albumQuery = `SELECT a.id, a.name, COALESCE(a.description, ''), a.cover_image_id, a.created_at,
+	(SELECT COUNT(*) FROM album_images WHERE album_id = a.id), c.id, c.thumbnailpath
+	FROM album a LEFT JOIN image c ON c.id = (
+		SELECT image_id FROM album_images WHERE album_id = a.id ORDER BY image_id = a.cover_image_id DESC, added_at, image_id LIMIT 1)
+	WHERE a.user_id = $1`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAlbum(row scanner) (*Album, error) {
+
+	var album Album
+	var coverImageId sql.NullInt64
+	var coverId sql.NullInt64
+	var coverPath sql.NullString
+	err := row.Scan(&album.Id, &album.Name, &album.Description, &coverImageId, &album.CreatedAt, &album.ImageCount, &coverId, &coverPath)
+	if err != nil {
+		return nil, err
+	}
+	if coverImageId.Valid {
+		id := int(coverImageId.Int64)
+		album.CoverImageId = &id
+	}
+	if coverId.Valid {
+		album.Cover = &image.Image{Id: int(coverId.Int64), ThumbnailPath: coverPath.String}
+	}
+	return &album, nil
+}
+
+func (s service) Create(ctx context.Context, album *Album) error {
+
+	row := s.db.QueryRowContext(ctx, "INSERT INTO album (user_id, name, description) VALUES ($1, $2, $3) RETURNING id, created_at",
+		ctx.Value("userId"), album.Name, album.Description)
+	if err := row.Scan(&album.Id, &album.CreatedAt); err != nil {
+		return err
+	}
+	log.Infof("created album %d: %s", album.Id, album.Name)
+	return nil
+}
+
+func (s service) GetAll(ctx context.Context) ([]*Album, error) {
+
+	rows, err := s.db.QueryContext(ctx, albumQuery+" ORDER BY a.created_at, a.id", ctx.Value("userId"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	albums := []*Album{}
+	for rows.Next() {
+		album, err := scanAlbum(rows)
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, album)
+	}
+	return albums, rows.Err()
+}
+
+func (s service) Get(ctx context.Context, albumId int) (*Album, error) {
+
+	album, err := scanAlbum(s.db.QueryRowContext(ctx, albumQuery+" AND a.id = $2", ctx.Value("userId"), albumId))
+	if err == sql.ErrNoRows {
+		return nil, ErrAlbumNotFound
+	}
+	return album, err
+}
+
+// Update changes the name, the description and the cover of the album. The cover has to be in the album.
+func (s service) Update(ctx context.Context, album *Album) error {
+
+	if album.CoverImageId != nil {
+		var exists bool
+		err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM album_images WHERE album_id = $1 AND image_id = $2)", album.Id, *album.CoverImageId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("cover image %d: %w", *album.CoverImageId, image.ErrImageNotFound)
+		}
+	}
+
+	res, err := s.db.ExecContext(ctx, "UPDATE album SET name = $1, description = $2, cover_image_id = $3 WHERE id = $4 AND user_id = $5",
+		album.Name, album.Description, album.CoverImageId, album.Id, ctx.Value("userId"))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAlbumNotFound
+	}
+	return nil
+}
+
+// Delete deletes the album, but not the images in it
+func (s service) Delete(ctx context.Context, albumId int) error {
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM album WHERE id = $1 AND user_id = $2", albumId, ctx.Value("userId"))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAlbumNotFound
+	}
+	log.Infof("deleted album %d", albumId)
+	return nil
+}
+
+// GetImageIds returns the ids of the images in the album, in the order they were added
+func (s service) GetImageIds(ctx context.Context, albumId int) ([]int, error) {
+
+	if err := s.checkOwner(ctx, s.db, albumId); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT image_id FROM album_images WHERE album_id = $1 ORDER BY added_at, image_id", albumId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	imageIds := []int{}
+	for rows.Next() {
+		var imageId int
+		if err := rows.Scan(&imageId); err != nil {
+			return nil, err
+		}
+		imageIds = append(imageIds, imageId)
+	}
+	return imageIds, rows.Err()
+}
+
+// AddImages adds the user's images to the album. Either all of them are added or none.
+func (s service) AddImages(ctx context.Context, albumId int, imageIds []int) (err error) {
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	if err = s.checkOwner(ctx, tx, albumId); err != nil {
+		return
+	}
+	for _, imageId := range imageIds {
+		var res sql.Result
+		res, err = tx.ExecContext(ctx, "INSERT INTO album_images (album_id, image_id) SELECT $1, image_id FROM user_images WHERE user_id = $2 AND image_id = $3 ON CONFLICT DO NOTHING",
+			albumId, ctx.Value("userId"), imageId)
+		if err != nil {
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Either already in the album or not the user's image
+			var owned bool
+			if err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM user_images WHERE user_id = $1 AND image_id = $2)", ctx.Value("userId"), imageId).Scan(&owned); err != nil {
+				return
+			}
+			if !owned {
+				err = fmt.Errorf("image %d: %w", imageId, image.ErrImageNotFound)
+				return
+			}
+		}
+	}
+	log.Infof("added %d images to album %d", len(imageIds), albumId)
+	return
+}
+
+// RemoveImage removes the image from the album, the image itself stays
+func (s service) RemoveImage(ctx context.Context, albumId int, imageId int) error {
+
+	if err := s.checkOwner(ctx, s.db, albumId); err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, "DELETE FROM album_images WHERE album_id = $1 AND image_id = $2", albumId, imageId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("image %d: %w", imageId, image.ErrImageNotFound)
+	}
+	return nil
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// checkOwner returns ErrAlbumNotFound if the album isn't the user's
+func (s service) checkOwner(ctx context.Context, q queryer, albumId int) error {
+
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM album WHERE id = $1 AND user_id = $2)", albumId, ctx.Value("userId")).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrAlbumNotFound
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package album
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ele7ija/go-pipelines/image"
+	pipeline2 "github.com/ele7ija/pipeline"
+	image2 "image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+var albumColumns = []string{"id", "name", "description", "cover_image_id", "created_at", "count", "id", "thumbnailpath"}
+
+func TestService_GetAll(t *testing.T) {
+
+	userId := 1
+	ctx := context.WithValue(context.Background(), "userId", userId)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	created := time.Date(2021, 7, 14, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT (.+) FROM album a").WithArgs(userId).WillReturnRows(sqlmock.NewRows(albumColumns).
+		AddRow(1, "Holiday", "", 7, created, 3, 7, "thumbnail/7.jpg").
+		AddRow(2, "Empty", "nothing yet", nil, created, 0, nil, nil))
+
+	albums, err := NewService(db).GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(albums) != 2 {
+		t.Fatalf("got %d albums, want 2", len(albums))
+	}
+	if albums[0].Cover == nil || albums[0].Cover.ThumbnailPath != "thumbnail/7.jpg" || *albums[0].CoverImageId != 7 || albums[0].ImageCount != 3 {
+		t.Errorf("album not read well: %+v", albums[0])
+	}
+	if albums[1].Cover != nil || albums[1].CoverImageId != nil || albums[1].Description != "nothing yet" {
+		t.Errorf("empty album not read well: %+v", albums[1])
+	}
+}
+
+func TestService_AddImages(t *testing.T) {
+
+	userId := 1
+	albumId := 3
+	ctx := context.WithValue(context.Background(), "userId", userId)
+
+	t.Run("default", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT EXISTS (.+) FROM album").WithArgs(albumId, userId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectExec("INSERT INTO album_images").WithArgs(albumId, userId, 10).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO album_images").WithArgs(albumId, userId, 11).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT EXISTS (.+) FROM user_images").WithArgs(userId, 11).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectCommit()
+
+		if err := NewService(db).AddImages(ctx, albumId, []int{10, 11}); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("someone else's image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT EXISTS (.+) FROM album").WithArgs(albumId, userId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectExec("INSERT INTO album_images").WithArgs(albumId, userId, 10).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT EXISTS (.+) FROM user_images").WithArgs(userId, 10).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectRollback()
+
+		if err := NewService(db).AddImages(ctx, albumId, []int{10}); !errors.Is(err, image.ErrImageNotFound) {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("someone else's album", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT EXISTS (.+) FROM album").WithArgs(albumId, userId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectRollback()
+
+		if err := NewService(db).AddImages(ctx, albumId, []int{10}); err != ErrAlbumNotFound {
+			t.Errorf("expected ErrAlbumNotFound, got: %v", err)
+		}
+	})
+}
+
+func TestService_Delete(t *testing.T) {
+
+	ctx := context.WithValue(context.Background(), "userId", 1)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM album").WithArgs(3, 1).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := NewService(db).Delete(ctx, 3); err != ErrAlbumNotFound {
+		t.Errorf("expected ErrAlbumNotFound, got: %v", err)
+	}
+}
+
+func TestGetAllAlbumsPipeline(t *testing.T) {
+
+	store := image.NewMemoryBlobStore()
+	buff := new(bytes.Buffer)
+	if err := jpeg.Encode(buff, image2.NewRGBA(image2.Rect(0, 0, 20, 20)), nil); err != nil {
+		t.Fatalf("error encoding: %s", err)
+	}
+	if err := store.Put(context.Background(), "thumbnail/7.jpg", buff); err != nil {
+		t.Fatalf("error storing: %s", err)
+	}
+
+	pipeline := MakeGetAllAlbumsPipeline(image.NewImageService(nil, store, image.DefaultRenditions))
+	inputChan := make(chan pipeline2.Item, 2)
+	errors := make(chan error, 2)
+	inputChan <- &Album{Id: 1, Cover: &image.Image{Id: 7, ThumbnailPath: "thumbnail/7.jpg"}}
+	inputChan <- &Album{Id: 2}
+	close(inputChan)
+
+	covers := map[int]string{}
+	for item := range pipeline.Filter(context.Background(), inputChan, errors) {
+		a, ok := item.(*AlbumBase64)
+		if !ok {
+			t.Fatalf("item at the end of the pipeline is not an album")
+		}
+		covers[a.Id] = a.CoverBase64
+	}
+	close(errors)
+	for err := range errors {
+		t.Errorf("Error: %v", err)
+	}
+	if len(covers) != 2 || covers[1] == "" || covers[2] != "" {
+		t.Errorf("covers not loaded well: %v", covers)
+	}
+}
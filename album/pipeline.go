@@ -0,0 +1,18 @@
+package album
+
+import (
+	"github.com/ele7ija/go-pipelines/image"
+	pipe "github.com/ele7ija/pipeline"
+)
+
+func MakeGetAllAlbumsPipeline(service image.ImageService) *pipe.Pipeline {
+
+	loadCoverWorker := LoadCoverWorker{service}
+	loadCoverFilter := pipe.NewParallelFilter(&loadCoverWorker)
+
+	base64Encoder := Base64EncodeWorker{}
+	base64EncoderFilter := pipe.NewParallelFilter(&base64Encoder)
+
+	pipeline := pipe.NewPipeline("GetAllAlbumsPipeline", loadCoverFilter, base64EncoderFilter)
+	return pipeline
+}
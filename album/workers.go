@@ -0,0 +1,44 @@
+package album
+
+import (
+	"context"
+	"fmt"
+	"github.com/ele7ija/go-pipelines/image"
+	pipe "github.com/ele7ija/pipeline"
+)
+
+type LoadCoverWorker struct {
+	image.ImageService
+}
+
+// Work loads the thumbnail of the album's cover, empty albums pass as they are
+func (worker *LoadCoverWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var album *Album
+	var ok bool
+	if album, ok = in.(*Album); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	if album.Cover == nil {
+		return album, nil
+	}
+	if err = worker.LoadThumbnail(ctx, album.Cover); err != nil {
+		return nil, fmt.Errorf("album %d: %w", album.Id, err)
+	}
+	return album, nil
+}
+
+type Base64EncodeWorker struct {
+}
+
+func (worker *Base64EncodeWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var album *Album
+	var ok bool
+	if album, ok = in.(*Album); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	return NewAlbumBase64(album), nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/ele7ija/go-pipelines/album"
+	"github.com/ele7ija/go-pipelines/image"
+	pipe "github.com/ele7ija/pipeline"
+	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func albumsRouter(db *sql.DB, store image.BlobStore) http.Handler {
+
+	r := chi.NewRouter()
+	r.Use(UserOnly(db), AdminOnly(db))
+	r.Get("/", getAllAlbums(db, store))
+	r.Post("/", createAlbum(db))
+	r.Get("/{albumId}", getAlbum(db))
+	r.Put("/{albumId}", updateAlbum(db))
+	r.Delete("/{albumId}", deleteAlbum(db))
+	r.Get("/{albumId}/images", getAlbumImages(db, store))
+	r.Post("/{albumId}/images", addAlbumImages(db))
+	r.Delete("/{albumId}/images/{imageId}", removeAlbumImage(db))
+	return r
+}
+
+// getAllAlbums streams the user's albums with their cover thumbnails
+func getAllAlbums(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	albumService := album.NewService(db)
+	pipeline := album.MakeGetAllAlbumsPipeline(image.NewImageService(db, store, Renditions))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		albums, err := albumService.GetAll(r.Context())
+		if err != nil {
+			log.Errorf("%v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("errored while getting albums"))
+			return
+		}
+
+		startingItems := make(chan pipe.Item, len(albums))
+		for _, a := range albums {
+			startingItems <- a
+		}
+		close(startingItems)
+		pipelineErrors := make(chan error, len(albums))
+		started := time.Now()
+		items := pipeline.Filter(r.Context(), startingItems, pipelineErrors)
+		go func() {
+			for err := range pipelineErrors {
+				log.Errorf("Error in the GetAllAlbumsPipeline: %v", err)
+			}
+		}()
+
+		encoder := newStreamEncoder(w, r, "albums", "album")
+		counter := 0
+		for item := range items {
+			log.Debugf("Sending album no: %d", counter)
+			counter++
+			encoder.Encode(item.(*album.AlbumBase64))
+		}
+		if err := encoder.Close(nil); err != nil {
+			log.Errorf("couldn't send the albums: %s", err)
+		}
+		pipeline.FilteringNumber++
+		pipeline.FilteringDuration += time.Since(started)
+		close(pipelineErrors)
+	}
+}
+
+func createAlbum(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+
+	albumService := album.NewService(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var a album.Album
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil || a.Name == "" {
+			w.WriteHeader(400)
+			w.Write([]byte("an album needs a name"))
+			return
+		}
+		if err := albumService.Create(r.Context(), &a); err != nil {
+			log.Errorf("couldn't create album: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(a)
+	}
+}
+
+func getAlbum(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+
+	albumService := album.NewService(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		albumId, ok := albumIdParam(w, r)
+		if !ok {
+			return
+		}
+		a, err := albumService.Get(r.Context(), albumId)
+		if err != nil {
+			writeAlbumError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+	}
+}
+
+func updateAlbum(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+
+	albumService := album.NewService(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		albumId, ok := albumIdParam(w, r)
+		if !ok {
+			return
+		}
+		var a album.Album
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil || a.Name == "" {
+			w.WriteHeader(400)
+			w.Write([]byte("an album needs a name"))
+			return
+		}
+		a.Id = albumId
+		if err := albumService.Update(r.Context(), &a); err != nil {
+			writeAlbumError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// deleteAlbum deletes the album, the images in it are kept
+func deleteAlbum(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+
+	albumService := album.NewService(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		albumId, ok := albumIdParam(w, r)
+		if !ok {
+			return
+		}
+		if err := albumService.Delete(r.Context(), albumId); err != nil {
+			writeAlbumError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// getAlbumImages streams the images of the album the same way getAllImages streams all of them
+func getAlbumImages(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	albumService := album.NewService(db)
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeGetAllImagesPipeline(imagesService)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		albumId, ok := albumIdParam(w, r)
+		if !ok {
+			return
+		}
+		r = withRendition(r)
+		imageIds, err := albumService.GetImageIds(r.Context(), albumId)
+		if err != nil {
+			writeAlbumError(w, err)
+			return
+		}
+		var imgs []*image.Image
+		if len(imageIds) > 0 {
+			if imgs, err = imagesService.GetMetadata(r.Context(), imageIds); err != nil {
+				log.Errorf("%v", err)
+				w.WriteHeader(500)
+				w.Write([]byte("errored while getting images metadata"))
+				return
+			}
+		}
+
+		startingItems := make(chan pipe.Item, len(imgs))
+		for _, img := range imgs {
+			startingItems <- img
+		}
+		close(startingItems)
+		pipelineErrors := make(chan error, len(imgs))
+		started := time.Now()
+		items := pipeline.Filter(r.Context(), startingItems, pipelineErrors)
+		go func() {
+			for err := range pipelineErrors {
+				log.Errorf("Error in the GetAllImagesPipeline: %v", err)
+			}
+		}()
+
+		encoder := newStreamEncoder(w, r, "images", "image")
+		for item := range items {
+			encoder.Encode(item.(*image.ImageBase64))
+		}
+		if err := encoder.Close(nil); err != nil {
+			log.Errorf("couldn't send the images: %s", err)
+		}
+		pipeline.FilteringNumber++
+		pipeline.FilteringDuration += time.Since(started)
+		close(pipelineErrors)
+	}
+}
+
+// addAlbumImages adds the images given as {"imageIds": [1, 2, 3]} to the album
+func addAlbumImages(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+
+	albumService := album.NewService(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		albumId, ok := albumIdParam(w, r)
+		if !ok {
+			return
+		}
+		var body struct {
+			ImageIds []int `json:"imageIds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.ImageIds) == 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("imageIds should be a list of image ids"))
+			return
+		}
+		if err := albumService.AddImages(r.Context(), albumId, body.ImageIds); err != nil {
+			writeAlbumError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+func removeAlbumImage(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+
+	albumService := album.NewService(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		albumId, ok := albumIdParam(w, r)
+		if !ok {
+			return
+		}
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		if err := albumService.RemoveImage(r.Context(), albumId, imageId); err != nil {
+			writeAlbumError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// withAlbum puts the album given with the upload as the albumId form field into the context, so the images land in it
+func withAlbum(albumService album.Service, w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+
+	albumIdStr := r.FormValue("albumId")
+	if albumIdStr == "" {
+		return r, true
+	}
+	albumId, err := strconv.Atoi(albumIdStr)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("album id not an integer"))
+		return r, false
+	}
+	if _, err := albumService.Get(r.Context(), albumId); err != nil {
+		writeAlbumError(w, err)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), "albumId", albumId)), true
+}
+
+func albumIdParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+
+	albumId, err := strconv.Atoi(chi.URLParam(r, "albumId"))
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte("album id not an integer"))
+		return 0, false
+	}
+	return albumId, true
+}
+
+func writeAlbumError(w http.ResponseWriter, err error) {
+
+	if errors.Is(err, album.ErrAlbumNotFound) || errors.Is(err, image.ErrImageNotFound) {
+		w.WriteHeader(404)
+	} else {
+		log.Errorf("album error: %s", err)
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(err.Error()))
+}
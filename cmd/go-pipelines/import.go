@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ele7ija/go-pipelines/image"
+	"github.com/ele7ija/go-pipelines/user"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// runImport is the import command, it creates the images of a directory for a user without going through HTTP:
+//
+//	go-pipelines import -user bojan [-dry-run] <dir>
+//
+// It returns the exit code, 1 when some of the files failed.
+func runImport(args []string) int {
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	username := flags.String("user", "", "the user the images are imported for")
+	dryRun := flags.Bool("dry-run", false, "only list the files that would be imported")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: go-pipelines import -user <username> [-dry-run] <dir>\n\n"+
+			"Imports the images under the directory, recursively. Files that aren't images and\n"+
+			"images the user already has are skipped.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *username == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	dir := flags.Arg(0)
+	// Progress goes to stdout, only the problems are logged
+	log.SetLevel(log.WarnLevel)
+
+	db, err := openDb()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't connect to the database: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+	store, err := newBlobStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't open the blob store: %s\n", err)
+		return 1
+	}
+	if err := image.ValidateRenditions(Renditions); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	u, err := user.NewService(db, UserRegoPath).GetByUsername(context.Background(), *username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't find user %s: %s\n", *username, err)
+		return 1
+	}
+	ctx := context.WithValue(context.Background(), "userId", u.ID)
+	ctx = context.WithValue(ctx, "username", u.Username)
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	// The user's watermark is applied like it is on the uploads
+	watermark, err := imagesService.GetWatermark(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't get the watermark: %s\n", err)
+		return 1
+	}
+	if watermark != nil {
+		ctx = context.WithValue(ctx, "watermark", watermark)
+	}
+
+	counts := make(map[string]int)
+	done := 0
+	progress := func(result *image.UploadResult, total int) {
+		done++
+		counts[result.Status]++
+		fmt.Printf("\r[%d/%d] %s", done, total, summary(counts))
+	}
+	started := time.Now()
+	pipeline := image.MakeCreateImagesPipelineBoundedFilters(imagesService)
+	results, err := image.ImportDirectory(ctx, imagesService, pipeline, dir, *dryRun, progress)
+	if done > 0 {
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import stopped: %s\n", err)
+	}
+
+	failed := 0
+	for _, result := range results {
+		switch result.Status {
+		case image.UploadFailed:
+			failed++
+			fmt.Fprintf(os.Stderr, "failed: %s: %s\n", result.Name, result.Error)
+		case image.UploadPending:
+			fmt.Printf("would import: %s\n", result.Name)
+		}
+	}
+	fmt.Printf("%d files in %s: %s\n", len(results), time.Since(started).Round(time.Millisecond), summary(counts))
+	if err != nil || failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// summary counts the results by their status, e.g. "12 created, 3 existing, 1 failed"
+func summary(counts map[string]int) string {
+
+	var s string
+	for _, status := range []string{image.UploadSuccess, image.UploadDeduplicated, image.UploadPending, image.UploadExisting, image.UploadSkipped, image.UploadFailed} {
+		if counts[status] == 0 {
+			continue
+		}
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("%d %s", counts[status], status)
+	}
+	return s
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/ele7ija/go-pipelines/job"
+	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// JobsPrefix is where the jobs of the asynchronous uploads are mounted
+const JobsPrefix = "/api/jobs"
+
+func jobsRouter(db *sql.DB) http.Handler {
+
+	r := chi.NewRouter()
+	r.Use(UserOnly(db), AdminOnly(db))
+	r.Get("/{jobId}", getJob(db))
+	return r
+}
+
+// getJob returns the job with its progress and the results of its files so far
+func getJob(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+
+	jobService := job.NewService(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		jobId, err := strconv.Atoi(chi.URLParam(r, "jobId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("job id not an integer"))
+			return
+		}
+		j, err := jobService.Get(r.Context(), jobId)
+		if errors.Is(err, job.ErrJobNotFound) {
+			w.WriteHeader(404)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			log.Errorf("couldn't get job %d: %s", jobId, err)
+			w.WriteHeader(500)
+			w.Write([]byte("errored while getting the job"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(j); err != nil {
+			w.WriteHeader(500)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ele7ija/go-pipelines/image"
+	"github.com/ele7ija/go-pipelines/job"
+	"github.com/ele7ija/go-pipelines/policy"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// expiringEngine allows everything while its context is alive, and ends the request after the first image
+type expiringEngine struct {
+	expire func()
+}
+
+func (e expiringEngine) IsAllowed(ctx context.Context, request policy.ImageRequest) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	e.expire()
+	return true, nil
+}
+
+func TestCreateImagesAsync(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "staging")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO job").WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(1, time.Now(), time.Now()))
+	mock.ExpectExec("INSERT INTO job_files").WithArgs(1, 0, "a.jpg", image.UploadPending, "", "", 0).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO job_files").WithArgs(1, 1, "b.jpg", image.UploadPending, "", "", 0).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	images := image.NewImageService(db, image.NewMemoryBlobStore(), image.DefaultRenditions)
+	// No slots, the job stays queued
+	jobs, err := job.NewRunner(job.NewService(db), images, image.MakeCreateImagesPipelineBoundedFilters(images), dir, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		f, _ := mw.CreateFormFile("images", name)
+		f.Write([]byte("staged as it is"))
+	}
+	mw.Close()
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), "userId", 1), time.Minute)
+	defer cancel()
+	r := httptest.NewRequest("POST", "/api/images?async=true", &body).WithContext(ctx)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	mr, err := r.MultipartReader()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	uploads, err := image.NewMultipartUploads(mr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The request times out while the files are being staged
+	w := httptest.NewRecorder()
+	createImagesAsync(w, r, uploads, jobs, expiringEngine{expire: cancel})
+
+	if w.Code != 202 {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	var staged job.Job
+	if err := json.NewDecoder(w.Body).Decode(&staged); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(staged.Files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(staged.Files))
+	}
+	for _, file := range staged.Files {
+		if file.Status != image.UploadPending {
+			t.Errorf("the file should be queued: %+v", file)
+		}
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ele7ija/go-pipelines/album"
 	"github.com/ele7ija/go-pipelines/image"
+	"github.com/ele7ija/go-pipelines/job"
 	"github.com/ele7ija/go-pipelines/policy"
 	"github.com/ele7ija/go-pipelines/user"
 	"github.com/ele7ija/go-pipelines/user/jwt"
@@ -17,10 +20,13 @@ import (
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	metrics "github.com/tevjef/go-runtime-metrics"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -39,8 +45,34 @@ var (
 	HttpPort       = "3333"
 	UserRegoPath   = filepath.Join(os.Getenv("GOPATH"), "src", "github.com", "ele7ija", "go-pipelines", "user", "rego")
 	LoadRegoPath   = filepath.Join(os.Getenv("GOPATH"), "src", "github.com", "ele7ija", "go-pipelines", "policy", "rego")
+	BlobBackend    = "local"
+	BlobDir        = filepath.Join(os.Getenv("GOPATH"), "src", "github.com", "ele7ija", "go-pipelines", "data")
+	S3Endpoint     = "http://localhost:9000"
+	S3Region       = "us-east-1"
+	S3Bucket       = "go-pipelines"
+	S3AccessKey    = "go-pipelines"
+	S3SecretKey    = "go-pipelines"
+	Renditions     = image.DefaultRenditions
+	Resize         = image.DefaultResizeConfig
+	ResizeCacheDir = filepath.Join(os.TempDir(), "go-pipelines-resized")
+	ResizeCacheMB  = 512
+	UploadDir      = filepath.Join(os.TempDir(), "go-pipelines-uploads")
+	UploadMaxMB    = 1024
+	UploadExpiry   = 24 * time.Hour
+	StagingDir     = filepath.Join(os.TempDir(), "go-pipelines-staging")
+	JobWorkers     = 2
 )
 
+// ImagesPrefix is where the images API is mounted
+const ImagesPrefix = "/api/images"
+
+// ImageCacheControl lets browsers keep image files for a day. They're private to the user,
+// and after a day they are revalidated with their ETag.
+const ImageCacheControl = "private, max-age=86400"
+
+// DefaultMaxDistance is how many bits the perceptual hashes of similar images can differ in, when not given
+const DefaultMaxDistance = 10
+
 func main() {
 
 	readEnvironment()
@@ -51,6 +83,10 @@ func main() {
 	})
 	log.SetLevel(log.DebugLevel)
 
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
@@ -58,24 +94,50 @@ func main() {
 	r.Use(middleware.Timeout(60 * time.Second))
 	r.Use(middleware.SetHeader("Access-Control-Allow-Origin", "*"))
 
-	psqlInfo := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		DbHost, DbPort, DbUser, DbPassword, DbName)
-	db, err := sql.Open("postgres", psqlInfo)
+	db, err := openDb()
 	if err != nil {
 		panic(err)
 	}
-	db.SetMaxOpenConns(MaxOpenConns)
 	defer db.Close()
+	log.Info("Successfully connected to DB!")
+	imageRequestsEngine := policy.NewImageRequestsEngine(LoadRegoPath)
 
-	err = pingDb(db)
+	store, err := newBlobStore()
 	if err != nil {
 		panic(err)
 	}
-	log.Info("Successfully connected to DB!")
-	imageRequestsEngine := policy.NewImageRequestsEngine(LoadRegoPath)
+	log.Infof("Using the %s blob store", BlobBackend)
+	if err := image.ValidateRenditions(Renditions); err != nil {
+		panic(err)
+	}
 
-	r.Mount("/api/images", imagesRouter(db, imageRequestsEngine))
+	resizeCache, err := image.NewDiskCache(ResizeCacheDir, int64(ResizeCacheMB)<<20)
+	if err != nil {
+		panic(err)
+	}
+	log.Infof("Caching resized images in %s, %d MB at most", ResizeCacheDir, ResizeCacheMB)
+
+	uploads, err := image.NewResumableUploads(UploadDir, int64(UploadMaxMB)<<20, UploadExpiry)
+	if err != nil {
+		panic(err)
+	}
+	log.Infof("Keeping resumable uploads in %s for %s", UploadDir, UploadExpiry)
+	go removeExpiredUploads(uploads, time.Hour)
+
+	jobs, err := newJobRunner(db, store)
+	if err != nil {
+		panic(err)
+	}
+	log.Infof("Staging the files of the asynchronous uploads in %s, running %d jobs at once", StagingDir, JobWorkers)
+
+	// Hash the images uploaded before perceptual hashing, so they show up as similar images
+	go backfillPerceptualHashes(db, store)
+
+	r.Mount(ImagesPrefix, imagesRouter(db, store, resizeCache, imageRequestsEngine, jobs))
+	r.Mount("/api/albums", albumsRouter(db, store))
+	r.Mount("/api/watermark", watermarkRouter(db, store))
+	r.Mount(UploadsPrefix, uploadsRouter(db, store, uploads, imageRequestsEngine))
+	r.Mount(JobsPrefix, jobsRouter(db))
 	r.Mount("/api/login", userRouter(db))
 
 	fs := http.FileServer(http.Dir("static"))
@@ -99,13 +161,33 @@ func main() {
 	}
 }
 
-func imagesRouter(db *sql.DB, engine policy.ImageRequestsEngine) http.Handler {
+func imagesRouter(db *sql.DB, store image.BlobStore, resizeCache *image.DiskCache, engine policy.ImageRequestsEngine, jobs *job.Runner) http.Handler {
 
 	r := chi.NewRouter()
-	r.Use(UserOnly(db), AdminOnly(db), ParseForm, CheckImagePolicy(engine))
-	r.Get("/", getAllImages(db))
-	r.Get("/{imageId}", getImage(db))
-	r.Post("/", createImages(db))
+	r.Use(UserOnly(db), AdminOnly(db))
+	// The images are created while the form streams in, it isn't parsed up front
+	r.With(CheckImagePolicy(engine)).Post("/", createImages(db, store, engine, jobs))
+	r.With(CheckImagePolicy(engine)).Post("/archive", createImagesFromArchive(db, store, engine))
+
+	r.Group(func(r chi.Router) {
+		r.Use(ParseForm, CheckImagePolicy(engine))
+		r.Get("/", getAllImages(db, store))
+		r.Get("/export", exportImages(db, store))
+		r.Get("/{imageId}", getImage(db, store))
+		r.Get("/{imageId}/similar", getSimilarImages(db, store))
+		r.Get("/{imageId}/original", getOriginal(db, store))
+		r.Get("/{imageId}/thumbnail", getThumbnail(db, store))
+		r.Get("/{imageId}/renditions/{name}", getRendition(db, store))
+		r.Get("/{imageId}/resize", resizeImage(db, store, resizeCache))
+		r.Get("/{imageId}/tags", getTags(db, store))
+		r.Post("/{imageId}/tags", addTags(db, store))
+		r.Delete("/{imageId}/tags/{tag}", removeTag(db, store))
+		r.Get("/{imageId}/versions", getVersions(db, store))
+		r.Post("/{imageId}/edit", editImage(db, store))
+		r.Post("/edit", editImages(db, store))
+		r.Delete("/", deleteImages(db, store))
+		r.Delete("/{imageId}", deleteImage(db, store))
+	})
 	return r
 }
 
@@ -180,8 +262,9 @@ func ParseForm(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
+		// JSON bodies, e.g. of the tags and the edits, are left to the handlers
 		err := r.ParseMultipartForm(1 << 30) // 1GB
-		if err != nil {
+		if err != nil && err != http.ErrNotMultipart {
 			log.Errorf("form error: %s", err)
 			w.WriteHeader(400)
 			return
@@ -274,121 +357,363 @@ func login(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func createImages(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+// createImages creates the images of the "images" files of a multipart form while it streams in. The fields
+// used with them, e.g. albumId, have to come before the first file. The policy is checked again with the count
+// and the size of the images read so far, before each of them. With ?async=true the files are only staged, and a job
+// creates the images after the response, see createImagesAsync.
+func createImages(db *sql.DB, store image.BlobStore, engine policy.ImageRequestsEngine, jobs *job.Runner) func(w http.ResponseWriter, r *http.Request) {
 
-	imagesService := image.NewImageService(db)
+	imagesService := image.NewImageService(db, store, Renditions)
 	pipeline := image.MakeCreateImagesPipelineBoundedFilters(imagesService)
+	albumService := album.NewService(db)
+	create := createImagesWithPipeline(pipeline, engine)
 
-	return createImagesWithPipeline(pipeline)
+	return func(w http.ResponseWriter, r *http.Request) {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("the body should be a multipart form"))
+			return
+		}
+		uploads, err := image.NewMultipartUploads(mr)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		setFormFields(r, uploads)
+
+		r, ok := withAlbum(albumService, w, r)
+		if !ok {
+			return
+		}
+		if async, _ := strconv.ParseBool(r.FormValue("async")); async {
+			createImagesAsync(w, r, uploads, jobs, engine)
+			return
+		}
+		if r, ok = withWatermark(imagesService, w, r); !ok {
+			return
+		}
+		create(w, r, uploads)
+	}
+}
+
+// setFormFields sets the fields before the files of the streamed form as the parsed form, so FormValue doesn't read the body
+func setFormFields(r *http.Request, uploads *image.MultipartUploads) {
+
+	r.Form = r.URL.Query()
+	for key, values := range uploads.Fields {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+}
+
+// createImagesAsync stages the files of the form and responds with 202 and the queued job, before any image is created,
+// so a large upload isn't cut off by the request timeout. GET /api/jobs/{id} has the progress of the job.
+func createImagesAsync(w http.ResponseWriter, r *http.Request, uploads *image.MultipartUploads, jobs *job.Runner, engine policy.ImageRequestsEngine) {
+
+	// The files are still staged once the request timed out, the policy isn't evaluated with its deadline
+	allow := uploadPolicy(context.Background(), engine, r)
+	var albumId *int
+	if id, ok := r.Context().Value("albumId").(int); ok {
+		albumId = &id
+	}
+	// The job is saved even when the request times out while the files are being staged
+	ctx := context.WithValue(context.Background(), "userId", r.Context().Value("userId"))
+	j, err := jobs.Stage(ctx, uploads.Feed("images", allow), albumId)
+	if errors.Is(err, job.ErrNoFiles) {
+		w.WriteHeader(400)
+		w.Write([]byte("the form should have images files"))
+		return
+	}
+	if err != nil {
+		log.Errorf("couldn't stage the files: %s", err)
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	jobs.Submit(j)
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", JobsPrefix, j.Id))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	if err := json.NewEncoder(w).Encode(j); err != nil {
+		log.Errorf("couldn't send job %d: %s", j.Id, err)
+	}
 }
 
-func createImagesWithPipeline(pipeline *pipe.Pipeline) func(w http.ResponseWriter, r *http.Request) {
+// createImagesFromArchive creates the images of a zip, tar or tar.gz archive, sent as the body or as the "archive" file of a form.
+// The policy is checked again with the count and the size of the images read so far, before each of them.
+func createImagesFromArchive(db *sql.DB, store image.BlobStore, engine policy.ImageRequestsEngine) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeCreateImagesPipelineBoundedFilters(imagesService)
+	albumService := album.NewService(db)
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		// asynchronously add starting items
-		fhs := r.MultipartForm.File["images"]
-		startingItems := make(chan pipe.Item, len(fhs))
-		go func() {
-			for _, fh := range fhs {
-				startingItems <- fh
+		// The archive of a form is read as it streams in, like the body
+		var archive io.Reader = r.Body
+		mr, err := r.MultipartReader()
+		if err != nil && err != http.ErrNotMultipart {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if mr != nil {
+			form, err := image.NewMultipartUploads(mr)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
 			}
-			close(startingItems)
-		}()
+			setFormFields(r, form)
+			part, err := form.NextFile("archive")
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if part == nil {
+				w.WriteHeader(400)
+				w.Write([]byte("the form should have an archive file"))
+				return
+			}
+			archive = part
+		}
+
+		r, ok := withAlbum(albumService, w, r)
+		if !ok {
+			return
+		}
+		if r, ok = withWatermark(imagesService, w, r); !ok {
+			return
+		}
 
-		errors := make(chan error, len(fhs))
+		allow := uploadPolicy(r.Context(), engine, r)
 		started := time.Now()
-		items := pipeline.Filter(r.Context(), startingItems, errors)
-		go func() {
-			for err := range errors {
-				log.Errorf("Error in the CreateImagesPipeline: %v", err)
-			}
-		}()
+		results, err := image.ImportArchive(r.Context(), archive, pipeline, allow)
+		if errors.Is(err, image.ErrUnsupportedArchive) && len(results) == 0 {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		pipeline.FilteringNumber++
+		pipeline.FilteringDuration += time.Since(started)
 
-		// Send response
+		response := struct {
+			Entries []*image.UploadResult `json:"entries"`
+			Error   string                `json:"error,omitempty"` // The archive broke off, the entries before are still there
+		}{Entries: results}
+		if err != nil {
+			log.Warnf("archive read partially: %s", err)
+			response.Error = err.Error()
+		}
 		w.Header().Set("Content-Type", "application/json")
-		counter := 0
-		w.Write([]byte("{\"images\": ["))
-		for item := range items {
-			log.Debugf("Sending image no: %d", counter)
-			counter++
-			img := item.(*image.ImageBase64)
-			err := json.NewEncoder(w).Encode(img)
-			if err != nil {
-				w.WriteHeader(500)
-			}
-			w.Write([]byte(","))
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			w.WriteHeader(500)
 		}
+	}
+}
+
+// uploadPolicy checks the policy with the count and the size of the images of the request read so far, before each of them
+func uploadPolicy(ctx context.Context, engine policy.ImageRequestsEngine, r *http.Request) func(count int, size int64) (bool, error) {
 
-		w.Write([]byte("\"void\"]}"))
+	return func(count int, size int64) (bool, error) {
+		return engine.IsAllowed(ctx, policy.ImageRequest{
+			Path:           r.URL.Path,
+			Method:         r.Method,
+			Header:         r.Header,
+			NumberOfImages: count,
+			SizeOfImages:   size,
+		})
+	}
+}
+
+// createImagesWithPipeline responds with the result of every file of the form, see image.UploadResult, and a summary.
+// In JSON they're sent at the end, with 207 when some of the files failed and 403 when the policy allowed none.
+// NDJSON and SSE send every result as soon as it's known, the response is under way by then so that status comes with the summary.
+func createImagesWithPipeline(pipeline *pipe.Pipeline, engine policy.ImageRequestsEngine) func(w http.ResponseWriter, r *http.Request, uploads *image.MultipartUploads) {
+
+	return func(w http.ResponseWriter, r *http.Request, uploads *image.MultipartUploads) {
+
+		allow := uploadPolicy(r.Context(), engine, r)
+
+		encoder := newStreamEncoder(w, r, "files", "file")
+		var progress func(*image.UploadResult)
+		if encoder.Incremental() {
+			progress = func(result *image.UploadResult) {
+				encoder.Encode(result)
+			}
+		}
+		started := time.Now()
+		results, err := image.CreateUploads(r.Context(), pipeline, uploads.Feed("images", allow), progress)
 		pipeline.FilteringNumber++
 		pipeline.FilteringDuration += time.Since(started)
-		close(errors)
+		if err != nil {
+			log.Errorf("form read partially: %s", err)
+		}
+		if len(results) == 0 && err == nil {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(400)
+			w.Write([]byte("the form should have images files"))
+			return
+		}
+
+		trailer := struct {
+			Summary image.UploadSummary `json:"summary"`
+			Status  int                 `json:"status,omitempty"` // Of NDJSON and SSE, JSON has it as the status of the response
+			Error   string              `json:"error,omitempty"`  // The form broke off, the files before are still there
+		}{Summary: image.SummarizeUploads(results)}
+		notAllowed := 0
+		for _, result := range results {
+			if result.Status == image.UploadFailed {
+				log.Errorf("Error in the CreateImagesPipeline: %s: %s", result.Name, result.Error)
+			}
+			if result.Code == image.UploadCodeNotAllowed {
+				notAllowed++
+			}
+		}
+		if err != nil {
+			trailer.Error = err.Error()
+		}
+
+		status := 200
+		switch {
+		case notAllowed > 0 && notAllowed == len(results):
+			log.Warnf("policy decided false")
+			status = 403
+		case trailer.Summary.Failed > 0 || err != nil:
+			status = 207
+		}
+		if encoder.Incremental() {
+			trailer.Status = status
+		} else {
+			w.WriteHeader(status)
+			for _, result := range results {
+				encoder.Encode(result)
+			}
+		}
+		if err := encoder.Close(trailer); err != nil {
+			log.Errorf("couldn't send the results: %s", err)
+		}
 	}
 }
 
-func getAllImages(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+// getAllImages returns a page of the user's images, see image.ParsePage and image.ParseImageFilter for the parameters
+func getAllImages(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
 
-	imagesService := image.NewImageService(db)
-	pipeline := image.MakeGetAllImagesPipeline(imagesService)
+	imagesService := image.NewImageService(db, store, Renditions)
+	base64Pipeline := image.MakeGetAllImagesPipeline(imagesService)
+	urlsPipeline := image.MakeGetAllImageUrlsPipeline(ImagesPrefix, imagesService)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		images, errors, err := imagesService.GetAllMetadata(r.Context())
+		// With ?urls=true the files are linked instead of embedded, and the browser can fetch and cache them
+		pipeline := base64Pipeline
+		if urls, _ := strconv.ParseBool(r.URL.Query().Get("urls")); urls {
+			pipeline = urlsPipeline
+		}
+		filter, err := image.ParseImageFilter(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		page, err := image.ParsePage(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		r = withRendition(r)
+		r, ok := withWatermark(imagesService, w, r)
+		if !ok {
+			return
+		}
+		result, err := imagesService.GetAllMetadata(r.Context(), filter, page)
 		if err != nil {
 			log.Errorf("%v", err)
 			w.WriteHeader(500)
 			w.Write([]byte("errored while getting images metadata"))
 			return
 		}
-		go func() {
-			for err := range errors {
-				log.Errorf("Error in the GetAllMetadata: %v", err)
-			}
-		}()
 
-		// Add starting items and filter them -> we use an unbuffered channel because we don't know how many there are
-		startingItems := make(chan pipe.Item)
-		pipelineErrors := make(chan error)
-		items := pipeline.Filter(r.Context(), startingItems, pipelineErrors)
-
-		// adding the starting items can be done concurrently too
-		started := time.Now()
-		for img := range images {
+		// Only the page goes through the pipeline
+		positions := make(map[int]int, len(result.Images))
+		startingItems := make(chan pipe.Item, len(result.Images))
+		for i, img := range result.Images {
+			positions[img.Id] = i
 			startingItems <- img
 		}
 		close(startingItems)
+		pipelineErrors := make(chan error, len(result.Images))
+		started := time.Now()
+		items := pipeline.Filter(r.Context(), startingItems, pipelineErrors)
 
-		go func() {
-			for err := range pipelineErrors {
-				log.Errorf("Error in the MakeGetImagePipeline: %v", err)
-			}
-		}()
-
-		w.Header().Set("Content-Type", "application/json")
-		counter := 0
-		w.Write([]byte("{\"images\": ["))
+		// The pipeline doesn't keep the order, the images are sent in the order of the page as soon as they can be
+		encoder := newOrderedEncoder(newStreamEncoder(w, r, "images", "image"))
 		for item := range items {
-			log.Debugf("Sending image no: %d", counter)
-			counter++
 			img := item.(*image.ImageBase64)
-			err := json.NewEncoder(w).Encode(img)
-			if err != nil {
-				w.WriteHeader(500)
-			}
-			w.Write([]byte(","))
+			encoder.EncodeAt(positions[img.Id], img)
+		}
+		close(pipelineErrors)
+		for err := range pipelineErrors {
+			log.Errorf("Error in the GetAllImagesPipeline: %v", err)
 		}
+		pipeline.FilteringNumber++
+		pipeline.FilteringDuration += time.Since(started)
 
-		w.Write([]byte("\"void\"]}"))
-		w.WriteHeader(200)
+		trailer := struct {
+			NextCursor string `json:"nextCursor,omitempty"`
+		}{result.NextCursor}
+		if err := encoder.Close(trailer); err != nil {
+			log.Errorf("couldn't send the images: %s", err)
+		}
+	}
+}
+
+// exportImages streams a ZIP of the originals of the user's images, selected with the filters of the listing,
+// e.g. /export?ids=1,2,3, /export?albumId=4 or /export?tag=beach
+func exportImages(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeExportImagesPipeline(imagesService)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		filter, err := image.ParseImageFilter(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="images.zip"`)
+		started := time.Now()
+		manifest, err := image.ExportImages(r.Context(), w, imagesService, pipeline, filter)
+		if manifest == nil {
+			// Nothing was written yet
+			log.Errorf("couldn't list the exported images: %s", err)
+			w.Header().Del("Content-Type")
+			w.Header().Del("Content-Disposition")
+			w.WriteHeader(500)
+			return
+		}
+		if err != nil {
+			log.Warnf("export cut short after %d images: %s", len(manifest.Images), err)
+			return
+		}
+		for _, err := range manifest.Errors {
+			log.Errorf("Error in the ExportImagesPipeline: %s", err)
+		}
 		pipeline.FilteringNumber++
 		pipeline.FilteringDuration += time.Since(started)
-		close(pipelineErrors)
 	}
 }
 
-func getImage(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+func getImage(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
 
-	imagesService := image.NewImageService(db)
+	imagesService := image.NewImageService(db, store, Renditions)
 	pipeline := image.MakeGetImagePipeline(imagesService)
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -399,6 +724,11 @@ func getImage(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("image id not an integer"))
 			return
 		}
+		r = withRendition(r)
+		r, ok := withWatermark(imagesService, w, r)
+		if !ok {
+			return
+		}
 
 		ch := make(chan pipe.Item, 1)
 		ch <- imageId
@@ -424,29 +754,658 @@ func getImage(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func encodeS256(password string) (string, error) {
-	h := sha1.New()
-	_, err := h.Write([]byte(password))
-	if err != nil {
-		return "", err
+// getSimilarImages returns the user's images which look like the given one, closest first.
+// How alike they should be is set with ?maxDistance=N, the number of differing bits of the perceptual hashes (0-64).
+func getSimilarImages(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeGetAllImagesPipeline(imagesService)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		maxDistance := DefaultMaxDistance
+		if maxDistanceStr := r.URL.Query().Get("maxDistance"); maxDistanceStr != "" {
+			maxDistance, err = strconv.Atoi(maxDistanceStr)
+			if err != nil || maxDistance < 0 || maxDistance > 64 {
+				w.WriteHeader(400)
+				w.Write([]byte("maxDistance should be an integer between 0 and 64"))
+				return
+			}
+		}
+		r = withRendition(r)
+
+		similar, err := imagesService.FindSimilar(r.Context(), imageId, maxDistance)
+		if errors.Is(err, image.ErrImageNotFound) {
+			w.WriteHeader(404)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if errors.Is(err, image.ErrNoPerceptualHash) {
+			// The backfill hasn't got to it yet
+			w.WriteHeader(409)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			log.Errorf("%v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("errored while finding similar images"))
+			return
+		}
+
+		startingItems := make(chan pipe.Item, len(similar))
+		for _, img := range similar {
+			startingItems <- img
+		}
+		close(startingItems)
+		pipelineErrors := make(chan error, len(similar))
+		started := time.Now()
+		items := pipeline.Filter(r.Context(), startingItems, pipelineErrors)
+
+		response := struct {
+			Images []*image.ImageBase64 `json:"images"`
+		}{[]*image.ImageBase64{}}
+		for item := range items {
+			response.Images = append(response.Images, item.(*image.ImageBase64))
+		}
+		close(pipelineErrors)
+		for err := range pipelineErrors {
+			log.Errorf("Error in the GetAllImagesPipeline: %v", err)
+		}
+		pipeline.FilteringNumber++
+		pipeline.FilteringDuration += time.Since(started)
+
+		// The pipeline doesn't keep the order
+		sort.SliceStable(response.Images, func(i, j int) bool {
+			return *response.Images[i].Distance < *response.Images[j].Distance
+		})
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			w.WriteHeader(500)
+		}
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func readEnvironment() {
-	if envDbHost := os.Getenv("DB_HOST"); envDbHost != "" {
-		DbHost = envDbHost
+// backfillPerceptualHashes computes the perceptual hashes of the images which don't have one
+func backfillPerceptualHashes(db *sql.DB, store image.BlobStore) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeBackfillPerceptualHashesPipeline(imagesService)
+
+	imgs, err := imagesService.GetWithoutPerceptualHash(context.Background())
+	if err != nil {
+		log.Errorf("couldn't get the images to backfill perceptual hashes for: %s", err)
+		return
 	}
-	if envDbPort := os.Getenv("DB_PORT"); envDbPort != "" {
-		DbPort, _ = strconv.Atoi(envDbPort)
+	if len(imgs) == 0 {
+		return
 	}
-	if envDbUsername := os.Getenv("DB_USERNAME"); envDbUsername != "" {
-		DbUser = envDbUsername
+	log.Infof("Backfilling perceptual hashes of %d images...", len(imgs))
+
+	startingItems := make(chan pipe.Item, len(imgs))
+	for _, img := range imgs {
+		startingItems <- img
 	}
-	if envDbPassword := os.Getenv("DB_PASSWORD"); envDbPassword != "" {
-		DbPassword = envDbPassword
+	close(startingItems)
+	errs := make(chan error, len(imgs))
+	items := pipeline.Filter(context.Background(), startingItems, errs)
+	counter := 0
+	for range items {
+		counter++
 	}
-	if envDbName := os.Getenv("DB_NAME"); envDbName != "" {
+	close(errs)
+	for err := range errs {
+		log.Errorf("Error in the BackfillPerceptualHashesPipeline: %v", err)
+	}
+	log.Infof("Backfilled perceptual hashes of %d images", counter)
+}
+
+func getTags(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		tags, err := imagesService.GetTags(r.Context(), imageId)
+		if err != nil {
+			writeTagError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Tags []string `json:"tags"`
+		}{tags})
+	}
+}
+
+// addTags tags the image with the tags given as {"tags": ["beach", "2021"]}
+func addTags(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Tags) == 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("tags should be a list of strings"))
+			return
+		}
+		if err := imagesService.AddTags(r.Context(), imageId, body.Tags); err != nil {
+			writeTagError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+func removeTag(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		if err := imagesService.RemoveTag(r.Context(), imageId, chi.URLParam(r, "tag")); err != nil {
+			writeTagError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+func writeTagError(w http.ResponseWriter, err error) {
+
+	switch {
+	case errors.Is(err, image.ErrInvalidTag):
+		w.WriteHeader(400)
+	case errors.Is(err, image.ErrImageNotFound), errors.Is(err, image.ErrTagNotFound):
+		w.WriteHeader(404)
+	default:
+		log.Errorf("tag error: %s", err)
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// getOriginal serves the image as it was uploaded
+func getOriginal(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		content, err := imagesService.OpenOriginal(r.Context(), imageId)
+		serveContent(w, r, content, err)
+	}
+}
+
+func getThumbnail(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		content, err := imagesService.OpenThumbnail(r.Context(), imageId)
+		serveContent(w, r, content, err)
+	}
+}
+
+func getRendition(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		watermark, err := imagesService.GetWatermark(r.Context())
+		if err != nil {
+			serveContent(w, r, nil, err)
+			return
+		}
+		content, err := imagesService.OpenRendition(r.Context(), imageId, chi.URLParam(r, "name"))
+		if err == nil && watermark != nil && watermark.ApplyOn == image.WatermarkOnServe {
+			content, err = watermark.WatermarkContent(content, image.WatermarkQuality)
+		}
+		serveContent(w, r, content, err)
+	}
+}
+
+// resizeImage renders a variant of the image on the fly, like /{imageId}/resize?w=800&h=600&fit=crop&format=png&q=90
+func resizeImage(db *sql.DB, store image.BlobStore, cache *image.DiskCache) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	resizer := image.NewResizer(db, store, cache)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		params, err := image.ParseResizeParams(r.URL.Query(), Resize)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		// Resized variants are made when they're served, they get the watermark either way
+		if params.Watermark, err = imagesService.GetWatermark(r.Context()); err != nil {
+			serveContent(w, r, nil, err)
+			return
+		}
+		content, err := resizer.Resize(r.Context(), imageId, params)
+		serveContent(w, r, content, err)
+	}
+}
+
+// serveContent writes the file of an image. http.ServeContent answers the conditional and range requests.
+func serveContent(w http.ResponseWriter, r *http.Request, content *image.Content, err error) {
+
+	if errors.Is(err, image.ErrImageNotFound) || errors.Is(err, image.ErrRenditionNotFound) || errors.Is(err, image.ErrBlobNotFound) {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Errorf("couldn't open image content: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", content.MimeType)
+	w.Header().Set("ETag", content.ETag)
+	w.Header().Set("Cache-Control", ImageCacheControl)
+	http.ServeContent(w, r, "", content.ModTime, content)
+}
+
+// withRendition puts the rendition requested with ?rendition=<name> into the context, for the LoadRenditionWorker
+func withRendition(r *http.Request) *http.Request {
+	rendition := r.URL.Query().Get("rendition")
+	if rendition == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), "rendition", rendition))
+}
+
+func deleteImage(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeDeleteImagesPipeline(imagesService)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+
+		deleted, errs := filterDeletes(r.Context(), pipeline, []int{imageId})
+		if len(errs) > 0 {
+			if errors.Is(errs[0], image.ErrImageNotFound) {
+				w.WriteHeader(404)
+			} else {
+				w.WriteHeader(500)
+			}
+			w.Write([]byte(errs[0].Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(deleted[0]); err != nil {
+			w.WriteHeader(500)
+		}
+	}
+}
+
+// editRequest is the body of the edit requests, e.g. {"operations": [{"op": "rotate", "angle": 90}], "saveAs": "version"}
+type editRequest struct {
+	ImageIds   []int                 `json:"imageIds"` // Only for editing many images
+	Operations []image.EditOperation `json:"operations"`
+	SaveAs     image.SaveAs          `json:"saveAs"` // image by default
+}
+
+// editPipeline reads the edit request and makes its pipeline, the pipeline depends on the operations
+func editPipeline(imagesService image.ImageService, w http.ResponseWriter, r *http.Request) (*editRequest, *pipe.Pipeline, bool) {
+
+	var body editRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("body should be a JSON object with the operations"))
+		return nil, nil, false
+	}
+	if body.SaveAs == "" {
+		body.SaveAs = image.SaveAsImage
+	}
+	pipeline, err := image.MakeEditImagesPipeline(imagesService, body.Operations, body.SaveAs)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return nil, nil, false
+	}
+	return &body, pipeline, true
+}
+
+// editImage edits the image and saves the result as a new image or a new version, see image.EditOperation
+func editImage(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		_, pipeline, ok := editPipeline(imagesService, w, r)
+		if !ok {
+			return
+		}
+		if r, ok = withWatermark(imagesService, w, r); !ok {
+			return
+		}
+
+		edited, errs := filterEdits(r.Context(), pipeline, []int{imageId})
+		switch {
+		case len(errs) > 0 && errors.Is(errs[0], image.ErrImageNotFound):
+			w.WriteHeader(404)
+			w.Write([]byte(errs[0].Error()))
+		case len(errs) > 0 && errors.Is(errs[0], image.ErrBadEdit):
+			w.WriteHeader(400)
+			w.Write([]byte(errs[0].Error()))
+		case len(edited) == 0:
+			w.WriteHeader(500)
+			w.Write([]byte("errored while editing the image"))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(201)
+			if err := json.NewEncoder(w).Encode(edited[0]); err != nil {
+				log.Errorf("couldn't write the edited image: %s", err)
+			}
+		}
+	}
+}
+
+// editImages does the same edit on many images. The images which couldn't be edited are in the errors.
+func editImages(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		body, pipeline, ok := editPipeline(imagesService, w, r)
+		if !ok {
+			return
+		}
+		if r, ok = withWatermark(imagesService, w, r); !ok {
+			return
+		}
+		if len(body.ImageIds) == 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("imageIds should be a list of image ids"))
+			return
+		}
+
+		edited, errs := filterEdits(r.Context(), pipeline, body.ImageIds)
+		response := struct {
+			Images []*image.ImageBase64 `json:"images"`
+			Errors []string             `json:"errors"`
+		}{edited, []string{}}
+		for _, err := range errs {
+			response.Errors = append(response.Errors, err.Error())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			w.WriteHeader(500)
+		}
+	}
+}
+
+func filterEdits(ctx context.Context, pipeline *pipe.Pipeline, imageIds []int) ([]*image.ImageBase64, []error) {
+
+	startingItems := make(chan pipe.Item, len(imageIds))
+	for _, imageId := range imageIds {
+		startingItems <- imageId
+	}
+	close(startingItems)
+
+	errs := make(chan error, len(imageIds))
+	items := pipeline.Filter(ctx, startingItems, errs)
+
+	edited := []*image.ImageBase64{}
+	for item := range items {
+		edited = append(edited, item.(*image.ImageBase64))
+	}
+	close(errs)
+	var errList []error
+	for err := range errs {
+		log.Errorf("Error in the EditImagesPipeline: %v", err)
+		errList = append(errList, err)
+	}
+	return edited, errList
+}
+
+// getVersions returns the versions of the image made by editing it, the first one first
+func getVersions(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeGetAllImageUrlsPipeline(ImagesPrefix, imagesService)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		imageId, err := strconv.Atoi(chi.URLParam(r, "imageId"))
+		if err != nil {
+			w.WriteHeader(404)
+			w.Write([]byte("image id not an integer"))
+			return
+		}
+		imgs, err := imagesService.GetVersions(r.Context(), imageId)
+		if errors.Is(err, image.ErrImageNotFound) {
+			w.WriteHeader(404)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			log.Errorf("%v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("errored while getting the versions"))
+			return
+		}
+
+		positions := make(map[int]int, len(imgs))
+		startingItems := make(chan pipe.Item, len(imgs))
+		for i, img := range imgs {
+			positions[img.Id] = i
+			startingItems <- img
+		}
+		close(startingItems)
+		errs := make(chan error, len(imgs))
+		items := pipeline.Filter(r.Context(), startingItems, errs)
+		versions := make([]*image.ImageBase64, len(imgs))
+		for item := range items {
+			img := item.(*image.ImageBase64)
+			versions[positions[img.Id]] = img
+		}
+		close(errs)
+		for err := range errs {
+			log.Errorf("Error in the GetAllImageUrlsPipeline: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Images []*image.ImageBase64 `json:"images"`
+		}{versions}); err != nil {
+			w.WriteHeader(500)
+		}
+	}
+}
+
+// deleteImages deletes the images given as ?ids=1,2,3 concurrently
+func deleteImages(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeDeleteImagesPipeline(imagesService)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var imageIds []int
+		for _, idStr := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			imageId, err := strconv.Atoi(strings.TrimSpace(idStr))
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("ids should be a comma separated list of image ids"))
+				return
+			}
+			imageIds = append(imageIds, imageId)
+		}
+
+		deleted, errs := filterDeletes(r.Context(), pipeline, imageIds)
+		response := struct {
+			Images []*image.DeletedImage `json:"images"`
+			Errors []string              `json:"errors"`
+		}{deleted, []string{}}
+		for _, err := range errs {
+			response.Errors = append(response.Errors, err.Error())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			w.WriteHeader(500)
+		}
+	}
+}
+
+func filterDeletes(ctx context.Context, pipeline *pipe.Pipeline, imageIds []int) ([]*image.DeletedImage, []error) {
+
+	startingItems := make(chan pipe.Item, len(imageIds))
+	for _, imageId := range imageIds {
+		startingItems <- imageId
+	}
+	close(startingItems)
+
+	errs := make(chan error, len(imageIds))
+	started := time.Now()
+	items := pipeline.Filter(ctx, startingItems, errs)
+
+	deleted := []*image.DeletedImage{}
+	for item := range items {
+		deleted = append(deleted, item.(*image.DeletedImage))
+	}
+	close(errs)
+	var errList []error
+	for err := range errs {
+		log.Errorf("Error in the DeleteImagesPipeline: %v", err)
+		errList = append(errList, err)
+	}
+	pipeline.FilteringNumber++
+	pipeline.FilteringDuration += time.Since(started)
+	return deleted, errList
+}
+
+func encodeS256(password string) (string, error) {
+	h := sha1.New()
+	_, err := h.Write([]byte(password))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newBlobStore picks the storage backend for image files based on BlobBackend
+func newBlobStore() (image.BlobStore, error) {
+	switch BlobBackend {
+	case "local":
+		return image.NewLocalBlobStore(BlobDir)
+	case "memory":
+		return image.NewMemoryBlobStore(), nil
+	case "s3":
+		return image.NewS3BlobStore(S3Endpoint, S3Region, S3Bucket, S3AccessKey, S3SecretKey), nil
+	default:
+		return nil, fmt.Errorf("unknown blob backend: %s", BlobBackend)
+	}
+}
+
+// newJobRunner makes the runner of the asynchronous uploads, with a create pipeline of its own, and resumes the jobs
+// left unfinished when the server stopped
+func newJobRunner(db *sql.DB, store image.BlobStore) (*job.Runner, error) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeCreateImagesPipelineBoundedFilters(imagesService)
+	runner, err := job.NewRunner(job.NewService(db), imagesService, pipeline, StagingDir, JobWorkers)
+	if err != nil {
+		return nil, err
+	}
+	resumed, err := runner.Resume(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resume the jobs: %s", err)
+	}
+	if resumed > 0 {
+		log.Infof("Resumed %d unfinished jobs", resumed)
+	}
+	return runner, nil
+}
+
+func readEnvironment() {
+	if envDbHost := os.Getenv("DB_HOST"); envDbHost != "" {
+		DbHost = envDbHost
+	}
+	if envDbPort := os.Getenv("DB_PORT"); envDbPort != "" {
+		DbPort, _ = strconv.Atoi(envDbPort)
+	}
+	if envDbUsername := os.Getenv("DB_USERNAME"); envDbUsername != "" {
+		DbUser = envDbUsername
+	}
+	if envDbPassword := os.Getenv("DB_PASSWORD"); envDbPassword != "" {
+		DbPassword = envDbPassword
+	}
+	if envDbName := os.Getenv("DB_NAME"); envDbName != "" {
 		DbName = envDbName
 	}
 	if envHttpPort := os.Getenv("HTTP_PORT"); envHttpPort != "" {
@@ -473,6 +1432,73 @@ func readEnvironment() {
 	if envLoadRego := os.Getenv("LOAD_REGO_PATH"); envLoadRego != "" {
 		LoadRegoPath = envLoadRego
 	}
+	if envRenditions := os.Getenv("RENDITIONS"); envRenditions != "" {
+		var renditions []image.Rendition
+		if err := json.Unmarshal([]byte(envRenditions), &renditions); err != nil {
+			log.Errorf("bad RENDITIONS, using the defaults: %s", err)
+		} else {
+			Renditions = renditions
+		}
+	}
+	if envResize := os.Getenv("RESIZE"); envResize != "" {
+		// The fields it leaves out keep their defaults
+		resize := image.DefaultResizeConfig.Copy()
+		if err := json.Unmarshal([]byte(envResize), &resize); err != nil {
+			log.Errorf("bad RESIZE, using the defaults: %s", err)
+		} else {
+			Resize = resize
+		}
+	}
+	if envResizeCacheDir := os.Getenv("RESIZE_CACHE_DIR"); envResizeCacheDir != "" {
+		ResizeCacheDir = envResizeCacheDir
+	}
+	if envResizeCacheMB := os.Getenv("RESIZE_CACHE_MB"); envResizeCacheMB != "" {
+		if mb, err := strconv.Atoi(envResizeCacheMB); err == nil {
+			ResizeCacheMB = mb
+		}
+	}
+	if envUploadDir := os.Getenv("UPLOAD_DIR"); envUploadDir != "" {
+		UploadDir = envUploadDir
+	}
+	if envUploadMaxMB := os.Getenv("UPLOAD_MAX_MB"); envUploadMaxMB != "" {
+		if mb, err := strconv.Atoi(envUploadMaxMB); err == nil {
+			UploadMaxMB = mb
+		}
+	}
+	if envUploadExpiry := os.Getenv("UPLOAD_EXPIRY"); envUploadExpiry != "" {
+		if expiry, err := time.ParseDuration(envUploadExpiry); err == nil {
+			UploadExpiry = expiry
+		}
+	}
+	if envStagingDir := os.Getenv("STAGING_DIR"); envStagingDir != "" {
+		StagingDir = envStagingDir
+	}
+	if envJobWorkers := os.Getenv("JOB_WORKERS"); envJobWorkers != "" {
+		if workers, err := strconv.Atoi(envJobWorkers); err == nil && workers > 0 {
+			JobWorkers = workers
+		}
+	}
+	if envBlobBackend := os.Getenv("BLOB_BACKEND"); envBlobBackend != "" {
+		BlobBackend = envBlobBackend
+	}
+	if envBlobDir := os.Getenv("BLOB_DIR"); envBlobDir != "" {
+		BlobDir = envBlobDir
+	}
+	if envS3Endpoint := os.Getenv("S3_ENDPOINT"); envS3Endpoint != "" {
+		S3Endpoint = envS3Endpoint
+	}
+	if envS3Region := os.Getenv("S3_REGION"); envS3Region != "" {
+		S3Region = envS3Region
+	}
+	if envS3Bucket := os.Getenv("S3_BUCKET"); envS3Bucket != "" {
+		S3Bucket = envS3Bucket
+	}
+	if envS3AccessKey := os.Getenv("S3_ACCESS_KEY"); envS3AccessKey != "" {
+		S3AccessKey = envS3AccessKey
+	}
+	if envS3SecretKey := os.Getenv("S3_SECRET_KEY"); envS3SecretKey != "" {
+		S3SecretKey = envS3SecretKey
+	}
 }
 
 func runCollector(conf *metrics.Config) {
@@ -488,6 +1514,24 @@ func runCollector(conf *metrics.Config) {
 	}
 }
 
+// openDb connects to the database and waits until it's up
+func openDb() (*sql.DB, error) {
+
+	psqlInfo := fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		DbHost, DbPort, DbUser, DbPassword, DbName)
+	db, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(MaxOpenConns)
+	if err := pingDb(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
 func pingDb(db *sql.DB) (err error) {
 	for i := 0; i < 10; i++ {
 		err = db.Ping()
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ele7ija/go-pipelines/image"
+	"github.com/ele7ija/go-pipelines/policy"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type allowingEngine struct{}
+
+func (allowingEngine) IsAllowed(ctx context.Context, request policy.ImageRequest) (bool, error) {
+	return true, nil
+}
+
+func TestCreateImagesWithPipeline(t *testing.T) {
+
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	images := image.NewImageService(db, image.NewMemoryBlobStore(), image.DefaultRenditions)
+	handler := createImagesWithPipeline(image.MakeCreateImagesPipelineBoundedFilters(images), allowingEngine{})
+
+	upload := func(t *testing.T, accept string) *httptest.ResponseRecorder {
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, name := range []string{"a.jpg", "b.jpg"} {
+			f, _ := mw.CreateFormFile("images", name)
+			f.Write([]byte("not an image"))
+		}
+		mw.Close()
+
+		r := httptest.NewRequest("POST", "/api/images", &body).WithContext(context.WithValue(context.Background(), "userId", 1))
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Accept", accept)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		uploads, err := image.NewMultipartUploads(mr)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r, uploads)
+		return w
+	}
+
+	t.Run("json has the status of the response", func(t *testing.T) {
+
+		w := upload(t, FormatJSON)
+		if w.Code != 207 {
+			t.Fatalf("expected 207, got %d: %s", w.Code, w.Body)
+		}
+		var response struct {
+			Files   []*image.UploadResult `json:"files"`
+			Summary image.UploadSummary   `json:"summary"`
+			Status  *int                  `json:"status"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(response.Files) != 2 || response.Files[0].Name != "a.jpg" || response.Summary.Failed != 2 || response.Status != nil {
+			t.Errorf("incorrect response: %+v", response)
+		}
+	})
+
+	t.Run("ndjson has the status with the summary", func(t *testing.T) {
+
+		w := upload(t, FormatNDJSON)
+		if w.Code != 200 {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("expected 2 results and the summary, got: %q", lines)
+		}
+		var trailer struct {
+			Summary image.UploadSummary `json:"summary"`
+			Status  int                 `json:"status"`
+		}
+		if err := json.Unmarshal([]byte(lines[2]), &trailer); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if trailer.Summary.Failed != 2 || trailer.Status != 207 {
+			t.Errorf("incorrect trailer: %+v", trailer)
+		}
+	})
+}
+
+func TestCreateImagesFromArchive(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	mock.ExpectQuery("SELECT (.+) FROM user_watermark").WillReturnRows(sqlmock.NewRows([]string{"text", "logo", "position", "opacity", "scale", "apply_on"}))
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "README", Mode: 0644, Size: 5})
+	tw.Write([]byte("notes"))
+	tw.Close()
+
+	// The archive is the file of a form that isn't parsed up front
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	f, _ := mw.CreateFormFile("archive", "photos.tar")
+	f.Write(archive.Bytes())
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/api/images/archive", &body).WithContext(context.WithValue(context.Background(), "userId", 1))
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	createImagesFromArchive(db, image.NewMemoryBlobStore(), allowingEngine{})(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	var response struct {
+		Entries []*image.UploadResult `json:"entries"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(response.Entries) != 1 || response.Entries[0].Name != "README" || response.Entries[0].Status != image.UploadSkipped {
+		t.Errorf("incorrect entries: %+v", response.Entries)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Formats of the streamed responses, picked with the Accept header
+const (
+	FormatJSON   = "application/json"
+	FormatNDJSON = "application/x-ndjson"
+	FormatSSE    = "text/event-stream"
+)
+
+// negotiateFormat picks the format the client prefers by the q values of the Accept header, JSON when it doesn't ask for one
+func negotiateFormat(accept string) string {
+
+	format, best := FormatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case FormatJSON, FormatNDJSON, FormatSSE:
+			if q > best {
+				format, best = mediaType, q
+			}
+		}
+	}
+	return format
+}
+
+// streamEncoder writes items as they leave a pipeline, flushing every one of them:
+//   - JSON is an object with the items in an array under the key, and the fields of the trailer after it
+//   - NDJSON is an item per line, and the trailer on the last line when it has any fields
+//   - SSE is an event per item named by the event, and an "end" event with the trailer
+//
+// Once a write fails, e.g. because the client is gone, the rest are skipped and Close returns the error.
+type streamEncoder struct {
+	w      http.ResponseWriter
+	format string
+	key    string
+	event  string
+	count  int
+	err    error
+}
+
+func newStreamEncoder(w http.ResponseWriter, r *http.Request, key, event string) *streamEncoder {
+
+	e := &streamEncoder{w: w, format: negotiateFormat(r.Header.Get("Accept")), key: key, event: event}
+	w.Header().Set("Content-Type", e.format)
+	w.Header().Add("Vary", "Accept")
+	if e.format == FormatSSE {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	return e
+}
+
+// Incremental is true for the formats whose readers take the items one by one, NDJSON and SSE
+func (e *streamEncoder) Incremental() bool {
+	return e.format != FormatJSON
+}
+
+func (e *streamEncoder) Encode(v interface{}) error {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	switch e.format {
+	case FormatNDJSON:
+		e.write(string(b) + "\n")
+	case FormatSSE:
+		e.write(fmt.Sprintf("event: %s\ndata: %s\n\n", e.event, b))
+	default:
+		if e.count == 0 {
+			e.write(fmt.Sprintf("{%q:[", e.key))
+		} else {
+			e.write(",")
+		}
+		e.write(string(b))
+	}
+	e.count++
+	e.flush()
+	return e.err
+}
+
+// Close ends the stream with the trailer, a struct or a map of what's known only at the end, e.g. the next cursor. It can be nil.
+func (e *streamEncoder) Close(trailer interface{}) error {
+
+	b := []byte("{}")
+	if trailer != nil {
+		var err error
+		if b, err = json.Marshal(trailer); err != nil {
+			return err
+		}
+	}
+	switch e.format {
+	case FormatNDJSON:
+		if string(b) != "{}" {
+			e.write(string(b) + "\n")
+		}
+	case FormatSSE:
+		e.write(fmt.Sprintf("event: end\ndata: %s\n\n", b))
+	default:
+		if e.count == 0 {
+			e.write(fmt.Sprintf("{%q:[", e.key))
+		}
+		e.write("]")
+		if fields := strings.TrimSpace(string(b[1 : len(b)-1])); fields != "" {
+			e.write("," + fields)
+		}
+		e.write("}\n")
+	}
+	e.flush()
+	return e.err
+}
+
+func (e *streamEncoder) write(s string) {
+	if e.err == nil {
+		_, e.err = io.WriteString(e.w, s)
+	}
+}
+
+func (e *streamEncoder) flush() {
+	if f, ok := e.w.(http.Flusher); ok && e.err == nil {
+		f.Flush()
+	}
+}
+
+// orderedEncoder encodes the items by their positions, the ones that come before their turn are held back until it.
+// It's for the pipelines that don't keep the order, the items still go out as soon as the ones before them did.
+type orderedEncoder struct {
+	*streamEncoder
+	next int
+	held map[int]interface{}
+}
+
+func newOrderedEncoder(e *streamEncoder) *orderedEncoder {
+	return &orderedEncoder{streamEncoder: e, held: make(map[int]interface{})}
+}
+
+func (o *orderedEncoder) EncodeAt(position int, v interface{}) error {
+
+	o.held[position] = v
+	for {
+		v, ok := o.held[o.next]
+		if !ok {
+			return o.err
+		}
+		delete(o.held, o.next)
+		o.next++
+		if err := o.Encode(v); err != nil {
+			return err
+		}
+	}
+}
+
+// Close encodes the items still held back, the ones before them never came, and closes the stream
+func (o *orderedEncoder) Close(trailer interface{}) error {
+
+	positions := make([]int, 0, len(o.held))
+	for position := range o.held {
+		positions = append(positions, position)
+	}
+	sort.Ints(positions)
+	for _, position := range positions {
+		o.Encode(o.held[position])
+	}
+	o.held = make(map[int]interface{})
+	return o.streamEncoder.Close(trailer)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ele7ija/go-pipelines/album"
+	"github.com/ele7ija/go-pipelines/image"
+	"github.com/ele7ija/go-pipelines/policy"
+	pipe "github.com/ele7ija/pipeline"
+	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TusVersion is the version of the tus protocol the resumable uploads speak
+const TusVersion = "1.0.0"
+
+// UploadsPrefix is where the resumable uploads are mounted
+const UploadsPrefix = "/api/uploads"
+
+// uploadsRouter serves resumable uploads with the tus protocol, see https://tus.io/protocols/resumable-upload.
+// Every completed upload is created as an image, the result is kept with the upload until it expires.
+func uploadsRouter(db *sql.DB, store image.BlobStore, uploads *image.ResumableUploads, engine policy.ImageRequestsEngine) http.Handler {
+
+	r := chi.NewRouter()
+	r.Use(tusResumable)
+	r.Options("/", tusOptions(uploads))
+	r.Group(func(r chi.Router) {
+		r.Use(UserOnly(db), AdminOnly(db))
+		r.Post("/", createUpload(uploads, engine))
+		r.Head("/{uploadId}", getUploadOffset(uploads))
+		r.Patch("/{uploadId}", appendUpload(db, store, uploads))
+		r.Get("/{uploadId}", getUpload(uploads))
+		r.Delete("/{uploadId}", deleteUpload(uploads))
+	})
+	return r
+}
+
+// tusExposedHeaders are the headers of the protocol that the browser clients on other origins read
+const tusExposedHeaders = "Upload-Offset, Upload-Length, Upload-Expires, Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size"
+
+// tusResumable answers every request with the version of the protocol, and rejects the requests of other versions
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TusVersion)
+		w.Header().Set("Access-Control-Expose-Headers", tusExposedHeaders)
+		if r.Method == http.MethodOptions || r.Method == http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if v := r.Header.Get("Tus-Resumable"); v != TusVersion {
+			w.Header().Set("Tus-Version", TusVersion)
+			w.WriteHeader(412)
+			w.Write([]byte(fmt.Sprintf("Tus-Resumable should be %s", TusVersion)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tusOptions(uploads *image.ResumableUploads) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(uploads.MaxSize(), 10))
+		w.WriteHeader(204)
+	}
+}
+
+// createUpload starts an upload of the Upload-Length bytes. Upload-Metadata can have the filename of the image,
+// and the albumId of the album to put it into.
+func createUpload(uploads *image.ResumableUploads, engine policy.ImageRequestsEngine) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("Upload-Length should be a positive integer"))
+			return
+		}
+		metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if albumIdStr := metadata["albumId"]; albumIdStr != "" {
+			if _, err := strconv.Atoi(albumIdStr); err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("album id not an integer"))
+				return
+			}
+		}
+
+		b, err := engine.IsAllowed(r.Context(), policy.ImageRequest{
+			Path:           r.URL.Path,
+			Method:         r.Method,
+			Header:         r.Header,
+			NumberOfImages: 1,
+			SizeOfImages:   length,
+		})
+		if b != true || err != nil {
+			w.WriteHeader(403)
+			w.Write([]byte("not allowed"))
+			if err != nil {
+				log.Errorf("policy error happened: %s", err)
+			}
+			return
+		}
+
+		upload, err := uploads.Create(r.Context(), length, metadata)
+		if errors.Is(err, image.ErrUploadTooLarge) {
+			w.WriteHeader(413)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			log.Errorf("couldn't create the upload: %s", err)
+			w.WriteHeader(500)
+			w.Write([]byte("errored while creating the upload"))
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/%s", UploadsPrefix, upload.Id))
+		w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+		w.WriteHeader(201)
+	}
+}
+
+// getUploadOffset tells how much of the upload the server has, where the client resumes from
+func getUploadOffset(uploads *image.ResumableUploads) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		upload, err := uploads.Get(r.Context(), chi.URLParam(r, "uploadId"))
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		writeUploadHeaders(w, upload)
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.WriteHeader(200)
+	}
+}
+
+// appendUpload appends the body at Upload-Offset. Once the upload is complete the image is created,
+// which is in the result of GET.
+func appendUpload(db *sql.DB, store image.BlobStore, uploads *image.ResumableUploads) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+	pipeline := image.MakeCreateImagesPipelineBoundedFilters(imagesService)
+	albumService := album.NewService(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			w.WriteHeader(415)
+			w.Write([]byte("Content-Type should be application/offset+octet-stream"))
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("Upload-Offset should be a non-negative integer"))
+			return
+		}
+
+		upload, err := uploads.Append(r.Context(), chi.URLParam(r, "uploadId"), offset, r.Body)
+		if errors.Is(err, image.ErrUploadComplete) && upload.Result == nil {
+			// Creating the image failed before, it's tried again
+			err = nil
+		}
+		if upload == nil || errors.Is(err, image.ErrUploadOffset) || errors.Is(err, image.ErrUploadComplete) {
+			writeUploadError(w, err)
+			return
+		}
+		if err != nil {
+			// The connection broke off, what came is kept
+			log.Warnf("upload %s interrupted at %d: %s", upload.Id, upload.Offset, err)
+			writeUploadHeaders(w, upload)
+			w.WriteHeader(500)
+			return
+		}
+		if upload.Complete() && upload.Result == nil {
+			// One request at a time creates the image, the others are told it's already being created
+			claimed, err := uploads.Claim(r.Context(), upload.Id)
+			switch {
+			case err == nil:
+				defer uploads.Release(claimed.Id)
+				if ok := createUploadedImage(imagesService, albumService, pipeline, uploads, w, r, claimed); !ok {
+					return
+				}
+				upload = claimed
+			case errors.Is(err, image.ErrUploadComplete):
+				// Another request created it in the meantime
+				upload = claimed
+			default:
+				writeUploadError(w, err)
+				return
+			}
+		}
+		writeUploadHeaders(w, upload)
+		w.WriteHeader(204)
+	}
+}
+
+// createUploadedImage creates the image of the complete upload with the create pipeline, and keeps the result with it
+func createUploadedImage(imagesService image.ImageService, albumService album.Service, pipeline *pipe.Pipeline, uploads *image.ResumableUploads, w http.ResponseWriter, r *http.Request, upload *image.ResumableUpload) bool {
+
+	ctx := r.Context()
+	if albumIdStr := upload.Metadata["albumId"]; albumIdStr != "" {
+		albumId, _ := strconv.Atoi(albumIdStr)
+		if _, err := albumService.Get(ctx, albumId); err != nil {
+			writeAlbumError(w, err)
+			return false
+		}
+		ctx = context.WithValue(ctx, "albumId", albumId)
+	}
+	r, ok := withWatermark(imagesService, w, r.WithContext(ctx))
+	if !ok {
+		return false
+	}
+
+	data, err := uploads.Data(upload)
+	if err != nil {
+		log.Errorf("couldn't read the upload: %s", err)
+		w.WriteHeader(500)
+		return false
+	}
+	feed := func(send func(*image.Upload) error, done func(*image.UploadResult)) error {
+		return send(&image.Upload{Index: 0, Name: upload.Name(), Data: data})
+	}
+	started := time.Now()
+	results, err := image.CreateUploads(r.Context(), pipeline, feed, nil)
+	if err != nil {
+		log.Errorf("couldn't create the uploaded image: %s", err)
+	}
+	pipeline.FilteringNumber++
+	pipeline.FilteringDuration += time.Since(started)
+	if len(results) == 0 {
+		results = append(results, &image.UploadResult{Name: upload.Name(), Status: image.UploadFailed, Code: image.UploadCodeInternal, Error: "internal error"})
+	}
+	if err := uploads.Finish(upload, results[0]); err != nil {
+		log.Errorf("couldn't finish the upload: %s", err)
+		w.WriteHeader(500)
+		return false
+	}
+	return true
+}
+
+// getUpload returns the upload, with the result of creating its image once it's complete
+func getUpload(uploads *image.ResumableUploads) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		upload, err := uploads.Get(r.Context(), chi.URLParam(r, "uploadId"))
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(upload); err != nil {
+			w.WriteHeader(500)
+		}
+	}
+}
+
+func deleteUpload(uploads *image.ResumableUploads) func(w http.ResponseWriter, r *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if err := uploads.Delete(r.Context(), chi.URLParam(r, "uploadId")); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// removeExpiredUploads removes the expired uploads every interval, for as long as the server runs
+func removeExpiredUploads(uploads *image.ResumableUploads, interval time.Duration) {
+
+	for range time.Tick(interval) {
+		removed, err := uploads.RemoveExpired(time.Now())
+		if err != nil {
+			log.Errorf("couldn't remove the expired uploads: %s", err)
+		}
+		if removed > 0 {
+			log.Infof("Removed %d expired uploads", removed)
+		}
+	}
+}
+
+// parseUploadMetadata parses the Upload-Metadata header, comma separated keys with base64 encoded values
+func parseUploadMetadata(header string) (map[string]string, error) {
+
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(parts) == 2 {
+			b, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("Upload-Metadata value of %s isn't base64", parts[0])
+			}
+			value = string(b)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata, nil
+}
+
+func writeUploadHeaders(w http.ResponseWriter, upload *image.ResumableUpload) {
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if !upload.Complete() {
+		w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+
+	switch {
+	case errors.Is(err, image.ErrUploadNotFound):
+		w.WriteHeader(404)
+	case errors.Is(err, image.ErrUploadOffset), errors.Is(err, image.ErrUploadComplete), errors.Is(err, image.ErrUploadCreating):
+		w.WriteHeader(409)
+	case errors.Is(err, image.ErrUploadLocked):
+		w.WriteHeader(423)
+	default:
+		log.Errorf("upload error: %s", err)
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(err.Error()))
+}
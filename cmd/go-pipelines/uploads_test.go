@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTusResumable(t *testing.T) {
+
+	handler := tusResumable(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upload-Offset", "0")
+		w.WriteHeader(204)
+	}))
+
+	t.Run("exposes the headers of the protocol", func(t *testing.T) {
+
+		r := httptest.NewRequest("HEAD", "/api/uploads/abc", nil)
+		r.Header.Set("Tus-Resumable", TusVersion)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != 204 {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+		exposed := w.Header().Get("Access-Control-Expose-Headers")
+		for _, header := range []string{"Upload-Offset", "Upload-Length", "Location", "Tus-Resumable"} {
+			if !strings.Contains(exposed, header) {
+				t.Errorf("%s should be exposed, got: %s", header, exposed)
+			}
+		}
+	})
+
+	t.Run("other versions", func(t *testing.T) {
+
+		r := httptest.NewRequest("PATCH", "/api/uploads/abc", nil)
+		r.Header.Set("Tus-Resumable", "0.2.2")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != 412 || w.Header().Get("Tus-Version") != TusVersion || w.Header().Get("Access-Control-Expose-Headers") == "" {
+			t.Errorf("expected 412 with the headers of the protocol, got %d: %v", w.Code, w.Header())
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/ele7ija/go-pipelines/image"
+	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func watermarkRouter(db *sql.DB, store image.BlobStore) http.Handler {
+
+	r := chi.NewRouter()
+	r.Use(UserOnly(db), AdminOnly(db))
+	r.Get("/", getWatermark(db, store))
+	r.Put("/", saveWatermark(db, store))
+	r.Delete("/", deleteWatermark(db, store))
+	return r
+}
+
+func getWatermark(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		watermark, err := imagesService.GetWatermark(r.Context())
+		if err != nil {
+			log.Errorf("%v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("errored while getting the watermark"))
+			return
+		}
+		if watermark == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("no watermark"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(watermark); err != nil {
+			w.WriteHeader(500)
+		}
+	}
+}
+
+// saveWatermark sets the user's watermark, see image.Watermark for the fields
+func saveWatermark(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var watermark image.Watermark
+		if err := json.NewDecoder(r.Body).Decode(&watermark); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("body should be a JSON watermark"))
+			return
+		}
+		err := imagesService.SaveWatermark(r.Context(), &watermark)
+		if errors.Is(err, image.ErrBadWatermark) {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			log.Errorf("%v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("errored while saving the watermark"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(watermark); err != nil {
+			w.WriteHeader(500)
+		}
+	}
+}
+
+func deleteWatermark(db *sql.DB, store image.BlobStore) func(w http.ResponseWriter, r *http.Request) {
+
+	imagesService := image.NewImageService(db, store, Renditions)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if err := imagesService.DeleteWatermark(r.Context()); err != nil {
+			log.Errorf("%v", err)
+			w.WriteHeader(500)
+			w.Write([]byte("errored while deleting the watermark"))
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// withWatermark puts the user's watermark into the context, for the WatermarkWorker. Users without one get none.
+func withWatermark(imagesService image.ImageService, w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+
+	watermark, err := imagesService.GetWatermark(r.Context())
+	if err != nil {
+		log.Errorf("couldn't get the watermark: %s", err)
+		w.WriteHeader(500)
+		w.Write([]byte("errored while getting the watermark"))
+		return r, false
+	}
+	if watermark == nil {
+		return r, true
+	}
+	return r.WithContext(context.WithValue(r.Context(), "watermark", watermark)), true
+}
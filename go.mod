@@ -12,4 +12,5 @@ require (
 	github.com/open-policy-agent/opa v0.33.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/tevjef/go-runtime-metrics v0.0.0-20170326170900-527a54029307
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
 )
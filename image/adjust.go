@@ -0,0 +1,150 @@
+package image
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Grayscale turns the image into shades of gray, by the luminance of its pixels
+func Grayscale(img image.Image) image.Image {
+
+	b := img.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// Adjust changes the brightness and the contrast of the image, both from -100 to 100. 0 leaves the image as it is.
+func Adjust(img image.Image, brightness, contrast float64) image.Image {
+
+	src := toNRGBA(img)
+	dst := image.NewNRGBA(src.Rect)
+	shift := brightness / 100 * 255
+	factor := 1 + contrast/100
+	var lookup [256]uint8
+	for v := range lookup {
+		lookup[v] = clamp((float64(v)-127.5)*factor + 127.5 + shift)
+	}
+	for i := 0; i < len(src.Pix); i += 4 {
+		dst.Pix[i] = lookup[src.Pix[i]]
+		dst.Pix[i+1] = lookup[src.Pix[i+1]]
+		dst.Pix[i+2] = lookup[src.Pix[i+2]]
+		dst.Pix[i+3] = src.Pix[i+3]
+	}
+	return dst
+}
+
+// Blur blurs the image with a gaussian of the given radius (its standard deviation) in pixels
+func Blur(img image.Image, radius float64) image.Image {
+
+	src := toRGBA(img)
+	if radius <= 0 {
+		return src
+	}
+	kernel := gaussianKernel(radius)
+	return convolve(convolve(src, kernel, true), kernel, false)
+}
+
+// Sharpen sharpens the image with an unsharp mask, amount from 0 to 5 says how much the edges are emphasized
+func Sharpen(img image.Image, amount float64) image.Image {
+
+	src := toRGBA(img)
+	blurred := Blur(src, 1).(*image.RGBA)
+	dst := image.NewRGBA(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		a := src.Pix[i+3]
+		for c := 0; c < 3; c++ {
+			v := float64(src.Pix[i+c]) + amount*(float64(src.Pix[i+c])-float64(blurred.Pix[i+c]))
+			// The colors are premultiplied, they can't exceed the alpha
+			if v = math.Min(v, float64(a)); v < 0 {
+				v = 0
+			}
+			dst.Pix[i+c] = uint8(v + 0.5)
+		}
+		dst.Pix[i+3] = a
+	}
+	return dst
+}
+
+// gaussianKernel returns the normalized weights of a gaussian, from the center outwards
+func gaussianKernel(sigma float64) []float64 {
+
+	size := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, size+1)
+	sum := 0.0
+	for i := range kernel {
+		kernel[i] = math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		sum += kernel[i]
+		if i > 0 {
+			sum += kernel[i]
+		}
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// convolve applies the symmetric kernel along the rows or the columns of the image. The edge pixels are repeated.
+func convolve(src *image.RGBA, kernel []float64, horizontal bool) *image.RGBA {
+
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(src.Rect)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for k := -len(kernel) + 1; k < len(kernel); k++ {
+				sx, sy := x, y
+				if horizontal {
+					sx = clampInt(x+k, 0, w-1)
+				} else {
+					sy = clampInt(y+k, 0, h-1)
+				}
+				weight := kernel[abs(k)]
+				offset := src.PixOffset(sx, sy)
+				for c := 0; c < 4; c++ {
+					sum[c] += weight * float64(src.Pix[offset+c])
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[offset+c] = clamp(sum[c])
+			}
+		}
+	}
+	return dst
+}
+
+// toNRGBA converts the image to non premultiplied RGBA with bounds starting at 0,0
+func toNRGBA(img image.Image) *image.NRGBA {
+
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+	b := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	return nrgba
+}
+
+func clamp(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
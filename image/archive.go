@@ -0,0 +1,169 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	pipe "github.com/ele7ija/pipeline"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ErrUnsupportedArchive is returned when the uploaded archive isn't a zip, a tar or a gzipped tar
+var ErrUnsupportedArchive = fmt.Errorf("unsupported archive, supported are zip, tar and tar.gz")
+
+// MaxArchiveEntrySize is the largest file read from an archive, a file is held in memory while it's in the pipeline
+var MaxArchiveEntrySize int64 = 100 << 20
+
+// ArchiveEntry is a regular file in an archive, its content is read from the embedded reader
+type ArchiveEntry struct {
+	io.Reader
+	Name string
+	Size int64
+}
+
+// ReadArchive calls fn with every regular file of the zip, tar or tar.gz archive, in the order they're stored.
+// The format is sniffed from the content. Tars are read as they stream in, but zips keep their directory at the end,
+// so they're copied into a temporary file first. Reading stops at the first error of fn, which is returned.
+func ReadArchive(r io.Reader, fn func(entry ArchiveEntry) error) error {
+
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return readZip(br, fn)
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrUnsupportedArchive, err)
+		}
+		defer gz.Close()
+		return readTar(gz, fn)
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return readTar(br, fn)
+	}
+	return ErrUnsupportedArchive
+}
+
+func readZip(r io.Reader, fn func(entry ArchiveEntry) error) error {
+
+	f, err := ioutil.TempFile("", "go-pipelines-archive-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return fmt.Errorf("corrupt zip: %s", err)
+	}
+	for _, file := range zr.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("corrupt zip: %s: %s", file.Name, err)
+		}
+		err = fn(ArchiveEntry{rc, file.Name, int64(file.UncompressedSize64)})
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTar(r io.Reader, fn func(entry ArchiveEntry) error) error {
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt tar: %s", err)
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err := fn(ArchiveEntry{tr, h.Name, h.Size}); err != nil {
+			return err
+		}
+	}
+}
+
+// hiddenEntry is true for the files archivers and file systems leave around, e.g. __MACOSX/._img.jpg or .DS_Store
+func hiddenEntry(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// errNotAllowed stops reading the archive once the policy doesn't allow more images
+var errNotAllowed = fmt.Errorf("not allowed")
+
+// ImportArchive streams the images of the archive into the create pipeline as Uploads, so they're created
+// while the rest of the archive is still being read. Files that aren't images are skipped.
+// allow is asked before every image with their count and total size so far, the rest of the archive
+// isn't read once it says no. The result of every file read is returned in the order of the archive.
+// The error is about the archive itself, e.g. when it's corrupt, the images read before it are still created.
+func ImportArchive(ctx context.Context, r io.Reader, pipeline *pipe.Pipeline, allow func(count int, size int64) (bool, error)) ([]*UploadResult, error) {
+
+	feed := func(send func(*Upload) error, done func(*UploadResult)) error {
+		index, count, size := 0, 0, int64(0)
+		err := ReadArchive(r, func(entry ArchiveEntry) error {
+			if hiddenEntry(entry.Name) {
+				return nil
+			}
+			result := &UploadResult{Index: index, Name: entry.Name}
+			index++
+			if entry.Size > MaxArchiveEntrySize {
+				result.fail(UploadCodeTooLarge, fmt.Sprintf("larger than %d B", MaxArchiveEntrySize))
+				done(result)
+				return nil
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(entry, MaxArchiveEntrySize))
+			if err != nil {
+				return fmt.Errorf("%s: %w", entry.Name, err)
+			}
+			if !isImage(data) {
+				result.skip()
+				done(result)
+				return nil
+			}
+
+			count++
+			size += int64(len(data))
+			if ok, err := allow(count, size); !ok || err != nil {
+				result.fail(UploadCodeNotAllowed, "over the limits, the rest of the archive wasn't read")
+				done(result)
+				if err != nil {
+					log.Errorf("policy error happened: %s", err)
+				}
+				return errNotAllowed
+			}
+			return send(&Upload{Index: result.Index, Name: result.Name, Data: data})
+		})
+		if err == errNotAllowed {
+			return nil
+		}
+		return err
+	}
+	return CreateUploads(ctx, pipeline, feed, nil)
+}
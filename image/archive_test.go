@@ -0,0 +1,176 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"io/ioutil"
+	"testing"
+)
+
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+func makeZip(t *testing.T, files []archiveFile) []byte {
+
+	buff := new(bytes.Buffer)
+	zw := zip.NewWriter(buff)
+	if _, err := zw.Create("photos/"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w.Write(f.data)
+	}
+	zw.Close()
+	return buff.Bytes()
+}
+
+func makeTar(t *testing.T, files []archiveFile) []byte {
+
+	buff := new(bytes.Buffer)
+	tw := tar.NewWriter(buff)
+	tw.WriteHeader(&tar.Header{Name: "photos/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.data))}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tw.Write(f.data)
+	}
+	tw.Close()
+	return buff.Bytes()
+}
+
+func TestReadArchive(t *testing.T) {
+
+	files := []archiveFile{{"photos/a.jpg", []byte("a")}, {"notes.txt", []byte("notes")}}
+	tarball := makeTar(t, files)
+	gzipped := new(bytes.Buffer)
+	gw := gzip.NewWriter(gzipped)
+	gw.Write(tarball)
+	gw.Close()
+
+	for name, archive := range map[string][]byte{
+		"zip":    makeZip(t, files),
+		"tar":    tarball,
+		"tar.gz": gzipped.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var read []archiveFile
+			err := ReadArchive(bytes.NewReader(archive), func(entry ArchiveEntry) error {
+				b, err := ioutil.ReadAll(entry)
+				read = append(read, archiveFile{entry.Name, b})
+				return err
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(read) != 2 || read[0].name != "photos/a.jpg" || string(read[1].data) != "notes" {
+				t.Errorf("incorrect entries: %v", read)
+			}
+		})
+	}
+
+	t.Run("not an archive", func(t *testing.T) {
+		b, _ := ioutil.ReadFile(TestImagePath)
+		if err := ReadArchive(bytes.NewReader(b), nil); !errors.Is(err, ErrUnsupportedArchive) {
+			t.Errorf("expected ErrUnsupportedArchive, got: %v", err)
+		}
+	})
+
+	t.Run("stops on error", func(t *testing.T) {
+		stop := errors.New("stop")
+		calls := 0
+		err := ReadArchive(bytes.NewReader(makeZip(t, files)), func(entry ArchiveEntry) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Errorf("reading should stop at the first error, got %v after %d calls", err, calls)
+		}
+	})
+}
+
+func TestImportArchive(t *testing.T) {
+
+	userId := int64(1)
+	ctx := context.WithValue(context.Background(), "userId", userId)
+	photo, _ := ioutil.ReadFile(TestImagePath)
+	archive := makeZip(t, []archiveFile{
+		{"photos/a.jpg", photo},
+		{"notes.txt", []byte("not an image")},
+		{"__MACOSX/photos/._a.jpg", []byte("resource fork")},
+		{"photos/broken.jpg", photo[:100]},
+		{"photos/c.jpg", photo},
+	})
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM image WHERE hash").WillReturnRows(NewImageRows())
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO image").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	for range DefaultRenditions {
+		mock.ExpectExec("INSERT INTO image_renditions").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec("INSERT INTO image_colors").WillReturnResult(sqlmock.NewResult(0, PaletteSize))
+	mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+	var asked []int
+	allow := func(count int, size int64) (bool, error) {
+		asked = append(asked, count)
+		return count <= 2, nil
+	}
+	results, err := ImportArchive(ctx, bytes.NewReader(archive), MakeCreateImagesPipelineBoundedFilters(service), allow)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expected := []struct {
+		name   string
+		status string
+		code   string
+	}{
+		{"photos/a.jpg", UploadSuccess, ""},
+		{"notes.txt", UploadSkipped, UploadCodeNotAnImage},
+		{"photos/broken.jpg", UploadFailed, UploadCodeInvalidImage},
+		{"photos/c.jpg", UploadFailed, UploadCodeNotAllowed},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, e := range expected {
+		if results[i].Index != i || results[i].Name != e.name || results[i].Status != e.status || results[i].Code != e.code {
+			t.Errorf("incorrect result %d: %+v", i, results[i])
+		}
+	}
+	if img := results[0].Image; img == nil || img.Id != 1 || img.Name != "a.jpg" || img.FullBase64 != "" {
+		t.Errorf("incorrect image: %+v", img)
+	}
+	if results[2].Error == "" {
+		t.Errorf("the error should be tied to the entry")
+	}
+	if summary := SummarizeUploads(results); summary != (UploadSummary{Total: 4, Succeeded: 1, Skipped: 1, Failed: 2}) {
+		t.Errorf("incorrect summary: %+v", summary)
+	}
+	if len(asked) != 3 {
+		t.Errorf("the policy should be asked for every image, asked %v", asked)
+	}
+}
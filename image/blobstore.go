@@ -0,0 +1,182 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// BlobStore keeps the encoded image files. Keys are slash separated paths, e.g. "full/4f2a.jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// ErrBlobNotFound is returned by a BlobStore when there's nothing stored under the key
+var ErrBlobNotFound = fmt.Errorf("blob not found")
+
+// NewBlobKey makes a random key in the given namespace, e.g. NewBlobKey("full", ".jpg")
+func NewBlobKey(namespace, ext string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return path.Join(namespace, hex.EncodeToString(b)+ext), nil
+}
+
+// LocalBlobStore keeps the blobs as files under a root directory
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("error creating blob directory: %s", err)
+	}
+	return &LocalBlobStore{root}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+
+	p := filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key)))
+	if p == s.root {
+		return "", fmt.Errorf("invalid blob key: %q", key)
+	}
+	return p, nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a reader never sees a half written blob
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// MemoryBlobStore keeps the blobs in a map. It's meant for tests.
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+
+	return &MemoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *MemoryBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.blobs[key] = b
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+
+	s.mu.RLock()
+	b, ok := s.blobs[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return blobReader{bytes.NewReader(b)}, nil
+}
+
+func (s *MemoryBlobStore) Delete(ctx context.Context, key string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[key]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+// Keys returns all the stored keys with the given prefix
+func (s *MemoryBlobStore) Keys(prefix string) []string {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key := range s.blobs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// blobReader lets the blobs of the MemoryBlobStore be seeked, like the files of the LocalBlobStore
+type blobReader struct {
+	*bytes.Reader
+}
+
+func (blobReader) Close() error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testBlobStore(t *testing.T, store BlobStore) {
+
+	ctx := context.Background()
+	key := "full/test.jpg"
+	content := []byte("some content")
+
+	if err := store.Put(ctx, key, bytes.NewReader(content)); err != nil {
+		t.Fatalf("error while putting: %s", err)
+	}
+
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("error while getting: %s", err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %q, want %q", got, content)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("error while deleting: %s", err)
+	}
+	if _, err := store.Get(ctx, key); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got: %v", err)
+	}
+	if err := store.Delete(ctx, key); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got: %v", err)
+	}
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+
+	testBlobStore(t, NewMemoryBlobStore())
+}
+
+func TestLocalBlobStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalBlobStore(dir)
+	if err != nil {
+		t.Fatalf("error creating store: %s", err)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		testBlobStore(t, store)
+	})
+
+	t.Run("keys stay inside the root", func(t *testing.T) {
+
+		if err := store.Put(context.Background(), "../../escaped.jpg", strings.NewReader("x")); err != nil {
+			t.Fatalf("error while putting: %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "escaped.jpg")); err != nil {
+			t.Errorf("blob was not written inside the root: %s", err)
+		}
+	})
+}
+
+// fakeS3 is a tiny in-memory S3 stand-in
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") ||
+		r.Header.Get("X-Amz-Content-Sha256") == "" {
+		w.WriteHeader(403)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		if sha256Hex(b) != r.Header.Get("X-Amz-Content-Sha256") {
+			w.WriteHeader(400)
+			return
+		}
+		s.objects[r.URL.Path] = b
+	case http.MethodGet:
+		b, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(b)
+	case http.MethodDelete:
+		if _, ok := s.objects[r.URL.Path]; !ok {
+			w.WriteHeader(404)
+			return
+		}
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(204)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store := NewS3BlobStore(server.URL, "us-east-1", "bucket", "access", "secret")
+	testBlobStore(t, store)
+
+	t.Run("objects are stored in the bucket", func(t *testing.T) {
+
+		if err := store.Put(context.Background(), "thumbnail/a.jpg", strings.NewReader("x")); err != nil {
+			t.Fatalf("error while putting: %s", err)
+		}
+		if _, ok := fake.objects["/bucket/thumbnail/a.jpg"]; !ok {
+			t.Errorf("object not found in the bucket")
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package image
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DiskCache keeps derived files in a directory, up to a total size.
+// When it's full, the least recently used files are evicted.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Most recently used at the front
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// NewDiskCache makes a cache in the directory. Files already there are kept, the most recently modified being the most recently used.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) == ".tmp" {
+			continue
+		}
+		c.entries[f.Name()] = c.lru.PushFront(&cacheEntry{f.Name(), f.Size()})
+		c.size += f.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Open opens the cached file, keys are file names
+func (c *DiskCache) Open(key string) (*os.File, bool) {
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// Put caches the file. Files bigger than the whole cache aren't kept.
+func (c *DiskCache) Put(key string, b []byte) error {
+
+	if int64(len(b)) > c.maxBytes {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(c.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, int64(len(b))})
+	c.size += int64(len(b))
+	c.evict()
+	return nil
+}
+
+// Size is the total size of the cached files, in bytes
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// evict removes the least recently used files until the cache fits its size. The caller holds the lock.
+// Files that are open while they're removed can still be read to the end.
+func (c *DiskCache) evict() {
+	for c.size > c.maxBytes {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+		os.Remove(filepath.Join(c.dir, entry.key))
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+	}
+}
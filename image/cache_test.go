@@ -0,0 +1,84 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskCache(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("couldn't make a temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := cache.Put(key, []byte("1234")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		f, ok := cache.Open("a")
+		if !ok {
+			t.Fatalf("a should be cached")
+		}
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(b) != "1234" {
+			t.Errorf("got %q", b)
+		}
+	})
+
+	t.Run("evicts the least recently used", func(t *testing.T) {
+		// a was just opened, so b goes
+		if err := cache.Put("c", []byte("1234")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, ok := cache.Open("b"); ok {
+			t.Errorf("b should be evicted")
+		}
+		if _, err := os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+			t.Errorf("b should be removed from the disk")
+		}
+		if f, ok := cache.Open("a"); !ok {
+			t.Errorf("a should stay")
+		} else {
+			f.Close()
+		}
+		if cache.Size() != 8 {
+			t.Errorf("got size %d, want 8", cache.Size())
+		}
+	})
+
+	t.Run("too big", func(t *testing.T) {
+		if err := cache.Put("d", make([]byte, 11)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, ok := cache.Open("d"); ok {
+			t.Errorf("d shouldn't be cached")
+		}
+	})
+
+	t.Run("reopened", func(t *testing.T) {
+		reopened, err := NewDiskCache(dir, 10)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if reopened.Size() != 8 {
+			t.Errorf("got size %d, want 8", reopened.Size())
+		}
+		if f, ok := reopened.Open("c"); !ok {
+			t.Errorf("c should be cached")
+		} else {
+			f.Close()
+		}
+	})
+}
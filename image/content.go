@@ -0,0 +1,139 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Content is a stored file of an image, ready to be served as it is
+type Content struct {
+	io.ReadSeeker
+	closer   io.Closer
+	MimeType string
+	Size     int64     // 0 when unknown
+	ETag     string    // Quoted, stays the same as long as the bytes do
+	ModTime  time.Time // When the user uploaded the image
+}
+
+func (c *Content) Close() error {
+	return c.closer.Close()
+}
+
+// ImageUrls are where the files of an image are served from
+type ImageUrls struct {
+	Original   string            `json:"original"`
+	Thumbnail  string            `json:"thumbnail"`
+	Renditions map[string]string `json:"renditions,omitempty"`
+}
+
+// NewImageUrls makes the urls of the image and of its renditions under the prefix the images are served from, e.g. /api/images
+func NewImageUrls(prefix string, imageId int, renditions []string) *ImageUrls {
+
+	base := fmt.Sprintf("%s/%d", prefix, imageId)
+	urls := &ImageUrls{
+		Original:  base + "/original",
+		Thumbnail: base + "/thumbnail",
+	}
+	for _, name := range renditions {
+		if urls.Renditions == nil {
+			urls.Renditions = make(map[string]string)
+		}
+		urls.Renditions[name] = base + "/renditions/" + name
+	}
+	return urls
+}
+
+// OpenOriginal opens the bytes of the user's image as they were uploaded
+func (i *imageService) OpenOriginal(ctx context.Context, imageId int) (*Content, error) {
+
+	var path, mimeType, hash string
+	var size int64
+	var modTime time.Time
+	err := i.db.QueryRowContext(ctx, "SELECT fullpath, COALESCE(mime_type, ''), COALESCE(hash, ''), COALESCE(size, 0), user_images.created_at FROM image JOIN user_images ON image_id = id WHERE id = $1 AND user_id = $2",
+		imageId, ctx.Value("userId")).Scan(&path, &mimeType, &hash, &size, &modTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mimeType == "" {
+		// Uploaded before originals were kept, it was stored as a JPEG
+		mimeType = "image/jpeg"
+	}
+	etag := hash
+	if etag == "" {
+		etag = HashContent([]byte(path))
+	}
+	return i.openContent(ctx, path, mimeType, size, etag, modTime)
+}
+
+func (i *imageService) OpenThumbnail(ctx context.Context, imageId int) (*Content, error) {
+
+	var path string
+	var modTime time.Time
+	err := i.db.QueryRowContext(ctx, "SELECT thumbnailpath, user_images.created_at FROM image JOIN user_images ON image_id = id WHERE id = $1 AND user_id = $2",
+		imageId, ctx.Value("userId")).Scan(&path, &modTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return i.openContent(ctx, path, "image/jpeg", 0, HashContent([]byte(path)), modTime)
+}
+
+func (i *imageService) OpenRendition(ctx context.Context, imageId int, name string) (*Content, error) {
+
+	var path, mimeType string
+	var size int64
+	var modTime time.Time
+	err := i.db.QueryRowContext(ctx, "SELECT r.path, r.mime_type, r.size, user_images.created_at FROM image_renditions r JOIN user_images ON user_images.image_id = r.image_id WHERE r.image_id = $1 AND user_id = $2 AND r.name = $3",
+		imageId, ctx.Value("userId"), name).Scan(&path, &mimeType, &size, &modTime)
+	if err == sql.ErrNoRows {
+		if err := i.checkOwner(ctx, imageId); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", ErrRenditionNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return i.openContent(ctx, path, mimeType, size, HashContent([]byte(path)), modTime)
+}
+
+// openContent opens the blob. Blobs are never overwritten, so the ETag can come from the key when there's no content hash.
+func (i *imageService) openContent(ctx context.Context, key, mimeType string, size int64, etag string, modTime time.Time) (*Content, error) {
+
+	f, err := i.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	content := &Content{
+		closer:   f,
+		MimeType: mimeType,
+		Size:     size,
+		ETag:     fmt.Sprintf("%q", etag),
+		ModTime:  modTime,
+	}
+	if rs, ok := f.(io.ReadSeeker); ok {
+		content.ReadSeeker = rs
+		return content, nil
+	}
+
+	// Ranges need seeking, so a remote blob is read whole
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	content.ReadSeeker = bytes.NewReader(b)
+	content.closer = ioutil.NopCloser(nil)
+	content.Size = int64(len(b))
+	return content, nil
+}
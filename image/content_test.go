@@ -0,0 +1,125 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestImageService_OpenOriginal(t *testing.T) {
+
+	userId := 1
+	imageId := 10
+	ctx := context.WithValue(context.Background(), "userId", userId)
+	uploaded := time.Date(2021, 7, 14, 18, 30, 5, 0, time.UTC)
+	columns := []string{"fullpath", "mime_type", "hash", "size", "created_at"}
+
+	t.Run("found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		store := NewMemoryBlobStore()
+		key := StoreTestImage(t, store)
+		original, _ := ioutil.ReadFile(TestImagePath)
+		mock.ExpectQuery("SELECT fullpath, (.+) FROM image JOIN user_images").WithArgs(imageId, userId).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(key, "image/jpeg", "abc", len(original), uploaded))
+
+		service := NewImageService(db, store, DefaultRenditions)
+		content, err := service.OpenOriginal(ctx, imageId)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer content.Close()
+		if content.MimeType != "image/jpeg" || content.ETag != `"abc"` || !content.ModTime.Equal(uploaded) {
+			t.Errorf("content not opened well: %+v", content)
+		}
+
+		// Ranges are served by seeking
+		if _, err := content.Seek(2, io.SeekStart); err != nil {
+			t.Fatalf("content should be seekable: %s", err)
+		}
+		b, _ := ioutil.ReadAll(content)
+		if string(b) != string(original[2:]) {
+			t.Errorf("content differs from the original")
+		}
+	})
+
+	t.Run("someone else's image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT fullpath").WithArgs(imageId, userId).WillReturnRows(sqlmock.NewRows(columns))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.OpenOriginal(ctx, imageId); err != ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+	})
+}
+
+func TestImageService_OpenRendition(t *testing.T) {
+
+	userId := 1
+	imageId := 10
+	ctx := context.WithValue(context.Background(), "userId", userId)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM image_renditions").WithArgs(imageId, userId, "huge").
+		WillReturnRows(sqlmock.NewRows([]string{"path", "mime_type", "size", "created_at"}))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(userId, imageId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+	if _, err := service.OpenRendition(ctx, imageId, "huge"); !errors.Is(err, ErrRenditionNotFound) {
+		t.Errorf("expected ErrRenditionNotFound, got: %v", err)
+	}
+}
+
+func TestLinkWorker(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	// The image was uploaded before the large rendition was configured
+	mock.ExpectQuery("SELECT name FROM image_renditions").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("medium").AddRow("thumb"))
+
+	worker := LinkWorker{"/api/images", NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)}
+	out, err := worker.Work(context.Background(), &Image{Id: 5, Name: "a.jpg"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	img := out.(*ImageBase64)
+	if img.Urls == nil || img.Urls.Original != "/api/images/5/original" || img.Urls.Thumbnail != "/api/images/5/thumbnail" {
+		t.Errorf("urls not made well: %+v", img.Urls)
+	}
+	expected := map[string]string{"medium": "/api/images/5/renditions/medium", "thumb": "/api/images/5/renditions/thumb"}
+	if fmt.Sprint(img.Urls.Renditions) != fmt.Sprint(expected) {
+		t.Errorf("only the stored renditions should be linked, got: %v", img.Urls.Renditions)
+	}
+	if img.FullBase64 != "" || img.ThumbnailBase64 != "" {
+		t.Errorf("nothing should be embedded")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,92 @@
+package image
+
+import (
+	"fmt"
+	pipe "github.com/ele7ija/pipeline"
+	"image"
+)
+
+// ErrBadEdit is returned for edit operations that can't be done
+var ErrBadEdit = fmt.Errorf("bad edit operation")
+
+// EditQuality is the JPEG quality edited images are saved with
+const EditQuality = 90
+
+// MaxEditOperations is how many operations a single edit can have
+const MaxEditOperations = 20
+
+// EditOperation is one step of an edit, e.g. {"op": "rotate", "angle": 90}. The fields used depend on the op:
+//
+//	crop                 x, y, width, height - relative to the upright image
+//	rotate               angle - 90, 180 or 270 degrees clockwise
+//	flip                 direction - horizontal or vertical
+//	grayscale
+//	brightness, contrast amount - from -100 to 100
+//	sharpen              amount - from 0 to 5
+//	blur                 amount - the radius in pixels, from 0 to 50
+type EditOperation struct {
+	Op        string  `json:"op"`
+	X         int     `json:"x,omitempty"`
+	Y         int     `json:"y,omitempty"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	Angle     int     `json:"angle,omitempty"`
+	Direction string  `json:"direction,omitempty"`
+	Amount    float64 `json:"amount,omitempty"`
+}
+
+// SaveAs says how an edited image is saved
+type SaveAs string
+
+const (
+	SaveAsImage   SaveAs = "image"   // A new image, unrelated to the one it was edited from
+	SaveAsVersion SaveAs = "version" // A new version of the image it was edited from
+)
+
+// Worker makes the worker that does the operation on the full image
+func (op EditOperation) Worker() (pipe.Worker, error) {
+
+	switch op.Op {
+	case "crop":
+		if op.X < 0 || op.Y < 0 || op.Width <= 0 || op.Height <= 0 {
+			return nil, fmt.Errorf("%w: crop needs x, y >= 0 and width, height > 0", ErrBadEdit)
+		}
+		return &CropWorker{image.Rect(op.X, op.Y, op.X+op.Width, op.Y+op.Height)}, nil
+	case "rotate":
+		switch op.Angle {
+		case 90, 180, 270:
+			return &RotateWorker{op.Angle}, nil
+		case -90:
+			return &RotateWorker{270}, nil
+		}
+		return nil, fmt.Errorf("%w: rotate angle should be 90, 180 or 270", ErrBadEdit)
+	case "flip":
+		switch op.Direction {
+		case "horizontal", "vertical":
+			return &FlipWorker{Vertical: op.Direction == "vertical"}, nil
+		}
+		return nil, fmt.Errorf("%w: flip direction should be horizontal or vertical", ErrBadEdit)
+	case "grayscale":
+		return &GrayscaleWorker{}, nil
+	case "brightness", "contrast":
+		if op.Amount < -100 || op.Amount > 100 {
+			return nil, fmt.Errorf("%w: %s amount should be from -100 to 100", ErrBadEdit, op.Op)
+		}
+		if op.Op == "brightness" {
+			return &AdjustWorker{Brightness: op.Amount}, nil
+		}
+		return &AdjustWorker{Contrast: op.Amount}, nil
+	case "sharpen":
+		if op.Amount < 0 || op.Amount > 5 {
+			return nil, fmt.Errorf("%w: sharpen amount should be from 0 to 5", ErrBadEdit)
+		}
+		return &SharpenWorker{op.Amount}, nil
+	case "blur":
+		if op.Amount < 0 || op.Amount > 50 {
+			return nil, fmt.Errorf("%w: blur amount should be from 0 to 50", ErrBadEdit)
+		}
+		return &BlurWorker{op.Amount}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", ErrBadEdit, op.Op)
+	}
+}
@@ -0,0 +1,252 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	pipeline2 "github.com/ele7ija/pipeline"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEditOperation_Worker(t *testing.T) {
+
+	valid := []EditOperation{
+		{Op: "crop", X: 10, Y: 10, Width: 100, Height: 50},
+		{Op: "rotate", Angle: 90},
+		{Op: "rotate", Angle: -90},
+		{Op: "flip", Direction: "vertical"},
+		{Op: "grayscale"},
+		{Op: "brightness", Amount: -20},
+		{Op: "contrast", Amount: 100},
+		{Op: "sharpen", Amount: 1.5},
+		{Op: "blur", Amount: 2},
+	}
+	for _, op := range valid {
+		if _, err := op.Worker(); err != nil {
+			t.Errorf("%+v: unexpected error: %s", op, err)
+		}
+	}
+
+	invalid := []EditOperation{
+		{Op: "crop", Width: 0, Height: 50},
+		{Op: "crop", X: -1, Width: 10, Height: 10},
+		{Op: "rotate", Angle: 45},
+		{Op: "flip", Direction: "diagonal"},
+		{Op: "brightness", Amount: 101},
+		{Op: "sharpen", Amount: -1},
+		{Op: "blur", Amount: 51},
+		{Op: "sepia"},
+	}
+	for _, op := range invalid {
+		if _, err := op.Worker(); !errors.Is(err, ErrBadEdit) {
+			t.Errorf("%+v: expected ErrBadEdit, got: %v", op, err)
+		}
+	}
+}
+
+func TestCrop(t *testing.T) {
+
+	src := image.NewRGBA(image.Rect(10, 10, 20, 20))
+	red := color.RGBA{R: 255, A: 255}
+	src.Set(12, 13, red)
+
+	got := Crop(src, image.Rect(2, 3, 6, 5))
+	if got.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Errorf("got bounds %v", got.Bounds())
+	}
+	if got.At(0, 0) != red {
+		t.Errorf("red pixel isn't at the top left corner")
+	}
+}
+
+func TestGrayscale(t *testing.T) {
+
+	got := Grayscale(OpenTestImage(t).Full)
+	r, g, b, _ := got.At(100, 100).RGBA()
+	if r != g || g != b {
+		t.Errorf("pixel isn't gray: %d %d %d", r, g, b)
+	}
+}
+
+func TestAdjust(t *testing.T) {
+
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 2))
+	src.Set(0, 0, color.NRGBA{R: 100, G: 100, B: 100, A: 255})
+	src.Set(0, 1, color.NRGBA{R: 200, G: 200, B: 200, A: 255})
+
+	brighter := Adjust(src, 20, 0).(*image.NRGBA)
+	if brighter.Pix[0] != 151 || brighter.Pix[4] != 251 {
+		t.Errorf("not brighter: %v", brighter.Pix)
+	}
+	flat := Adjust(src, 0, -100).(*image.NRGBA)
+	if flat.Pix[0] != flat.Pix[4] {
+		t.Errorf("no contrast should leave a single shade: %v", flat.Pix)
+	}
+	if same := Adjust(src, 0, 0).(*image.NRGBA); same.Pix[0] != 100 || same.Pix[4] != 200 {
+		t.Errorf("nothing should change: %v", same.Pix)
+	}
+}
+
+func TestBlurSharpen(t *testing.T) {
+
+	// A sharp vertical edge between black and white
+	src := image.NewRGBA(image.Rect(0, 0, 10, 1))
+	for x := 0; x < 10; x++ {
+		v := uint8(0)
+		if x >= 5 {
+			v = 255
+		}
+		src.Set(x, 0, color.RGBA{R: v, G: v, B: v, A: 255})
+	}
+
+	blurred := Blur(src, 1).(*image.RGBA)
+	if v := blurred.Pix[blurred.PixOffset(4, 0)]; v == 0 || v >= 128 {
+		t.Errorf("edge not blurred: %d", v)
+	}
+	if v := blurred.Pix[blurred.PixOffset(0, 0)]; v != 0 {
+		t.Errorf("far from the edge should stay black: %d", v)
+	}
+
+	// Sharpening a blurred edge makes it steeper again
+	sharpened := Sharpen(blurred, 2).(*image.RGBA)
+	if sharpened.Pix[sharpened.PixOffset(4, 0)] >= blurred.Pix[blurred.PixOffset(4, 0)] {
+		t.Errorf("edge not sharpened")
+	}
+	if sharpened.Pix[sharpened.PixOffset(4, 0)+3] != 255 {
+		t.Errorf("alpha should stay")
+	}
+}
+
+func TestEditImagesPipeline(t *testing.T) {
+
+	userId := 1
+	ctx := context.WithValue(context.Background(), "userId", userId)
+	ops := []EditOperation{{Op: "rotate", Angle: 90}, {Op: "crop", Width: 200, Height: 100}, {Op: "grayscale"}}
+
+	t.Run("saved as a version", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		store := NewMemoryBlobStore()
+		key := StoreTestImage(t, store)
+		mock.ExpectQuery("SELECT (.+) FROM image JOIN user_images").WithArgs(1, userId).
+			WillReturnRows(NewImageRows().AddRow(1, "test.jpg", key, key, 320, 240, "abc", "jpeg", "image/jpeg", 100))
+		mock.ExpectQuery("SELECT (.+) FROM image_metadata").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"orientation"}))
+		mock.ExpectQuery("SELECT (.+) FROM image WHERE hash").WillReturnRows(NewImageRows())
+		mock.ExpectBegin()
+		mock.ExpectQuery("INSERT INTO image").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+		for range DefaultRenditions {
+			mock.ExpectExec("INSERT INTO image_renditions").WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		mock.ExpectExec("INSERT INTO image_colors").WillReturnResult(sqlmock.NewResult(0, PaletteSize))
+		mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectQuery("UPDATE user_images SET version_of").WithArgs(userId, 1, 2).
+			WillReturnRows(sqlmock.NewRows([]string{"version_of"}).AddRow(1))
+
+		service := NewImageService(db, store, DefaultRenditions)
+		pipeline, err := MakeEditImagesPipeline(service, ops, SaveAsVersion)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		inputChan := make(chan pipeline2.Item, 1)
+		errors := make(chan error, 1)
+		inputChan <- 1
+		close(inputChan)
+		edited := 0
+		for item := range pipeline.Filter(ctx, inputChan, errors) {
+			edited++
+			img := item.(*ImageBase64)
+			if img.Id != 2 || img.EditedFrom != 1 || img.VersionOf == nil || *img.VersionOf != 1 {
+				t.Errorf("not saved as a version: %+v", img)
+			}
+			if img.Resolution != image.Pt(200, 100) || img.Format != "jpeg" || img.Hash == "abc" {
+				t.Errorf("not edited well: %v, %s", img.Resolution, img.Format)
+			}
+		}
+		close(errors)
+		for err := range errors {
+			t.Errorf("Error: %v", err)
+		}
+		if edited != 1 {
+			t.Errorf("got %d edited images, want 1", edited)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("crop outside the image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		store := NewMemoryBlobStore()
+		key := StoreTestImage(t, store)
+		mock.ExpectQuery("SELECT (.+) FROM image JOIN user_images").WithArgs(1, userId).
+			WillReturnRows(NewImageRows().AddRow(1, "test.jpg", key, key, 320, 240, "abc", "jpeg", "image/jpeg", 100))
+		mock.ExpectQuery("SELECT (.+) FROM image_metadata").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"orientation"}))
+
+		service := NewImageService(db, store, DefaultRenditions)
+		pipeline, _ := MakeEditImagesPipeline(service, []EditOperation{{Op: "crop", Width: 321, Height: 10}}, SaveAsImage)
+
+		inputChan := make(chan pipeline2.Item, 1)
+		errs := make(chan error, 1)
+		inputChan <- 1
+		close(inputChan)
+		for range pipeline.Filter(ctx, inputChan, errs) {
+			t.Errorf("nothing should be edited")
+		}
+		close(errs)
+		if err := <-errs; !errors.Is(err, ErrBadEdit) {
+			t.Errorf("expected ErrBadEdit, got: %v", err)
+		}
+	})
+
+	t.Run("someone else's image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) FROM image JOIN user_images").WithArgs(1, userId).WillReturnRows(NewImageRows())
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		pipeline, _ := MakeEditImagesPipeline(service, ops, SaveAsImage)
+
+		inputChan := make(chan pipeline2.Item, 1)
+		errs := make(chan error, 1)
+		inputChan <- 1
+		close(inputChan)
+		for range pipeline.Filter(ctx, inputChan, errs) {
+			t.Errorf("nothing should be edited")
+		}
+		close(errs)
+		if err := <-errs; !errors.Is(err, ErrImageNotFound) {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+
+		service := NewImageService(nil, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := MakeEditImagesPipeline(service, nil, SaveAsImage); !errors.Is(err, ErrBadEdit) {
+			t.Errorf("expected ErrBadEdit without operations, got: %v", err)
+		}
+		if _, err := MakeEditImagesPipeline(service, ops, "copy"); !errors.Is(err, ErrBadEdit) {
+			t.Errorf("expected ErrBadEdit for an unknown save as, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Exif holds the EXIF fields we care about. Zero values mean the field wasn't present.
+type Exif struct {
+	Orientation  int        `json:"orientation,omitempty"`
+	CameraMake   string     `json:"cameraMake,omitempty"`
+	CameraModel  string     `json:"cameraModel,omitempty"`
+	Lens         string     `json:"lens,omitempty"`
+	ExposureTime string     `json:"exposureTime,omitempty"` // e.g. "1/250"
+	FNumber      float64    `json:"fNumber,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focalLength,omitempty"` // In mm
+	DateTaken    *time.Time `json:"dateTaken,omitempty"`
+	GPS          *GPS       `json:"gps,omitempty"`
+}
+
+type GPS struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude,omitempty"` // In meters above sea level
+}
+
+// ErrNoExif is returned by ParseExif when the content has no EXIF data
+var ErrNoExif = fmt.Errorf("no exif data")
+
+// EXIF tags, as defined by the EXIF 2.32 specification
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+	tagGPSAltitudeRef   = 0x0005
+	tagGPSAltitude      = 0x0006
+)
+
+// ParseExif reads the EXIF data from the raw bytes of a JPEG or a TIFF, without decoding the image
+func ParseExif(b []byte) (*Exif, error) {
+
+	tiff := findTIFF(b)
+	if tiff == nil {
+		return nil, ErrNoExif
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(tiff, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(tiff, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad tiff header")
+	}
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("short tiff header")
+	}
+	r := ifdReader{tiff, order}
+
+	ifd0, err := r.readIFD(order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	x := &Exif{
+		CameraMake:  ifd0.string(tagMake),
+		CameraModel: ifd0.string(tagModel),
+		Orientation: int(ifd0.uint(tagOrientation)),
+	}
+
+	if offset := ifd0.uint(tagExifIFD); offset != 0 {
+		exifIFD, err := r.readIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		x.Lens = exifIFD.string(tagLensModel)
+		x.ISO = int(exifIFD.uint(tagISO))
+		if v := exifIFD.rationals(tagFNumber); len(v) > 0 {
+			x.FNumber = v[0]
+		}
+		if v := exifIFD.rationals(tagFocalLength); len(v) > 0 {
+			x.FocalLength = v[0]
+		}
+		if v := exifIFD.rationals(tagExposureTime); len(v) > 0 && v[0] > 0 {
+			x.ExposureTime = formatExposure(v[0])
+		}
+		if t, err := time.Parse("2006:01:02 15:04:05", exifIFD.string(tagDateTimeOriginal)); err == nil {
+			x.DateTaken = &t
+		}
+	}
+
+	if offset := ifd0.uint(tagGPSIFD); offset != 0 {
+		gpsIFD, err := r.readIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		lat, lon := gpsIFD.rationals(tagGPSLatitude), gpsIFD.rationals(tagGPSLongitude)
+		if len(lat) == 3 && len(lon) == 3 {
+			gps := &GPS{
+				Latitude:  lat[0] + lat[1]/60 + lat[2]/3600,
+				Longitude: lon[0] + lon[1]/60 + lon[2]/3600,
+			}
+			if gpsIFD.string(tagGPSLatitudeRef) == "S" {
+				gps.Latitude = -gps.Latitude
+			}
+			if gpsIFD.string(tagGPSLongitudeRef) == "W" {
+				gps.Longitude = -gps.Longitude
+			}
+			if alt := gpsIFD.rationals(tagGPSAltitude); len(alt) > 0 {
+				gps.Altitude = alt[0]
+				if gpsIFD.uint(tagGPSAltitudeRef) == 1 {
+					gps.Altitude = -gps.Altitude
+				}
+			}
+			x.GPS = gps
+		}
+	}
+
+	return x, nil
+}
+
+// findTIFF returns the TIFF structure holding the EXIF data: the APP1 segment of a JPEG or the whole TIFF file
+func findTIFF(b []byte) []byte {
+
+	if bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*")) {
+		return b
+	}
+	if !bytes.HasPrefix(b, []byte{0xFF, 0xD8}) {
+		return nil
+	}
+
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return nil
+		}
+		marker := b[i+1]
+		if marker == 0xDA || marker == 0xD9 { // Start of scan or end of image, no more metadata
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		if length < 2 || i+2+length > len(b) {
+			return nil
+		}
+		segment := b[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+func formatExposure(seconds float64) string {
+	if seconds >= 1 {
+		return fmt.Sprintf("%g", seconds)
+	}
+	return fmt.Sprintf("1/%d", int(math.Round(1/seconds)))
+}
+
+type ifdReader struct {
+	tiff  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+type ifd struct {
+	entries map[uint16]ifdEntry
+	order   binary.ByteOrder
+}
+
+// Sizes of the TIFF field types, in bytes
+var typeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (r ifdReader) readIFD(offset uint32) (ifd, error) {
+
+	tiff := r.tiff
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return ifd{}, fmt.Errorf("ifd offset out of range")
+	}
+	n := uint32(r.order.Uint16(tiff[offset:]))
+	if uint64(offset)+2+uint64(n)*12 > uint64(len(tiff)) {
+		return ifd{}, fmt.Errorf("ifd entries out of range")
+	}
+
+	entries := make(map[uint16]ifdEntry, n)
+	for i := uint32(0); i < n; i++ {
+		e := tiff[offset+2+i*12:]
+		tag := r.order.Uint16(e)
+		typ := r.order.Uint16(e[2:])
+		count := r.order.Uint32(e[4:])
+		size, ok := typeSizes[typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(count)
+		var data []byte
+		if total <= 4 {
+			data = e[8 : 8+total]
+		} else {
+			valueOffset := uint64(r.order.Uint32(e[8:]))
+			if valueOffset+total > uint64(len(tiff)) {
+				continue
+			}
+			data = tiff[valueOffset : valueOffset+total]
+		}
+		entries[tag] = ifdEntry{typ, count, data}
+	}
+	return ifd{entries, r.order}, nil
+}
+
+func (d ifd) string(tag uint16) string {
+	e, ok := d.entries[tag]
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+// uint returns the first value of a BYTE, SHORT or LONG entry
+func (d ifd) uint(tag uint16) uint32 {
+	e, ok := d.entries[tag]
+	if !ok || e.count == 0 {
+		return 0
+	}
+	switch e.typ {
+	case 1:
+		return uint32(e.data[0])
+	case 3:
+		return uint32(d.order.Uint16(e.data))
+	case 4:
+		return d.order.Uint32(e.data)
+	}
+	return 0
+}
+
+func (d ifd) rationals(tag uint16) []float64 {
+	e, ok := d.entries[tag]
+	if !ok || (e.typ != 5 && e.typ != 10) {
+		return nil
+	}
+	values := make([]float64, 0, e.count)
+	for i := uint32(0); i < e.count; i++ {
+		num, den := d.order.Uint32(e.data[i*8:]), d.order.Uint32(e.data[i*8+4:])
+		if den == 0 {
+			values = append(values, 0)
+			continue
+		}
+		if e.typ == 10 {
+			values = append(values, float64(int32(num))/float64(int32(den)))
+		} else {
+			values = append(values, float64(num)/float64(den))
+		}
+	}
+	return values
+}
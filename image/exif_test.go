@@ -0,0 +1,278 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/DATA-DOG/go-sqlmock"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+)
+
+type testIFDEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func asciiEntry(tag uint16, s string) testIFDEntry {
+	return testIFDEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortEntry(tag uint16, v uint16) testIFDEntry {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return testIFDEntry{tag, 3, 1, b}
+}
+
+func longEntry(tag uint16, v uint32) testIFDEntry {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return testIFDEntry{tag, 4, 1, b}
+}
+
+func rationalEntry(tag uint16, values ...[2]uint32) testIFDEntry {
+	var b []byte
+	for _, v := range values {
+		b = append(b, make([]byte, 8)...)
+		binary.LittleEndian.PutUint32(b[len(b)-8:], v[0])
+		binary.LittleEndian.PutUint32(b[len(b)-4:], v[1])
+	}
+	return testIFDEntry{tag, 5, uint32(len(values)), b}
+}
+
+// appendIFD writes a little endian IFD with its out of line values at the end of the tiff
+func appendIFD(tiff []byte, entries []testIFDEntry) ([]byte, uint32) {
+
+	offset := uint32(len(tiff))
+	dataOffset := offset + 2 + uint32(len(entries))*12 + 4
+	ifdBytes := make([]byte, 2, 2+len(entries)*12+4)
+	binary.LittleEndian.PutUint16(ifdBytes, uint16(len(entries)))
+	var data []byte
+	for _, e := range entries {
+		entry := make([]byte, 12)
+		binary.LittleEndian.PutUint16(entry, e.tag)
+		binary.LittleEndian.PutUint16(entry[2:], e.typ)
+		binary.LittleEndian.PutUint32(entry[4:], e.count)
+		if len(e.data) <= 4 {
+			copy(entry[8:], e.data)
+		} else {
+			binary.LittleEndian.PutUint32(entry[8:], dataOffset+uint32(len(data)))
+			data = append(data, e.data...)
+		}
+		ifdBytes = append(ifdBytes, entry...)
+	}
+	ifdBytes = append(ifdBytes, 0, 0, 0, 0) // No next IFD
+	return append(append(tiff, ifdBytes...), data...), offset
+}
+
+// testExifTIFF makes the EXIF data of a phone photo taken on its side
+func testExifTIFF(orientation uint16) []byte {
+
+	tiff := []byte("II*\x00\x00\x00\x00\x00")
+	tiff, exifOffset := appendIFD(tiff, []testIFDEntry{
+		rationalEntry(tagExposureTime, [2]uint32{1, 250}),
+		rationalEntry(tagFNumber, [2]uint32{18, 10}),
+		shortEntry(tagISO, 100),
+		asciiEntry(tagDateTimeOriginal, "2021:07:14 18:30:05"),
+		rationalEntry(tagFocalLength, [2]uint32{425, 100}),
+		asciiEntry(tagLensModel, "Back Camera 4.25mm f/1.8"),
+	})
+	tiff, gpsOffset := appendIFD(tiff, []testIFDEntry{
+		asciiEntry(tagGPSLatitudeRef, "N"),
+		rationalEntry(tagGPSLatitude, [2]uint32{45, 1}, [2]uint32{15, 1}, [2]uint32{0, 1}),
+		asciiEntry(tagGPSLongitudeRef, "E"),
+		rationalEntry(tagGPSLongitude, [2]uint32{19, 1}, [2]uint32{50, 1}, [2]uint32{24, 1}),
+		rationalEntry(tagGPSAltitude, [2]uint32{80, 1}),
+	})
+	tiff, ifd0Offset := appendIFD(tiff, []testIFDEntry{
+		asciiEntry(tagMake, "Apple"),
+		asciiEntry(tagModel, "iPhone 12"),
+		shortEntry(tagOrientation, orientation),
+		longEntry(tagExifIFD, exifOffset),
+		longEntry(tagGPSIFD, gpsOffset),
+	})
+	binary.LittleEndian.PutUint32(tiff[4:], ifd0Offset)
+	return tiff
+}
+
+// testExifJPEG encodes the image as a JPEG with an APP1 EXIF segment right after the SOI marker
+func testExifJPEG(t *testing.T, img image.Image, orientation uint16) []byte {
+
+	buff := new(bytes.Buffer)
+	if err := jpeg.Encode(buff, img, nil); err != nil {
+		t.Fatalf("error encoding: %s", err)
+	}
+	app1 := append([]byte("Exif\x00\x00"), testExifTIFF(orientation)...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(app1)+2))
+	segment = append(segment, app1...)
+
+	b := buff.Bytes()
+	return append(append(append([]byte{}, b[:2]...), segment...), b[2:]...)
+}
+
+func TestParseExif(t *testing.T) {
+
+	t.Run("jpeg", func(t *testing.T) {
+
+		b := testExifJPEG(t, image.NewRGBA(image.Rect(0, 0, 4, 2)), OrientationRotate90)
+		x, err := ParseExif(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if x.Orientation != OrientationRotate90 || x.CameraMake != "Apple" || x.CameraModel != "iPhone 12" {
+			t.Errorf("ifd0 not parsed well: %+v", x)
+		}
+		if x.Lens != "Back Camera 4.25mm f/1.8" || x.ExposureTime != "1/250" || x.FNumber != 1.8 || x.ISO != 100 || x.FocalLength != 4.25 {
+			t.Errorf("exif ifd not parsed well: %+v", x)
+		}
+		if x.DateTaken == nil || !x.DateTaken.Equal(time.Date(2021, 7, 14, 18, 30, 5, 0, time.UTC)) {
+			t.Errorf("date taken not parsed well: %v", x.DateTaken)
+		}
+		if x.GPS == nil || x.GPS.Latitude != 45.25 || math.Abs(x.GPS.Longitude-19.84) > 1e-9 || x.GPS.Altitude != 80 {
+			t.Errorf("gps not parsed well: %+v", x.GPS)
+		}
+	})
+
+	t.Run("tiff", func(t *testing.T) {
+
+		x, err := ParseExif(testExifTIFF(OrientationFlipH))
+		if err != nil || x.Orientation != OrientationFlipH {
+			t.Errorf("tiff not parsed well: %+v, %v", x, err)
+		}
+	})
+
+	t.Run("no exif", func(t *testing.T) {
+
+		b, _ := ioutil.ReadFile(TestImagePath)
+		if _, err := ParseExif(b); err != ErrNoExif {
+			t.Errorf("expected ErrNoExif, got: %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+
+		tiff := testExifTIFF(OrientationRotate90)
+		for i := 0; i < len(tiff); i++ {
+			// Shouldn't panic no matter where the data ends
+			ParseExif(tiff[:i])
+		}
+	})
+}
+
+func TestOrient(t *testing.T) {
+
+	// A 3x2 image with a red top left corner
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red := color.RGBA{R: 255, A: 255}
+	src.Set(0, 0, red)
+
+	tests := []struct {
+		orientation int
+		size        image.Point
+		red         image.Point
+	}{
+		{OrientationNormal, image.Pt(3, 2), image.Pt(0, 0)},
+		{OrientationFlipH, image.Pt(3, 2), image.Pt(2, 0)},
+		{OrientationRotate180, image.Pt(3, 2), image.Pt(2, 1)},
+		{OrientationFlipV, image.Pt(3, 2), image.Pt(0, 1)},
+		{OrientationTranspose, image.Pt(2, 3), image.Pt(0, 0)},
+		{OrientationRotate90, image.Pt(2, 3), image.Pt(1, 0)},
+		{OrientationTransverse, image.Pt(2, 3), image.Pt(1, 2)},
+		{OrientationRotate270, image.Pt(2, 3), image.Pt(0, 2)},
+	}
+	for _, tt := range tests {
+		got := Orient(src, tt.orientation)
+		if got.Bounds().Size() != tt.size {
+			t.Errorf("orientation %d: got size %v, want %v", tt.orientation, got.Bounds().Size(), tt.size)
+		}
+		if got.At(tt.red.X, tt.red.Y) != red {
+			t.Errorf("orientation %d: red pixel isn't at %v", tt.orientation, tt.red)
+		}
+	}
+}
+
+func TestExtractExifWorker(t *testing.T) {
+
+	b := testExifJPEG(t, image.NewRGBA(image.Rect(0, 0, 40, 20)), OrientationRotate90)
+	upload := &Upload{Index: 0, Name: "phone.jpg", Data: b}
+
+	// The EXIF data is parsed before the upload is decoded
+	worker := ExtractExifWorker{}
+	if _, err := worker.Work(context.Background(), upload); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if upload.Exif == nil || upload.Exif.CameraModel != "iPhone 12" {
+		t.Errorf("exif not extracted")
+	}
+
+	transform := TransformFileHeaderWorker{}
+	out, err := transform.Work(context.Background(), upload)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	img := out.(*Image)
+	if img.Exif != upload.Exif {
+		t.Errorf("exif should be kept with the image")
+	}
+	if img.Full.Bounds().Size() != image.Pt(20, 40) || img.Resolution != image.Pt(20, 40) {
+		t.Errorf("image wasn't turned upright, got: %v", img.Full.Bounds())
+	}
+	if !bytes.Equal(img.Original, b) {
+		t.Errorf("original should stay as uploaded")
+	}
+}
+
+func TestImageService_LoadExif(t *testing.T) {
+
+	columns := []string{"orientation", "camera_make", "camera_model", "lens", "exposure_time", "f_number", "iso", "focal_length", "date_taken", "gps_latitude", "gps_longitude", "gps_altitude"}
+
+	t.Run("found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		taken := time.Date(2021, 7, 14, 18, 30, 5, 0, time.UTC)
+		mock.ExpectQuery("SELECT (.+) FROM image_metadata").WithArgs(1).WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(6, "Apple", "iPhone 12", "", "1/250", 1.8, 100, 4.25, taken, 45.25, 19.84, nil))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		img := &Image{Id: 1}
+		if err := service.LoadExif(context.Background(), img); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if img.Exif == nil || img.Exif.CameraMake != "Apple" || !img.Exif.DateTaken.Equal(taken) {
+			t.Errorf("exif not loaded well: %+v", img.Exif)
+		}
+		if img.Exif.GPS == nil || img.Exif.GPS.Latitude != 45.25 || img.Exif.GPS.Altitude != 0 {
+			t.Errorf("gps not loaded well: %+v", img.Exif.GPS)
+		}
+	})
+
+	t.Run("no exif", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) FROM image_metadata").WillReturnRows(sqlmock.NewRows(columns))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		img := &Image{Id: 1}
+		if err := service.LoadExif(context.Background(), img); err != nil || img.Exif != nil {
+			t.Errorf("expected no exif and no error, got: %+v, %v", img.Exif, err)
+		}
+	})
+}
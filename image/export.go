@@ -0,0 +1,200 @@
+package image
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	pipe "github.com/ele7ija/pipeline"
+	"image"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ExportManifestName is the file with the metadata of the exported images, written last into the archive
+const ExportManifestName = "manifest.json"
+
+// ExportFile is an image with its original opened, ready to be copied into the archive
+type ExportFile struct {
+	*Image
+	Content *Content
+}
+
+// ExportEntry is an exported image in the manifest
+type ExportEntry struct {
+	File         string      `json:"file"` // Name of the file in the archive
+	Id           int         `json:"id"`
+	Name         string      `json:"name"`
+	Format       string      `json:"format,omitempty"`
+	MimeType     string      `json:"mimeType,omitempty"`
+	Size         int64       `json:"size,omitempty"`
+	Hash         string      `json:"hash,omitempty"`
+	Resolution   image.Point `json:"resolution"`
+	AverageColor *Color      `json:"averageColor,omitempty"`
+	Uploaded     time.Time   `json:"uploaded"`
+}
+
+// ExportManifest lists what's in the archive, and the images that couldn't be exported
+type ExportManifest struct {
+	Images []ExportEntry `json:"images"`
+	Errors []string      `json:"errors"`
+}
+
+// ExportImages streams a ZIP archive of the originals of the user's images matching the filter into w.
+// The pipeline opens the originals while the ones before them are copied into the archive, and only the metadata
+// is kept in memory. Images that fail are listed in the manifest. An error is returned when the listing fails
+// before anything is written, or when writing to w fails or ctx is done, e.g. the request timed out, before every image
+// is in. The archive is cut short then, without the manifest and the central directory, so it doesn't open as a whole one.
+func ExportImages(ctx context.Context, w io.Writer, service ImageService, pipeline *pipe.Pipeline, filter ImageFilter) (*ExportManifest, error) {
+
+	page := Page{Limit: MaxPageLimit, Sort: SortUploaded, Desc: true}
+	first, err := service.GetAllMetadata(ctx, filter, page)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	manifest := &ExportManifest{Images: []ExportEntry{}, Errors: []string{}}
+
+	startingItems := make(chan pipe.Item)
+	listingErr := make(chan error, 1)
+	go func() {
+		defer close(startingItems)
+		listingErr <- listExported(ctx, service, filter, page, first, startingItems)
+	}()
+
+	errs := make(chan error)
+	errsDone := make(chan struct{})
+	go func() {
+		for err := range errs {
+			manifest.Errors = append(manifest.Errors, err.Error())
+		}
+		close(errsDone)
+	}()
+
+	zw := zip.NewWriter(w)
+	names := map[string]bool{ExportManifestName: true}
+	var writeErr error
+	for item := range pipeline.Filter(ctx, startingItems, errs) {
+		file := item.(*ExportFile)
+		if writeErr == nil {
+			var entry ExportEntry
+			if entry, writeErr = writeExportFile(zw, file, names); writeErr == nil {
+				manifest.Images = append(manifest.Images, entry)
+			} else {
+				// The client is gone, the images already in the pipeline are only closed
+				cancel()
+			}
+		}
+		file.Content.Close()
+	}
+	close(errs)
+	<-errsDone
+	if writeErr != nil {
+		return manifest, writeErr
+	}
+	if err := ctx.Err(); err != nil {
+		return manifest, err
+	}
+	if err := <-listingErr; err != nil {
+		manifest.Errors = append(manifest.Errors, fmt.Sprintf("listing stopped: %s", err))
+	}
+
+	f, err := zw.Create(ExportManifestName)
+	if err != nil {
+		return manifest, err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return manifest, err
+	}
+	return manifest, zw.Close()
+}
+
+// listExported sends the images of the first page and of the ones after it, until the last page or until ctx is done
+func listExported(ctx context.Context, service ImageService, filter ImageFilter, page Page, result *ImagePage, images chan<- pipe.Item) error {
+
+	for {
+		for _, img := range result.Images {
+			select {
+			case images <- img:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if result.NextCursor == "" {
+			return nil
+		}
+		var err error
+		if page.After, err = DecodeCursor(result.NextCursor); err != nil {
+			return err
+		}
+		if result, err = service.GetAllMetadata(ctx, filter, page); err != nil {
+			return err
+		}
+	}
+}
+
+// writeExportFile copies the original into the archive under a name that isn't taken yet
+func writeExportFile(zw *zip.Writer, file *ExportFile, names map[string]bool) (ExportEntry, error) {
+
+	name := exportName(file.Image, names)
+	method := zip.Deflate
+	switch file.Format {
+	case "", "jpeg", "png", "gif", "webp":
+		// Already compressed
+		method = zip.Store
+	}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: file.Content.ModTime})
+	if err != nil {
+		return ExportEntry{}, err
+	}
+	size, err := io.Copy(f, file.Content)
+	if err != nil {
+		return ExportEntry{}, err
+	}
+	return ExportEntry{
+		File:         name,
+		Id:           file.Id,
+		Name:         file.Name,
+		Format:       file.Format,
+		MimeType:     file.Content.MimeType,
+		Size:         size,
+		Hash:         file.Hash,
+		Resolution:   file.Resolution,
+		AverageColor: file.AverageColor,
+		Uploaded:     file.Content.ModTime,
+	}, nil
+}
+
+// exportName makes a flat file name from the name of the image, with the extension of its format.
+// Names that are taken get a number, e.g. "beach (1).jpg". They're compared case insensitively, like some file systems do.
+func exportName(img *Image, taken map[string]bool) string {
+
+	name := strings.TrimSpace(path.Base(strings.ReplaceAll(img.Name, `\`, "/")))
+	if name == "" || name == "." || name == "/" || name == ".." {
+		name = fmt.Sprintf("image-%d", img.Id)
+	}
+	ext := ".jpg"
+	if img.Format != "" {
+		ext = formatExtension(img.Format)
+	}
+	switch current := strings.ToLower(path.Ext(name)); {
+	case current == ext, current == ".jpeg" && ext == ".jpg", current == ".tif" && ext == ".tiff":
+		// Keep the extension as the user named it
+		ext = path.Ext(name)
+	default:
+		name += ext
+	}
+
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; taken[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	taken[strings.ToLower(name)] = true
+	return name
+}
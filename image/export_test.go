@@ -0,0 +1,160 @@
+package image
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImages(t *testing.T) {
+
+	userId := 1
+	ctx := context.WithValue(context.Background(), "userId", userId)
+	uploaded := time.Date(2021, 7, 14, 18, 30, 5, 0, time.UTC)
+	listColumns := []string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y", "hash", "format", "mime_type", "size", "created_at", "average_color", "blurhash", "lqip"}
+	originalColumns := []string{"fullpath", "mime_type", "hash", "size", "created_at"}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := NewMemoryBlobStore()
+	key := StoreTestImage(t, store)
+	original, _ := ioutil.ReadFile(TestImagePath)
+
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery("SELECT id, (.+) FROM image JOIN user_images (.+) image.id IN").WithArgs(userId, 1, 2, 3, 4, MaxPageLimit+1).
+		WillReturnRows(sqlmock.NewRows(listColumns).
+			AddRow(1, "beach.jpg", key, "", 320, 240, "", "jpeg", "image/jpeg", len(original), uploaded, nil, "", "").
+			AddRow(2, "BEACH.JPG", key, "", 320, 240, "", "jpeg", "image/jpeg", len(original), uploaded, nil, "", "").
+			AddRow(3, "../beach", key, "", 320, 240, "", "jpeg", "image/jpeg", len(original), uploaded, nil, "", "").
+			AddRow(4, "gone.jpg", key, "", 320, 240, "", "jpeg", "image/jpeg", len(original), uploaded, nil, "", ""))
+	for _, id := range []int{1, 2, 3} {
+		mock.ExpectQuery("SELECT fullpath").WithArgs(id, userId).
+			WillReturnRows(sqlmock.NewRows(originalColumns).AddRow(key, "image/jpeg", "abc", len(original), uploaded))
+	}
+	mock.ExpectQuery("SELECT fullpath").WithArgs(4, userId).WillReturnRows(sqlmock.NewRows(originalColumns))
+
+	service := NewImageService(db, store, DefaultRenditions)
+	buff := new(bytes.Buffer)
+	manifest, err := ExportImages(ctx, buff, service, MakeExportImagesPipeline(service), ImageFilter{Ids: []int{1, 2, 3, 4}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(manifest.Images) != 3 || len(manifest.Errors) != 1 {
+		t.Errorf("incorrect manifest: %+v", manifest)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buff.Bytes()), int64(buff.Len()))
+	if err != nil {
+		t.Fatalf("not a zip archive: %s", err)
+	}
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+		if f.Name == ExportManifestName {
+			continue
+		}
+		r, _ := f.Open()
+		b, _ := ioutil.ReadAll(r)
+		if !bytes.Equal(b, original) {
+			t.Errorf("%s differs from the original", f.Name)
+		}
+	}
+	if archive.File[len(archive.File)-1].Name != ExportManifestName {
+		t.Errorf("the manifest should be last")
+	}
+	// The first of the beaches keeps its name, whichever it is
+	for i := range names {
+		names[i] = strings.ToLower(names[i])
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "beach (1).jpg,beach (2).jpg,beach.jpg,manifest.json" {
+		t.Errorf("incorrect files: %v", names)
+	}
+
+	r, _ := archive.File[len(archive.File)-1].Open()
+	var written ExportManifest
+	if err := json.NewDecoder(r).Decode(&written); err != nil || len(written.Images) != 3 || written.Images[0].Uploaded.IsZero() {
+		t.Errorf("incorrect manifest in the archive: %+v, %v", written, err)
+	}
+}
+
+func TestExportName(t *testing.T) {
+
+	taken := map[string]bool{ExportManifestName: true}
+	for _, test := range []struct {
+		img  Image
+		name string
+	}{
+		{Image{Id: 1, Name: "beach.jpg", Format: "jpeg"}, "beach.jpg"},
+		{Image{Id: 2, Name: "Beach.JPG", Format: "jpeg"}, "Beach (1).JPG"},
+		{Image{Id: 3, Name: "beach.jpg", Format: "jpeg"}, "beach (2).jpg"},
+		{Image{Id: 4, Name: "beach.jpeg", Format: "jpeg"}, "beach.jpeg"},
+		{Image{Id: 5, Name: "scan", Format: "tiff"}, "scan.tiff"},
+		{Image{Id: 6, Name: "photo.png", Format: "jpeg"}, "photo.png.jpg"},
+		{Image{Id: 7, Name: "old"}, "old.jpg"},
+		{Image{Id: 8, Name: `C:\Users\me\sea.png`, Format: "png"}, "sea.png"},
+		{Image{Id: 9, Name: "../../etc/passwd", Format: "png"}, "passwd.png"},
+		{Image{Id: 10, Name: "", Format: "gif"}, "image-10.gif"},
+		{Image{Id: 11, Name: "manifest", Format: "json"}, "manifest (1).json"},
+	} {
+		if name := exportName(&test.img, taken); name != test.name {
+			t.Errorf("image %d should be %s, got %s", test.img.Id, test.name, name)
+		}
+	}
+}
+
+// cancelingWriter ends the context once something is written
+type cancelingWriter struct {
+	bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.Buffer.Write(p)
+}
+
+func TestExportImagesCutShort(t *testing.T) {
+
+	userId := 1
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "userId", userId))
+	defer cancel()
+	listColumns := []string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y", "hash", "format", "mime_type", "size", "created_at", "average_color", "blurhash", "lqip"}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := NewMemoryBlobStore()
+	key := StoreTestImage(t, store)
+	mock.ExpectQuery("SELECT id, (.+) FROM image JOIN user_images").
+		WillReturnRows(sqlmock.NewRows(listColumns).AddRow(1, "beach.jpg", key, "", 320, 240, "", "jpeg", "image/jpeg", 0, time.Now(), nil, "", ""))
+	mock.ExpectQuery("SELECT fullpath").WithArgs(1, userId).
+		WillReturnRows(sqlmock.NewRows([]string{"fullpath", "mime_type", "hash", "size", "created_at"}).AddRow(key, "image/jpeg", "abc", 0, time.Now()))
+
+	// The request times out while the image is being written
+	service := NewImageService(db, store, DefaultRenditions)
+	w := &cancelingWriter{cancel: cancel}
+	if _, err := ExportImages(ctx, w, service, MakeExportImagesPipeline(service), ImageFilter{Ids: []int{1}}); err == nil {
+		t.Errorf("expected the error of the context")
+	}
+	if _, err := zip.NewReader(bytes.NewReader(w.Bytes()), int64(w.Len())); err == nil {
+		t.Errorf("the archive cut short shouldn't open")
+	}
+}
@@ -0,0 +1,182 @@
+package image
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageFilter narrows down the images listed by GetAllMetadata. Zero values don't filter.
+type ImageFilter struct {
+	Tags           []string  // The image has to have all of them
+	Name           string    // Substring of the name, case insensitive
+	UploadedAfter  time.Time // Inclusive
+	UploadedBefore time.Time // Exclusive
+	MinWidth       int
+	MaxWidth       int
+	MinHeight      int
+	MaxHeight      int
+	Format         string
+	Color          *Color  // One of the dominant colors is close to it
+	Tolerance      float64 // How far from Color, as the distance of RGB colors. ParseImageFilter defaults it to DefaultColorTolerance.
+	Ids            []int   // One of these images
+	AlbumId        int     // In the user's album
+}
+
+// DefaultColorTolerance matches clearly similar shades of a color, but not a different color
+const DefaultColorTolerance = 60
+
+// ParseImageFilter reads the filter from query parameters, e.g.
+// ?tag=beach&tag=2021&name=img_&uploadedAfter=2021-07-01&uploadedBefore=2021-08-01&minWidth=1920&format=jpeg&color=%23ff8800&tolerance=40&ids=1,2,3&albumId=4.
+// Dates are either 2006-01-02 or RFC 3339 timestamps, the tolerance of a color is from 0 to 441.
+func ParseImageFilter(query url.Values) (ImageFilter, error) {
+
+	var filter ImageFilter
+	var err error
+	for _, tag := range query["tag"] {
+		if tag, err = NormalizeTag(tag); err != nil {
+			return filter, err
+		}
+		filter.Tags = append(filter.Tags, tag)
+	}
+	filter.Name = query.Get("name")
+	if filter.UploadedAfter, err = parseDate(query, "uploadedAfter"); err != nil {
+		return filter, err
+	}
+	if filter.UploadedBefore, err = parseDate(query, "uploadedBefore"); err != nil {
+		return filter, err
+	}
+	for param, dest := range map[string]*int{
+		"minWidth":  &filter.MinWidth,
+		"maxWidth":  &filter.MaxWidth,
+		"minHeight": &filter.MinHeight,
+		"maxHeight": &filter.MaxHeight,
+	} {
+		if v := query.Get(param); v != "" {
+			if *dest, err = strconv.Atoi(v); err != nil || *dest < 0 {
+				return filter, fmt.Errorf("%s should be a positive integer", param)
+			}
+		}
+	}
+	if format := query.Get("format"); format != "" {
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if !contains(SupportedFormats, format) {
+			return filter, fmt.Errorf("%w: %s", ErrUnsupportedFormat, format)
+		}
+		filter.Format = format
+	}
+	if c := query.Get("color"); c != "" {
+		color, err := ParseColor(c)
+		if err != nil {
+			return filter, err
+		}
+		filter.Color = &color
+		filter.Tolerance = DefaultColorTolerance
+	}
+	if t := query.Get("tolerance"); t != "" {
+		if filter.Color == nil {
+			return filter, fmt.Errorf("tolerance needs a color")
+		}
+		if filter.Tolerance, err = strconv.ParseFloat(t, 64); err != nil || filter.Tolerance < 0 || filter.Tolerance > 441 {
+			return filter, fmt.Errorf("tolerance should be a number from 0 to 441")
+		}
+	}
+	if ids := query.Get("ids"); ids != "" {
+		for _, idStr := range strings.Split(ids, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(idStr))
+			if err != nil {
+				return filter, fmt.Errorf("ids should be a comma separated list of image ids")
+			}
+			filter.Ids = append(filter.Ids, id)
+		}
+	}
+	if albumId := query.Get("albumId"); albumId != "" {
+		if filter.AlbumId, err = strconv.Atoi(albumId); err != nil || filter.AlbumId < 1 {
+			return filter, fmt.Errorf("albumId should be an album id")
+		}
+	}
+	return filter, nil
+}
+
+func parseDate(query url.Values, param string) (time.Time, error) {
+
+	v := query.Get(param)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s should be a date like 2006-01-02 or 2006-01-02T15:04:05Z", param)
+	}
+	return t, nil
+}
+
+// where makes the conditions of the filter on the image table joined with user_images.
+// Its placeholders are numbered after the given arguments.
+func (f ImageFilter) where(args []interface{}) (string, []interface{}) {
+
+	var conditions []string
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	for _, tag := range f.Tags {
+		add("EXISTS (SELECT 1 FROM image_tags t WHERE t.user_id = user_images.user_id AND t.image_id = image.id AND t.tag = $%d)", tag)
+	}
+	if f.Name != "" {
+		add(`name ILIKE $%d ESCAPE '\'`, "%"+escapeLike(f.Name)+"%")
+	}
+	if !f.UploadedAfter.IsZero() {
+		add("user_images.created_at >= $%d", f.UploadedAfter)
+	}
+	if !f.UploadedBefore.IsZero() {
+		add("user_images.created_at < $%d", f.UploadedBefore)
+	}
+	if f.MinWidth > 0 {
+		add("resolution_x >= $%d", f.MinWidth)
+	}
+	if f.MaxWidth > 0 {
+		add("resolution_x <= $%d", f.MaxWidth)
+	}
+	if f.MinHeight > 0 {
+		add("resolution_y >= $%d", f.MinHeight)
+	}
+	if f.MaxHeight > 0 {
+		add("resolution_y <= $%d", f.MaxHeight)
+	}
+	if f.Format != "" {
+		add("format = $%d", f.Format)
+	}
+	if f.Color != nil {
+		args = append(args, int(f.Color.R), int(f.Color.G), int(f.Color.B), f.Tolerance*f.Tolerance)
+		n := len(args)
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM image_colors c WHERE c.image_id = image.id AND (c.red - $%d) ^ 2 + (c.green - $%d) ^ 2 + (c.blue - $%d) ^ 2 <= $%d)", n-3, n-2, n-1, n))
+	}
+	if len(f.Ids) > 0 {
+		var placeholders []string
+		for _, id := range f.Ids {
+			args = append(args, id)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		conditions = append(conditions, fmt.Sprintf("image.id IN (%s)", strings.Join(placeholders, ", ")))
+	}
+	if f.AlbumId > 0 {
+		add("EXISTS (SELECT 1 FROM album_images a JOIN album ON album.id = a.album_id WHERE a.image_id = image.id AND a.album_id = $%d AND album.user_id = user_images.user_id)", f.AlbumId)
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " AND " + strings.Join(conditions, " AND "), args
+}
+
+// escapeLike makes the LIKE wildcards in s match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,100 @@
+package image
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImageFilter(t *testing.T) {
+
+	t.Run("all filters", func(t *testing.T) {
+
+		query, _ := url.ParseQuery("tag=Beach&tag=2021&name=img_&uploadedAfter=2021-07-01&uploadedBefore=2021-08-01T12:00:00Z&minWidth=1920&maxHeight=1080&format=jpg")
+		filter, err := ParseImageFilter(query)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(filter.Tags) != 2 || filter.Tags[0] != "beach" || filter.Name != "img_" || filter.Format != "jpeg" {
+			t.Errorf("filter not parsed well: %+v", filter)
+		}
+		if !filter.UploadedAfter.Equal(time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)) || !filter.UploadedBefore.Equal(time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("dates not parsed well: %+v", filter)
+		}
+		if filter.MinWidth != 1920 || filter.MaxHeight != 1080 || filter.MaxWidth != 0 {
+			t.Errorf("resolution not parsed well: %+v", filter)
+		}
+	})
+
+	t.Run("no filters", func(t *testing.T) {
+
+		filter, err := ParseImageFilter(url.Values{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if where, args := filter.where([]interface{}{1}); where != "" || len(args) != 1 {
+			t.Errorf("empty filter shouldn't add conditions: %s", where)
+		}
+	})
+
+	t.Run("color", func(t *testing.T) {
+
+		query, _ := url.ParseQuery("color=%23FF8000&tolerance=30")
+		filter, err := ParseImageFilter(query)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if filter.Color == nil || *filter.Color != (Color{255, 128, 0}) || filter.Tolerance != 30 {
+			t.Errorf("color not parsed well: %+v", filter)
+		}
+		where, args := filter.where([]interface{}{1})
+		if !strings.Contains(where, "image_colors") || len(args) != 5 || args[4] != 900.0 {
+			t.Errorf("incorrect color condition: %s %v", where, args)
+		}
+	})
+
+	t.Run("ids and album", func(t *testing.T) {
+
+		query, _ := url.ParseQuery("ids=3,%205,7&albumId=2")
+		filter, err := ParseImageFilter(query)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(filter.Ids) != 3 || filter.Ids[1] != 5 || filter.AlbumId != 2 {
+			t.Errorf("ids not parsed well: %+v", filter)
+		}
+		where, args := filter.where([]interface{}{1})
+		if !strings.Contains(where, "image.id IN ($2, $3, $4)") || !strings.Contains(where, "a.album_id = $5") || len(args) != 5 {
+			t.Errorf("incorrect conditions: %s %v", where, args)
+		}
+	})
+
+	invalid := map[string]string{
+		"bad date":                "uploadedAfter=yesterday",
+		"bad width":               "minWidth=-1",
+		"bad format":              "format=heic",
+		"empty tag":               "tag=%20",
+		"bad color":               "color=orange",
+		"bad tolerance":           "color=ff8000&tolerance=500",
+		"tolerance past 441":      "color=ff8000&tolerance=441.5",
+		"tolerance with no color": "tolerance=10",
+		"bad ids":                 "ids=1,two",
+		"bad album":               "albumId=0",
+	}
+	for name, rawQuery := range invalid {
+		t.Run(name, func(t *testing.T) {
+			query, _ := url.ParseQuery(rawQuery)
+			if _, err := ParseImageFilter(query); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+
+	t.Run("unsupported format", func(t *testing.T) {
+		if _, err := ParseImageFilter(url.Values{"format": {"heic"}}); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("expected ErrUnsupportedFormat, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+)
+
+// SupportedFormats are the formats that can be uploaded, as named by image.RegisterFormat
+var SupportedFormats = []string{"jpeg", "png", "gif", "bmp", "tiff", "webp"}
+
+// ErrUnsupportedFormat is returned when the uploaded content isn't an image we can decode
+var ErrUnsupportedFormat = fmt.Errorf("unsupported image format")
+
+// Decode sniffs the format from the content (the magic bytes, not the filename) and decodes it
+// with the matching decoder. It returns the decoded image and the name of the format.
+func Decode(b []byte) (image.Image, string, error) {
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err == image.ErrFormat {
+		return nil, "", fmt.Errorf("%w: %s, supported are: %s", ErrUnsupportedFormat, http.DetectContentType(b), strings.Join(SupportedFormats, ", "))
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("corrupt %s image: %s", format, err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", fmt.Errorf("corrupt %s image: %s", format, err)
+	}
+	return img, format, nil
+}
@@ -0,0 +1,111 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+
+	src := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	src.Set(1, 1, color.RGBA{R: 255, A: 255})
+
+	encoders := map[string]func(w io.Writer, m image.Image) error{
+		"jpeg": func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, nil) },
+		"png":  png.Encode,
+		"gif":  func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) },
+		"bmp":  bmp.Encode,
+		"tiff": func(w io.Writer, m image.Image) error { return tiff.Encode(w, m, nil) },
+	}
+	for format, encode := range encoders {
+		t.Run(format, func(t *testing.T) {
+
+			buff := new(bytes.Buffer)
+			if err := encode(buff, src); err != nil {
+				t.Fatalf("error encoding: %s", err)
+			}
+			img, gotFormat, err := Decode(buff.Bytes())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if gotFormat != format {
+				t.Errorf("got format %s, want %s", gotFormat, format)
+			}
+			if img.Bounds() != src.Bounds() {
+				t.Errorf("got bounds %v, want %v", img.Bounds(), src.Bounds())
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+
+		_, _, err := Decode([]byte("%PDF-1.4 not an image"))
+		if !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("expected ErrUnsupportedFormat, got: %v", err)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+
+		buff := new(bytes.Buffer)
+		png.Encode(buff, src)
+		_, _, err := Decode(buff.Bytes()[:buff.Len()/2])
+		if err == nil || errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("expected a corrupt image error, got: %v", err)
+		}
+	})
+}
+
+func TestTransformFileHeaderWorker(t *testing.T) {
+
+	newFileHeader := func(filename string, content []byte) *multipart.FileHeader {
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		fw, _ := w.CreateFormFile("images", filename)
+		fw.Write(content)
+		w.Close()
+		req, _ := http.NewRequest("POST", "", &b)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		if err := req.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatalf("err %s", err)
+		}
+		return req.MultipartForm.File["images"][0]
+	}
+
+	t.Run("format is sniffed from the content", func(t *testing.T) {
+
+		buff := new(bytes.Buffer)
+		png.Encode(buff, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+
+		worker := TransformFileHeaderWorker{}
+		out, err := worker.Work(context.Background(), newFileHeader("misnamed.jpg", buff.Bytes()))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if img := out.(*Image); img.Format != "png" {
+			t.Errorf("got format %s, want png", img.Format)
+		}
+	})
+
+	t.Run("unsupported format names the file", func(t *testing.T) {
+
+		worker := TransformFileHeaderWorker{}
+		_, err := worker.Work(context.Background(), newFileHeader("notes.txt", []byte("just some text")))
+		if !errors.Is(err, ErrUnsupportedFormat) || !strings.HasPrefix(err.Error(), "notes.txt:") {
+			t.Errorf("expected an unsupported format error for notes.txt, got: %v", err)
+		}
+	})
+}
@@ -3,17 +3,16 @@ package image
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"github.com/nfnt/resize"
 	log "github.com/sirupsen/logrus"
 	"image"
 	"image/jpeg"
 	"io/ioutil"
-	"math"
-	"os"
-	"sync"
+	"strings"
 )
 
 const (
@@ -21,24 +20,86 @@ const (
 	ThumbnailHeight = uint(200)
 )
 
+// ErrImageNotFound is returned when there's no image matching the query
+var ErrImageNotFound = fmt.Errorf("image not found")
+
+// ErrRenditionNotFound is returned when the image has no rendition with the requested name
+var ErrRenditionNotFound = fmt.Errorf("rendition not found")
+
+// ErrNoPerceptualHash is returned when similar images are looked for before the image's perceptual hash is computed
+var ErrNoPerceptualHash = fmt.Errorf("no perceptual hash yet")
+
+// imageColumns are selected by every metadata query, in the order scanImage expects them
+const imageColumns = "id, name, fullpath, thumbnailpath, resolution_x, resolution_y, COALESCE(hash, ''), COALESCE(format, ''), COALESCE(mime_type, ''), COALESCE(size, 0)"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanImage reads a row of imageColumns, followed by the extra columns if any
+func scanImage(row scanner, extra ...interface{}) (*Image, error) {
+
+	var img Image
+	dest := []interface{}{&img.Id, &img.Name, &img.FullPath, &img.ThumbnailPath, &img.Resolution.X, &img.Resolution.Y, &img.Hash, &img.Format, &img.MimeType, &img.Size}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
 type Image struct {
-	Id            int         `json:"id,omitempty"`
-	Name          string      `json:"name"`
-	Full          image.Image `json:"full,omitempty"`
-	FullPath      string      `json:"fullPath"`
-	Resolution    image.Point `json:"resolution,omitempty"`
-	Thumbnail     image.Image `json:"thumbnail,omitempty"`
-	ThumbnailPath string      `json:"thumbnailPath"`
+	Id             int               `json:"id,omitempty"`
+	Name           string            `json:"name"`
+	Full           image.Image       `json:"full,omitempty"`
+	FullPath       string            `json:"fullPath"`
+	Resolution     image.Point       `json:"resolution,omitempty"`
+	Thumbnail      image.Image       `json:"thumbnail,omitempty"`
+	ThumbnailPath  string            `json:"thumbnailPath"`
+	Original       []byte            `json:"-"`                      // The uploaded bytes, stored as they are
+	Format         string            `json:"format,omitempty"`       // Format of the upload, e.g. "png"
+	MimeType       string            `json:"mimeType,omitempty"`     // MIME type of the original
+	Size           int64             `json:"size,omitempty"`         // Size of the original in bytes
+	Hash           string            `json:"hash,omitempty"`         // SHA-256 of the original, also used as its checksum
+	Deduplicated   bool              `json:"deduplicated,omitempty"` // The same content was already uploaded
+	Watermarked    bool              `json:"-"`                      // Its renditions are watermarked for its user, it isn't shared by its hash
+	Renditions     []*ImageRendition `json:"renditions,omitempty"`
+	Exif           *Exif             `json:"exif,omitempty"`
+	PerceptualHash *uint64           `json:"-"`                    // Set once computed, see PerceptualHash
+	Distance       *int              `json:"distance,omitempty"`   // Hamming distance to the image it was found similar to
+	EditedFrom     int               `json:"editedFrom,omitempty"` // The image this one is an edit of
+	VersionOf      *int              `json:"versionOf,omitempty"`  // The first version of the image, see SaveVersion
+	AverageColor   *Color            `json:"averageColor,omitempty"`
+	Palette        []PaletteColor    `json:"palette,omitempty"` // The dominant colors, the most common first
+	BlurHash       string            `json:"blurHash,omitempty"`
+	LQIP           string            `json:"lqip,omitempty"` // A tiny JPEG as a data URI, see LQIP
+	Upload         *Upload           `json:"-"`              // Where in the request the image came from, without the data
 }
 
 type ImageBase64 struct {
-	Id              int         `json:"id,omitempty"`
-	Name            string      `json:"name"`
-	FullBase64      string      `json:"fullBase64,omitempty"`
-	FullPath        string      `json:"fullPath"`
-	Resolution      image.Point `json:"resolution,omitempty"`
-	ThumbnailBase64 string      `json:"thumbnailBase64,omitempty"`
-	ThumbnailPath   string      `json:"thumbnailPath"`
+	Id              int               `json:"id,omitempty"`
+	Name            string            `json:"name"`
+	FullBase64      string            `json:"fullBase64,omitempty"`
+	FullPath        string            `json:"fullPath"`
+	Resolution      image.Point       `json:"resolution,omitempty"`
+	ThumbnailBase64 string            `json:"thumbnailBase64,omitempty"`
+	ThumbnailPath   string            `json:"thumbnailPath"`
+	Format          string            `json:"format,omitempty"`
+	MimeType        string            `json:"mimeType,omitempty"`
+	Size            int64             `json:"size,omitempty"`
+	Hash            string            `json:"hash,omitempty"`
+	Deduplicated    bool              `json:"deduplicated,omitempty"`
+	Renditions      map[string]string `json:"renditions,omitempty"` // Loaded renditions by name
+	Exif            *Exif             `json:"exif,omitempty"`
+	Distance        *int              `json:"distance,omitempty"`
+	Urls            *ImageUrls        `json:"urls,omitempty"` // Set instead of the base64 encodings when asked for
+	EditedFrom      int               `json:"editedFrom,omitempty"`
+	VersionOf       *int              `json:"versionOf,omitempty"`
+	AverageColor    *Color            `json:"averageColor,omitempty"` // For a placeholder while the image loads
+	Palette         []PaletteColor    `json:"palette,omitempty"`
+	BlurHash        string            `json:"blurHash,omitempty"` // Placeholders to paint before the thumbnail is loaded
+	LQIP            string            `json:"lqip,omitempty"`
+	Upload          *Upload           `json:"-"`
 }
 
 func NewImage(name string, fullImage image.Image) *Image {
@@ -49,10 +110,35 @@ func NewImage(name string, fullImage image.Image) *Image {
 	}
 }
 
+// NewImageFromBytes decodes the uploaded bytes and keeps them as the original
+func NewImageFromBytes(name string, b []byte) (*Image, error) {
+
+	rawimg, format, err := Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	img := NewImage(name, rawimg)
+	img.Original = b
+	img.Format = format
+	img.MimeType = "image/" + format
+	img.Size = int64(len(b))
+	img.Hash = HashContent(b)
+	return img, nil
+}
+
+// HashContent returns the hex encoded SHA-256 of the content, used to find duplicate uploads
+func HashContent(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
 func NewImageBase64(img *Image) *ImageBase64 {
 
 	fullBase64Encoding := ""
-	if img.Full != nil {
+	if img.Original != nil {
+		fullBase64Encoding = fmt.Sprintf("data:%s;base64,", img.MimeType)
+		fullBase64Encoding += base64.StdEncoding.EncodeToString(img.Original)
+	} else if img.Full != nil {
 		fullBuff := new(bytes.Buffer)
 		jpeg.Encode(fullBuff, img.Full, nil)
 		fullBase64Encoding = "data:image/jpeg;base64,"
@@ -67,6 +153,17 @@ func NewImageBase64(img *Image) *ImageBase64 {
 		thumbBase64Encoding += base64.StdEncoding.EncodeToString(thumbBuff.Bytes())
 	}
 
+	var renditions map[string]string
+	for _, r := range img.Renditions {
+		if r.Data == nil {
+			continue
+		}
+		if renditions == nil {
+			renditions = make(map[string]string)
+		}
+		renditions[r.Name] = fmt.Sprintf("data:%s;base64,%s", r.MimeType, base64.StdEncoding.EncodeToString(r.Data))
+	}
+
 	return &ImageBase64{
 		Id:              img.Id,
 		Name:            img.Name,
@@ -75,65 +172,186 @@ func NewImageBase64(img *Image) *ImageBase64 {
 		Resolution:      img.Resolution,
 		ThumbnailBase64: thumbBase64Encoding,
 		ThumbnailPath:   img.ThumbnailPath,
+		Format:          img.Format,
+		MimeType:        img.MimeType,
+		Size:            img.Size,
+		Hash:            img.Hash,
+		Deduplicated:    img.Deduplicated,
+		Renditions:      renditions,
+		Exif:            img.Exif,
+		Distance:        img.Distance,
+		EditedFrom:      img.EditedFrom,
+		VersionOf:       img.VersionOf,
+		AverageColor:    img.AverageColor,
+		Palette:         img.Palette,
+		BlurHash:        img.BlurHash,
+		LQIP:            img.LQIP,
+		Upload:          img.Upload,
 	}
 }
 
 type ImageService interface {
 	CreateThumbnail(ctx context.Context, image *Image) error
+	CreateRenditions(ctx context.Context, image *Image) error
 	Persist(ctx context.Context, image *Image) error
 	SaveMetadata(ctx context.Context, image *Image) error
-	GetAllMetadata(ctx context.Context) (<-chan *Image, <-chan error, error)
+	FindByHash(ctx context.Context, hash string) (*Image, error)
+	HasContent(ctx context.Context, hash string) (bool, error)
+	GetAllMetadata(ctx context.Context, filter ImageFilter, page Page) (*ImagePage, error)
 	GetMetadata(ctx context.Context, imageIds []int) ([]*Image, error)
+	Get(ctx context.Context, imageId int) (*Image, error)
 	LoadThumbnail(ctx context.Context, img *Image) error
 	LoadFull(ctx context.Context, img *Image) error
+	LoadRendition(ctx context.Context, img *Image, name string) error
+	GetRenditionNames(ctx context.Context, imageId int) ([]string, error)
+	LoadExif(ctx context.Context, img *Image) error
+	OpenOriginal(ctx context.Context, imageId int) (*Content, error)
+	OpenThumbnail(ctx context.Context, imageId int) (*Content, error)
+	OpenRendition(ctx context.Context, imageId int, name string) (*Content, error)
+	SavePerceptualHash(ctx context.Context, img *Image) error
+	GetWithoutPerceptualHash(ctx context.Context) ([]*Image, error)
+	FindSimilar(ctx context.Context, imageId int, maxDistance int) ([]*Image, error)
+	GetTags(ctx context.Context, imageId int) ([]string, error)
+	AddTags(ctx context.Context, imageId int, tags []string) error
+	RemoveTag(ctx context.Context, imageId int, tag string) error
+	SaveVersion(ctx context.Context, img *Image) error
+	GetVersions(ctx context.Context, imageId int) ([]*Image, error)
+	GetWatermark(ctx context.Context) (*Watermark, error)
+	SaveWatermark(ctx context.Context, w *Watermark) error
+	DeleteWatermark(ctx context.Context) error
+	Unlink(ctx context.Context, imageId int) (*DeletedImage, error)
+	DeleteBlobs(ctx context.Context, deleted *DeletedImage) error
+}
+
+// DeletedImage is the result of removing an image from the user's gallery
+type DeletedImage struct {
+	Id     int  `json:"id"`
+	Purged bool `json:"purged"` // No other user had the image, so it was removed along with its files
+	blobs  []string
 }
 
-func NewImageService(db *sql.DB) *imageService {
+func NewImageService(db *sql.DB, store BlobStore, renditions []Rendition) *imageService {
 
-	return &imageService{db}
+	return &imageService{db, store, renditions}
 }
 
 type imageService struct {
-	db *sql.DB
+	db         *sql.DB
+	store      BlobStore
+	renditions []Rendition
 }
 
 func (i *imageService) CreateThumbnail(ctx context.Context, image *Image) error {
 
-	image.Thumbnail = resize.Resize(ThumbnailWidth, ThumbnailHeight, image.Full, resize.Lanczos3)
+	image.Thumbnail = ResizeTo(image.Full, ThumbnailWidth, ThumbnailHeight, FitModeCrop)
+	return nil
+}
+
+func (i *imageService) CreateRenditions(ctx context.Context, image *Image) error {
+
+	for _, r := range i.renditions {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("context done")
+		default:
+		}
+
+		resized := ResizeTo(image.Full, r.Width, r.Height, r.Fit)
+		buff := new(bytes.Buffer)
+		if err := Encode(buff, resized, r.Format, r.Quality); err != nil {
+			return fmt.Errorf("error creating rendition %s: %s", r.Name, err)
+		}
+		image.Renditions = append(image.Renditions, &ImageRendition{
+			Name:     r.Name,
+			Width:    resized.Bounds().Dx(),
+			Height:   resized.Bounds().Dy(),
+			MimeType: "image/" + r.Format,
+			Size:     int64(buff.Len()),
+			Data:     buff.Bytes(),
+		})
+	}
 	return nil
 }
 
 func (i *imageService) Persist(ctx context.Context, image *Image) error {
 
-	// Save full image
-	fullImageFile, err := ioutil.TempFile(os.TempDir(), "pipelineImg*.jpg")
+	// Save the original as it was uploaded
+	fullKey, err := i.putOriginal(ctx, image)
 	if err != nil {
-		return fmt.Errorf("error creating temp file: %s", err)
-	}
-	if err := jpeg.Encode(fullImageFile, image.Full, nil); err != nil {
-		_ = os.Remove(fullImageFile.Name())
 		return fmt.Errorf("error while saving full image: %s", err)
 	}
 
 	// Save thumbnail
-	thumbnailImageFile, err := ioutil.TempFile(os.TempDir(), "pipelineImgThumb*.jpg")
+	thumbnailKey, err := i.putJPEG(ctx, "thumbnail", image.Thumbnail)
 	if err != nil {
-		_ = os.Remove(fullImageFile.Name())
-		return fmt.Errorf("error creating temp file: %s", err)
-	}
-	if err := jpeg.Encode(thumbnailImageFile, image.Thumbnail, nil); err != nil {
-		_ = os.Remove(fullImageFile.Name())
-		_ = os.Remove(thumbnailImageFile.Name())
+		_ = i.store.Delete(ctx, fullKey)
 		return fmt.Errorf("error while saving thumbnail: %s", err)
 	}
 
-	image.FullPath = fullImageFile.Name()
+	image.FullPath = fullKey
 	log.Printf("saved an image to: %s\n", image.FullPath)
-	image.ThumbnailPath = thumbnailImageFile.Name()
+	image.ThumbnailPath = thumbnailKey
 	log.Printf("saved a thumbnail to: %s\n", image.ThumbnailPath)
+
+	// Save renditions, their data isn't needed in memory afterwards
+	for _, r := range image.Renditions {
+		key, err := NewBlobKey("renditions/"+r.Name, mimeExtension(r.MimeType))
+		if err == nil {
+			err = i.store.Put(ctx, key, bytes.NewReader(r.Data))
+		}
+		if err != nil {
+			i.removeBlobs(ctx, image)
+			return fmt.Errorf("error while saving rendition %s: %s", r.Name, err)
+		}
+		r.Path = key
+		r.Data = nil
+	}
 	return nil
 }
 
+func mimeExtension(mimeType string) string {
+	return formatExtension(strings.TrimPrefix(mimeType, "image/"))
+}
+
+func (i *imageService) putOriginal(ctx context.Context, image *Image) (string, error) {
+
+	if image.Original == nil {
+		// There's nothing uploaded to keep, the decoded image is all we have
+		return i.putJPEG(ctx, "full", image.Full)
+	}
+	key, err := NewBlobKey("full", formatExtension(image.Format))
+	if err != nil {
+		return "", err
+	}
+	if err := i.store.Put(ctx, key, bytes.NewReader(image.Original)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func formatExtension(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+func (i *imageService) putJPEG(ctx context.Context, namespace string, img image.Image) (string, error) {
+
+	key, err := NewBlobKey(namespace, ".jpg")
+	if err != nil {
+		return "", err
+	}
+	buff := new(bytes.Buffer)
+	if err := jpeg.Encode(buff, img, nil); err != nil {
+		return "", err
+	}
+	if err := i.store.Put(ctx, key, buff); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
 func (i *imageService) SaveMetadata(ctx context.Context, image *Image) (err error) {
 
 	tx, err := i.db.Begin()
@@ -150,96 +368,145 @@ func (i *imageService) SaveMetadata(ctx context.Context, image *Image) (err erro
 		}
 	}()
 
-	var imageId int
-	err = tx.QueryRowContext(ctx, "INSERT INTO image (name, fullpath, thumbnailpath, resolution_x, resolution_y) VALUES( $1, $2, $3, $4, $5 ) RETURNING id", image.Name, image.FullPath, image.ThumbnailPath, image.Resolution.X, image.Resolution.Y).Scan(&imageId)
-	if err != nil {
-		return
+	if !image.Deduplicated {
+		var imageId int
+		err = tx.QueryRowContext(ctx, "INSERT INTO image (name, fullpath, thumbnailpath, resolution_x, resolution_y, hash, format, mime_type, size, phash, average_color, blurhash, lqip, watermarked) VALUES( $1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11, NULLIF($12, ''), NULLIF($13, ''), $14 ) ON CONFLICT (hash) WHERE NOT watermarked DO NOTHING RETURNING id", image.Name, image.FullPath, image.ThumbnailPath, image.Resolution.X, image.Resolution.Y, image.Hash, image.Format, image.MimeType, image.Size, phashValue(image.PerceptualHash), colorValue(image.AverageColor), image.BlurHash, image.LQIP, image.Watermarked).Scan(&imageId)
+		switch err {
+		case nil:
+			image.Id = imageId
+		case sql.ErrNoRows:
+			// The same content was saved in the meantime, link that one instead
+			i.removeBlobs(ctx, image)
+			image.Renditions = nil
+			if err = tx.QueryRowContext(ctx, "SELECT id, fullpath, thumbnailpath FROM image WHERE hash = $1 AND NOT watermarked", image.Hash).Scan(&image.Id, &image.FullPath, &image.ThumbnailPath); err != nil {
+				return
+			}
+			image.Deduplicated = true
+		default:
+			return
+		}
+	}
+
+	if !image.Deduplicated {
+		for _, r := range image.Renditions {
+			if _, err = tx.ExecContext(ctx, "INSERT INTO image_renditions (image_id, name, path, width, height, mime_type, size) VALUES ($1, $2, $3, $4, $5, $6, $7)", image.Id, r.Name, r.Path, r.Width, r.Height, r.MimeType, r.Size); err != nil {
+				return
+			}
+		}
+		if x := image.Exif; x != nil {
+			var lat, lon, alt *float64
+			if x.GPS != nil {
+				lat, lon, alt = &x.GPS.Latitude, &x.GPS.Longitude, &x.GPS.Altitude
+			}
+			if _, err = tx.ExecContext(ctx, "INSERT INTO image_metadata (image_id, orientation, camera_make, camera_model, lens, exposure_time, f_number, iso, focal_length, date_taken, gps_latitude, gps_longitude, gps_altitude) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+				image.Id, x.Orientation, x.CameraMake, x.CameraModel, x.Lens, x.ExposureTime, x.FNumber, x.ISO, x.FocalLength, x.DateTaken, lat, lon, alt); err != nil {
+				return
+			}
+		}
+		if len(image.Palette) > 0 {
+			query, args := paletteInsert(image.Id, image.Palette)
+			if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+				return
+			}
+		}
 	}
-	image.Id = imageId
 
-	if _, err = tx.Exec("INSERT INTO user_images (user_id, image_id) VALUES ($1, $2)", ctx.Value("userId"), imageId); err != nil {
+	if _, err = tx.Exec("INSERT INTO user_images (user_id, image_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", ctx.Value("userId"), image.Id); err != nil {
 		return
 	}
 
+	// Uploads into an album, the album's owner was checked before the upload
+	if albumId, ok := ctx.Value("albumId").(int); ok {
+		if _, err = tx.Exec("INSERT INTO album_images (album_id, image_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", albumId, image.Id); err != nil {
+			return
+		}
+	}
+
 	log.Printf("saved metadata for image: %s", image.Name)
 	return
 }
 
-func (i *imageService) GetAllMetadata(ctx context.Context) (<-chan *Image, <-chan error, error) {
+// removeBlobs removes the blobs that were persisted for the image, e.g. for a duplicate before it was known to be one
+func (i *imageService) removeBlobs(ctx context.Context, image *Image) {
 
-	userId := ctx.Value("userId").(int)
-	rows, err := i.db.QueryContext(ctx, "SELECT image_id FROM user_images WHERE user_id = $1", userId)
-	if err != nil {
-		return nil, nil, err
+	keys := []string{image.FullPath, image.ThumbnailPath}
+	for _, r := range image.Renditions {
+		keys = append(keys, r.Path)
 	}
-
-	var imageIds []int
-	for rows.Next() {
-
-		var imageId int
-		err := rows.Scan(&imageId)
-		if err != nil {
-			return nil, nil, err
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := i.store.Delete(ctx, key); err != nil {
+			log.Warnf("couldn't remove blob %s: %s", key, err)
 		}
-		imageIds = append(imageIds, imageId)
 	}
-	rows.Close()
-	log.Printf("Got %d image ids to process", len(imageIds))
-
-	images := make(chan *Image, len(imageIds))
-	errors := make(chan error, len(imageIds))
-	if len(imageIds) == 0 {
-		close(images)
-		close(errors)
-		return images, errors, nil
-	}
-	wg := sync.WaitGroup{}
-
-	idGroups := divide(imageIds, 100)
-	wg.Add(len(idGroups))
-	for _, ids := range idGroups {
-		go func(ids []int) {
-			imgs, err := i.GetMetadata(ctx, ids)
-			if err != nil {
-				errors <- err
-				log.Errorf("Error processing images with ids: %v", ids)
-			} else {
-				for _, img := range imgs {
-					images <- img
-				}
-				log.Debugf("Processed successfully image with id: %v", ids)
-			}
-			wg.Done()
-		}(ids)
+}
+
+func (i *imageService) FindByHash(ctx context.Context, hash string) (*Image, error) {
+
+	img, err := scanImage(i.db.QueryRowContext(ctx, fmt.Sprintf("SELECT %s FROM image WHERE hash = $1 AND NOT watermarked", imageColumns), hash))
+	if err == sql.ErrNoRows {
+		return nil, ErrImageNotFound
 	}
+	return img, err
+}
 
-	go func() {
-		wg.Wait()
-		close(images)
-		close(errors)
-		log.Printf("Done processing all %d images", len(imageIds))
-	}()
+// HasContent is true when the user already has an image with the content of the hash
+func (i *imageService) HasContent(ctx context.Context, hash string) (bool, error) {
 
-	return images, errors, nil
+	var has bool
+	err := i.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM image JOIN user_images ON image_id = id WHERE hash = $1 AND user_id = $2)", hash, ctx.Value("userId")).Scan(&has)
+	return has, err
 }
 
-func divide(ids []int, groupSize int) [][]int {
-	if len(ids) <= groupSize {
-		return [][]int{ids}
+// GetAllMetadata returns a page of the user's images matching the filter
+func (i *imageService) GetAllMetadata(ctx context.Context, filter ImageFilter, page Page) (*ImagePage, error) {
+
+	userId := ctx.Value("userId").(int)
+	where, args := filter.where([]interface{}{userId})
+	after, args := page.after(args)
+	// One more than the limit, to know whether there's a next page
+	args = append(args, page.Limit+1)
+	query := fmt.Sprintf("SELECT %s, %s, average_color, COALESCE(blurhash, ''), COALESCE(lqip, '') FROM image JOIN user_images ON image_id = id WHERE user_id = $1%s%s%s LIMIT $%d",
+		imageColumns, page.Sort.key(), where, after, page.orderBy(), len(args))
+	rows, err := i.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
-	numGroups := int(math.Ceil(float64(len(ids)) / float64(groupSize)))
-	var retval [][]int
-	for index := 0; index < numGroups; index++ {
-		start := index * groupSize
-		var end int
-		if index == numGroups-1 {
-			end = len(ids)
-		} else {
-			end = (index + 1) * groupSize
+	defer rows.Close()
+
+	result := &ImagePage{Images: []*Image{}}
+	var last Cursor
+	for rows.Next() {
+		if len(result.Images) == page.Limit {
+			result.NextCursor = last.Encode()
+			break
+		}
+		last = Cursor{Sort: page.Sort, Desc: page.Desc}
+		var key interface{} = &last.Time
+		if page.Sort == SortName {
+			key = &last.Name
+		}
+		var averageColor sql.NullInt64
+		var blurHash, lqip string
+		img, err := scanImage(rows, key, &averageColor, &blurHash, &lqip)
+		if err != nil {
+			return nil, err
+		}
+		if averageColor.Valid {
+			c := ColorFromInt(int(averageColor.Int64))
+			img.AverageColor = &c
 		}
-		retval = append(retval, ids[start:end])
+		img.BlurHash, img.LQIP = blurHash, lqip
+		last.Id = img.Id
+		result.Images = append(result.Images, img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	return retval
+	log.Printf("Got %d images, more: %t", len(result.Images), result.NextCursor != "")
+	return result, nil
 }
 
 func (i *imageService) GetMetadata(ctx context.Context, imageIds []int) ([]*Image, error) {
@@ -251,7 +518,7 @@ func (i *imageService) GetMetadata(ctx context.Context, imageIds []int) ([]*Imag
 			str += ","
 		}
 	}
-	rows, err := i.db.QueryContext(ctx, fmt.Sprintf("SELECT id, name, fullpath, thumbnailpath, resolution_x, resolution_y FROM image WHERE id IN (%s)", str))
+	rows, err := i.db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM image WHERE id IN (%s)", imageColumns, str))
 	if err != nil {
 		return nil, err
 	}
@@ -259,12 +526,11 @@ func (i *imageService) GetMetadata(ctx context.Context, imageIds []int) ([]*Imag
 	counter := 0
 	for rows.Next() {
 		counter++
-		var img Image
-		err := rows.Scan(&img.Id, &img.Name, &img.FullPath, &img.ThumbnailPath, &img.Resolution.X, &img.Resolution.Y)
+		img, err := scanImage(rows)
 		if err != nil {
 			return nil, err
 		}
-		imgs = append(imgs, &img)
+		imgs = append(imgs, img)
 	}
 	rows.Close()
 	if counter != len(imageIds) {
@@ -274,6 +540,16 @@ func (i *imageService) GetMetadata(ctx context.Context, imageIds []int) ([]*Imag
 	return imgs, nil
 }
 
+// Get returns the metadata of the user's image
+func (i *imageService) Get(ctx context.Context, imageId int) (*Image, error) {
+
+	img, err := scanImage(i.db.QueryRowContext(ctx, fmt.Sprintf("SELECT %s FROM image JOIN user_images ON image_id = id WHERE id = $1 AND user_id = $2", imageColumns), imageId, ctx.Value("userId")))
+	if err == sql.ErrNoRows {
+		return nil, ErrImageNotFound
+	}
+	return img, err
+}
+
 func (i *imageService) LoadThumbnail(ctx context.Context, img *Image) error {
 
 	if img.ThumbnailPath == "" {
@@ -286,10 +562,11 @@ func (i *imageService) LoadThumbnail(ctx context.Context, img *Image) error {
 	default:
 	}
 
-	f, err := os.Open(img.ThumbnailPath)
+	f, err := i.store.Get(ctx, img.ThumbnailPath)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	thumbnail, _, err := image.Decode(f)
 	if err != nil {
 		return err
@@ -311,15 +588,260 @@ func (i *imageService) LoadFull(ctx context.Context, img *Image) error {
 	default:
 	}
 
-	f, err := os.Open(img.FullPath)
+	f, err := i.store.Get(ctx, img.FullPath)
 	if err != nil {
 		return err
 	}
-	full, _, err := image.Decode(f)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
 	if err != nil {
 		return err
 	}
+	full, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if img.Exif != nil && img.Exif.Orientation > OrientationNormal {
+		full = Orient(full, img.Exif.Orientation)
+	}
 	img.Full = full
+	img.Original = b
+	if img.MimeType == "" {
+		// Images uploaded before the originals were kept
+		img.MimeType = "image/" + format
+	}
+
+	return nil
+}
+
+func (i *imageService) LoadRendition(ctx context.Context, img *Image, name string) error {
+
+	r := ImageRendition{Name: name}
+	err := i.db.QueryRowContext(ctx, "SELECT path, width, height, mime_type, size FROM image_renditions WHERE image_id = $1 AND name = $2", img.Id, name).
+		Scan(&r.Path, &r.Width, &r.Height, &r.MimeType, &r.Size)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", ErrRenditionNotFound, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := i.store.Get(ctx, r.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if r.Data, err = ioutil.ReadAll(f); err != nil {
+		return err
+	}
+	img.Renditions = append(img.Renditions, &r)
+	return nil
+}
 
+// GetRenditionNames returns the names of the renditions stored for the image, which can be fewer than the configured ones,
+// e.g. for the images uploaded before a rendition was added
+func (i *imageService) GetRenditionNames(ctx context.Context, imageId int) ([]string, error) {
+
+	rows, err := i.db.QueryContext(ctx, "SELECT name FROM image_renditions WHERE image_id = $1 ORDER BY name", imageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (i *imageService) LoadExif(ctx context.Context, img *Image) error {
+
+	var x Exif
+	var lat, lon, alt *float64
+	err := i.db.QueryRowContext(ctx, "SELECT orientation, camera_make, camera_model, lens, exposure_time, f_number, iso, focal_length, date_taken, gps_latitude, gps_longitude, gps_altitude FROM image_metadata WHERE image_id = $1", img.Id).
+		Scan(&x.Orientation, &x.CameraMake, &x.CameraModel, &x.Lens, &x.ExposureTime, &x.FNumber, &x.ISO, &x.FocalLength, &x.DateTaken, &lat, &lon, &alt)
+	if err == sql.ErrNoRows {
+		// There was no EXIF in the upload
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if lat != nil && lon != nil {
+		x.GPS = &GPS{Latitude: *lat, Longitude: *lon}
+		if alt != nil {
+			x.GPS.Altitude = *alt
+		}
+	}
+	img.Exif = &x
 	return nil
 }
+
+// Unlink removes the image from the user's gallery. When no other user references the image,
+// its rows are deleted too and the returned DeletedImage holds the blobs to be deleted with DeleteBlobs.
+func (i *imageService) Unlink(ctx context.Context, imageId int) (deleted *DeletedImage, err error) {
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	// Lock the image so that a deduplicated upload can't link it while it's being deleted
+	var fullPath, thumbnailPath string
+	err = tx.QueryRowContext(ctx, "SELECT fullpath, thumbnailpath FROM image WHERE id = $1 FOR UPDATE", imageId).Scan(&fullPath, &thumbnailPath)
+	if err == sql.ErrNoRows {
+		err = ErrImageNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM user_images WHERE user_id = $1 AND image_id = $2", ctx.Value("userId"), imageId)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Someone else's image, the user shouldn't know it exists
+		err = ErrImageNotFound
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM album_images WHERE image_id = $1 AND album_id IN (SELECT id FROM album WHERE user_id = $2)", imageId, ctx.Value("userId")); err != nil {
+		return
+	}
+
+	deleted = &DeletedImage{Id: imageId}
+	var references int
+	if err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_images WHERE image_id = $1", imageId).Scan(&references); err != nil {
+		return
+	}
+	if references > 0 {
+		log.Printf("unlinked image %d, %d users still have it", imageId, references)
+		return
+	}
+
+	blobs := []string{fullPath, thumbnailPath}
+	rows, err := tx.QueryContext(ctx, "SELECT path FROM image_renditions WHERE image_id = $1", imageId)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var path string
+		if err = rows.Scan(&path); err != nil {
+			rows.Close()
+			return
+		}
+		blobs = append(blobs, path)
+	}
+	rows.Close()
+
+	// Renditions, metadata... are deleted by the ON DELETE CASCADE constraints
+	if _, err = tx.ExecContext(ctx, "DELETE FROM image WHERE id = $1", imageId); err != nil {
+		return
+	}
+	deleted.Purged = true
+	deleted.blobs = blobs
+	log.Printf("deleted image %d", imageId)
+	return
+}
+
+// DeleteBlobs deletes the files of a purged image. Files that are already gone are skipped.
+func (i *imageService) DeleteBlobs(ctx context.Context, deleted *DeletedImage) error {
+
+	var firstErr error
+	for _, key := range deleted.blobs {
+		if key == "" {
+			continue
+		}
+		if err := i.store.Delete(ctx, key); err != nil && err != ErrBlobNotFound {
+			log.Errorf("couldn't delete blob %s: %s", key, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// phashValue maps the hash onto a BIGINT column, bit for bit
+func phashValue(phash *uint64) interface{} {
+	if phash == nil {
+		return nil
+	}
+	return int64(*phash)
+}
+
+func (i *imageService) SavePerceptualHash(ctx context.Context, img *Image) error {
+
+	_, err := i.db.ExecContext(ctx, "UPDATE image SET phash = $1 WHERE id = $2", phashValue(img.PerceptualHash), img.Id)
+	return err
+}
+
+// GetWithoutPerceptualHash returns the images of all users uploaded before perceptual hashing, for the backfill
+func (i *imageService) GetWithoutPerceptualHash(ctx context.Context) ([]*Image, error) {
+
+	rows, err := i.db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM image WHERE phash IS NULL", imageColumns))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var imgs []*Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, rows.Err()
+}
+
+// FindSimilar returns the user's images whose perceptual hash is within maxDistance of the given image's, closest first
+func (i *imageService) FindSimilar(ctx context.Context, imageId int, maxDistance int) ([]*Image, error) {
+
+	userId := ctx.Value("userId")
+	var phash sql.NullInt64
+	err := i.db.QueryRowContext(ctx, "SELECT phash FROM image JOIN user_images ON image_id = id WHERE id = $1 AND user_id = $2", imageId, userId).Scan(&phash)
+	if err == sql.ErrNoRows {
+		return nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !phash.Valid {
+		return nil, fmt.Errorf("image %d has %w", imageId, ErrNoPerceptualHash)
+	}
+
+	// The Hamming distance is the number of 1s in the XOR of the hashes
+	distance := "length(replace((phash # $3)::bit(64)::text, '0', ''))"
+	rows, err := i.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s, %s AS distance FROM image JOIN user_images ON image_id = id WHERE user_id = $1 AND id <> $2 AND phash IS NOT NULL AND %s <= $4 ORDER BY distance, id",
+		imageColumns, distance, distance), userId, imageId, phash.Int64, maxDistance)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var imgs []*Image
+	for rows.Next() {
+		var d int
+		img, err := scanImage(rows, &d)
+		if err != nil {
+			return nil, err
+		}
+		img.Distance = &d
+		imgs = append(imgs, img)
+	}
+	return imgs, rows.Err()
+}
@@ -1,18 +1,22 @@
 package image
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
 	"image"
 	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
-	"math"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
-var TestImagePath = "/home/bp/go/src/github.com/ele7ija/go-pipelines/workers/test.jpg"
+var TestImagePath = "testdata/test.jpg"
 
 func TestImageService_CreateThumbnail(t *testing.T) {
 
@@ -22,7 +26,7 @@ func TestImageService_CreateThumbnail(t *testing.T) {
 	t.Run("create and open", func(t *testing.T) {
 		// Create a thumbnail, save it to file and check whether the resolution is as wanted
 
-		imageService := NewImageService(nil)
+		imageService := NewImageService(nil, NewMemoryBlobStore(), DefaultRenditions)
 		err := imageService.CreateThumbnail(context.Background(), testImage)
 		if err != nil {
 			t.Errorf("error creating thumbnail: %s", err)
@@ -56,9 +60,10 @@ func TestImageService_Persist(t *testing.T) {
 	testImage := OpenTestImage(t)
 
 	t.Run("persist images", func(t *testing.T) {
-		// Persist images to FS, check whether the files exist and can be deleted
+		// Persist images to the blob store, check whether the blobs exist and can be deleted
 
-		imageService := NewImageService(nil)
+		store := NewMemoryBlobStore()
+		imageService := NewImageService(nil, store, DefaultRenditions)
 		err := imageService.Persist(context.Background(), testImage)
 		if err != nil {
 			t.Errorf("error while persisting images: %s", err)
@@ -67,21 +72,60 @@ func TestImageService_Persist(t *testing.T) {
 		if testImage.FullPath == "" || testImage.ThumbnailPath == "" {
 			t.Errorf("paths are empty")
 		}
-		if _, err := os.Stat(testImage.FullPath); os.IsNotExist(err) {
+		if _, err := store.Get(context.Background(), testImage.FullPath); err != nil {
 			t.Errorf("full image wasn't saved: %s", err)
 		}
-		if _, err := os.Stat(testImage.ThumbnailPath); os.IsNotExist(err) {
+		if _, err := store.Get(context.Background(), testImage.ThumbnailPath); err != nil {
 			t.Errorf("thumbnail image wasn't saved: %s", err)
 		}
 
-		if err := os.Remove(testImage.FullPath); err != nil {
+		if err := store.Delete(context.Background(), testImage.FullPath); err != nil {
 			t.Errorf("couldn't remove full image: %s", err)
 		}
-		if err := os.Remove(testImage.ThumbnailPath); err != nil {
+		if err := store.Delete(context.Background(), testImage.ThumbnailPath); err != nil {
 			t.Errorf("couldn't remove thumbnail: %s", err)
 		}
 	})
 
+	t.Run("original is kept as uploaded", func(t *testing.T) {
+
+		buff := new(bytes.Buffer)
+		png.Encode(buff, testImage.Full)
+		uploaded, err := NewImageFromBytes("test.png", buff.Bytes())
+		if err != nil {
+			t.Fatalf("error decoding: %s", err)
+		}
+		uploaded.Thumbnail = testImage.Thumbnail
+
+		store := NewMemoryBlobStore()
+		imageService := NewImageService(nil, store, DefaultRenditions)
+		if err := imageService.Persist(context.Background(), uploaded); err != nil {
+			t.Fatalf("error while persisting images: %s", err)
+		}
+		if !strings.HasSuffix(uploaded.FullPath, ".png") {
+			t.Errorf("original should keep its format, got key: %s", uploaded.FullPath)
+		}
+
+		loaded := &Image{FullPath: uploaded.FullPath}
+		if err := imageService.LoadFull(context.Background(), loaded); err != nil {
+			t.Fatalf("error loading: %s", err)
+		}
+		if !bytes.Equal(loaded.Original, buff.Bytes()) || loaded.MimeType != "image/png" {
+			t.Errorf("loaded original differs from the upload")
+		}
+		if HashContent(loaded.Original) != uploaded.Hash || uploaded.Size != int64(buff.Len()) {
+			t.Errorf("checksum or size not recorded well")
+		}
+	})
+
+	t.Run("store fails", func(t *testing.T) {
+
+		imageService := NewImageService(nil, failingBlobStore{}, DefaultRenditions)
+		if err := imageService.Persist(context.Background(), testImage); err == nil {
+			t.Errorf("persisting should've failed")
+		}
+	})
+
 }
 
 func TestImageService_SaveMetadata(t *testing.T) {
@@ -89,11 +133,19 @@ func TestImageService_SaveMetadata(t *testing.T) {
 	testName := "testName"
 	testFullPath := "testFullPath"
 	testThumbnailPath := "testThumbnailPath"
+	testHash := "testHash"
+	testFormat := "jpeg"
+	testMimeType := "image/jpeg"
+	testSize := int64(100)
 	testImage := &Image{
 		Name:          testName,
 		FullPath:      testFullPath,
 		ThumbnailPath: testThumbnailPath,
 		Resolution:    image.Point{X: 0, Y: 0},
+		Hash:          testHash,
+		Format:        testFormat,
+		MimeType:      testMimeType,
+		Size:          testSize,
 	}
 	userId := int64(1)
 	imageId := int64(10)
@@ -108,11 +160,11 @@ func TestImageService_SaveMetadata(t *testing.T) {
 		defer db.Close()
 
 		mock.ExpectBegin()
-		mock.ExpectQuery("INSERT INTO image").WithArgs(testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(imageId))
+		mock.ExpectQuery("INSERT INTO image").WithArgs(testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY, testHash, testFormat, testMimeType, testSize, nil, nil, "", "", false).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(imageId))
 		mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, imageId).WillReturnResult(sqlmock.NewResult(imageId, 1))
 		mock.ExpectCommit()
 
-		service := NewImageService(db)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
 		ctx := context.WithValue(context.Background(), "userId", userId)
 		if err = service.SaveMetadata(ctx, testImage); err != nil {
 			t.Errorf("failed while persisting: %s", err)
@@ -123,6 +175,33 @@ func TestImageService_SaveMetadata(t *testing.T) {
 		}
 	})
 
+	t.Run("upload into an album", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		albumId := 3
+		mock.ExpectBegin()
+		mock.ExpectQuery("INSERT INTO image").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(imageId))
+		mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, imageId).WillReturnResult(sqlmock.NewResult(imageId, 1))
+		mock.ExpectExec("INSERT INTO album_images").WithArgs(albumId, imageId).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		ctx := context.WithValue(context.Background(), "userId", userId)
+		ctx = context.WithValue(ctx, "albumId", albumId)
+		if err = service.SaveMetadata(ctx, testImage); err != nil {
+			t.Errorf("failed while persisting: %s", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
 	t.Run("error while executing first query", func(t *testing.T) {
 
 		db, mock, err := sqlmock.New()
@@ -132,10 +211,10 @@ func TestImageService_SaveMetadata(t *testing.T) {
 		defer db.Close()
 
 		mock.ExpectBegin()
-		mock.ExpectQuery("INSERT INTO image").WithArgs(testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY).WillReturnError(fmt.Errorf("some err"))
+		mock.ExpectQuery("INSERT INTO image").WithArgs(testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY, testHash, testFormat, testMimeType, testSize, nil, nil, "", "", false).WillReturnError(fmt.Errorf("some err"))
 		mock.ExpectRollback()
 
-		service := NewImageService(db)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
 		if err = service.SaveMetadata(context.Background(), testImage); err == nil {
 			t.Errorf("persisting should've failed")
 		}
@@ -154,11 +233,11 @@ func TestImageService_SaveMetadata(t *testing.T) {
 		defer db.Close()
 
 		mock.ExpectBegin()
-		mock.ExpectQuery("INSERT INTO image").WithArgs(testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(imageId))
+		mock.ExpectQuery("INSERT INTO image").WithArgs(testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY, testHash, testFormat, testMimeType, testSize, nil, nil, "", "", false).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(imageId))
 		mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, imageId).WillReturnError(fmt.Errorf("some error"))
 		mock.ExpectRollback()
 
-		service := NewImageService(db)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
 		ctx := context.WithValue(context.Background(), "userId", 1)
 		if err = service.SaveMetadata(ctx, testImage); err == nil {
 			t.Errorf("should've failed while doing second query")
@@ -178,11 +257,11 @@ func TestImageService_SaveMetadata(t *testing.T) {
 		defer db.Close()
 
 		mock.ExpectBegin()
-		mock.ExpectQuery("INSERT INTO image").WithArgs(testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(imageId))
+		mock.ExpectQuery("INSERT INTO image").WithArgs(testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY, testHash, testFormat, testMimeType, testSize, nil, nil, "", "", false).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(imageId))
 		mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, imageId).WillReturnResult(sqlmock.NewResult(imageId, 1))
 		mock.ExpectCommit().WillReturnError(fmt.Errorf("error while committing"))
 
-		service := NewImageService(db)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
 		ctx := context.WithValue(context.Background(), "userId", 1)
 		if err = service.SaveMetadata(ctx, testImage); err == nil {
 			t.Errorf("should've failed while committing")
@@ -192,6 +271,111 @@ func TestImageService_SaveMetadata(t *testing.T) {
 			t.Errorf("there were unfulfilled expectations: %s", err)
 		}
 	})
+
+	t.Run("deduplicated image is only linked", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, imageId).WillReturnResult(sqlmock.NewResult(imageId, 1))
+		mock.ExpectCommit()
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		ctx := context.WithValue(context.Background(), "userId", userId)
+		dedupImage := &Image{Id: int(imageId), Name: testName, Hash: testHash, Deduplicated: true}
+		if err = service.SaveMetadata(ctx, dedupImage); err != nil {
+			t.Errorf("failed while persisting: %s", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("same content saved in the meantime", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		store := NewMemoryBlobStore()
+		fullKey := StoreTestImage(t, store)
+		thumbnailKey := StoreTestImage(t, store)
+		racingImage := &Image{Name: testName, FullPath: fullKey, ThumbnailPath: thumbnailKey, Hash: testHash}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("INSERT INTO image").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		mock.ExpectQuery("SELECT id, fullpath, thumbnailpath FROM image WHERE hash").WithArgs(testHash).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "fullpath", "thumbnailpath"}).AddRow(imageId, testFullPath, testThumbnailPath))
+		mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, imageId).WillReturnResult(sqlmock.NewResult(imageId, 1))
+		mock.ExpectCommit()
+
+		service := NewImageService(db, store, DefaultRenditions)
+		ctx := context.WithValue(context.Background(), "userId", userId)
+		if err = service.SaveMetadata(ctx, racingImage); err != nil {
+			t.Errorf("failed while persisting: %s", err)
+		}
+		if !racingImage.Deduplicated || racingImage.FullPath != testFullPath {
+			t.Errorf("image should've been linked to the existing one")
+		}
+		if keys := store.Keys(""); len(keys) != 0 {
+			t.Errorf("blobs of the duplicate weren't removed: %v", keys)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+func TestImageService_FindByHash(t *testing.T) {
+
+	testHash := "testHash"
+
+	t.Run("found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		rows := NewImageRows().
+			AddRow(1, "testName", "testFullPath", "testThumbnailPath", 0, 0, testHash, "jpeg", "image/jpeg", 100)
+		mock.ExpectQuery("SELECT (.+) FROM image WHERE hash").WithArgs(testHash).WillReturnRows(rows)
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		img, err := service.FindByHash(context.Background(), testHash)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if img.Id != 1 || img.FullPath != "testFullPath" {
+			t.Errorf("image was not instantiated well")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) FROM image WHERE hash").WithArgs(testHash).
+			WillReturnRows(NewImageRows())
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.FindByHash(context.Background(), testHash); err != ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+	})
 }
 
 func TestImageService_GetMetadata(t *testing.T) {
@@ -209,11 +393,11 @@ func TestImageService_GetMetadata(t *testing.T) {
 		}
 		defer db.Close()
 
-		rows := sqlmock.NewRows([]string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y"}).
-			AddRow(imageId, testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY)
+		rows := NewImageRows().
+			AddRow(imageId, testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY, "", "", "", 0)
 		mock.ExpectQuery("SELECT").WillReturnRows(rows)
 
-		service := NewImageService(db)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
 		imgs, err := service.GetMetadata(context.Background(), []int{int(imageId)})
 		if err != nil {
 			t.Errorf("unexpected error: %s", err)
@@ -240,10 +424,10 @@ func TestImageService_GetMetadata(t *testing.T) {
 		defer db.Close()
 
 		//query := fmt.Sprintf("SELECT name, fullpath, thumbnailpath FROM image WHERE image_id = %d", imageId)
-		rows := sqlmock.NewRows([]string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y"})
+		rows := NewImageRows()
 		mock.ExpectQuery("SELECT").WillReturnRows(rows)
 
-		service := NewImageService(db)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
 		_, err = service.GetMetadata(context.Background(), []int{int(imageId)})
 		if err == nil {
 			t.Errorf("expected error of no rows found")
@@ -264,7 +448,7 @@ func TestImageService_GetMetadata(t *testing.T) {
 
 		mock.ExpectQuery("SELECT").WillReturnError(fmt.Errorf("some error"))
 
-		service := NewImageService(db)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
 		_, err = service.GetMetadata(context.Background(), []int{int(imageId)})
 		if err == nil {
 			t.Errorf("expected query error")
@@ -281,19 +465,21 @@ func TestImageService_GetAllMetadata(t *testing.T) {
 	testName := "testName"
 	testFullPath := "testFullPath"
 	testThumbnailPath := "testThumbnailPath"
-	noImages := 5
-	images := make([]*Image, 0)
-	for i := 0; i < noImages; i++ {
-		images = append(images, &Image{
-			Name:          fmt.Sprintf("%s%d", testName, i),
-			FullPath:      fmt.Sprintf("%s%d", testFullPath, i),
-			ThumbnailPath: fmt.Sprintf("%s%d", testThumbnailPath, i),
-		})
-	}
 	userId := 1
 	testResolutionX, testResolutionY := 0, 0
+	uploaded := time.Date(2021, 7, 14, 18, 30, 5, 0, time.UTC)
+	firstPage := Page{Limit: 2, Sort: SortUploaded, Desc: true}
 
-	t.Run("success", func(t *testing.T) {
+	// The rows have the sort key and the average color at the end
+	newRows := func(ids ...int) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y", "hash", "format", "mime_type", "size", "created_at", "average_color", "blurhash", "lqip"})
+		for _, id := range ids {
+			rows.AddRow(id, fmt.Sprintf("%s%d", testName, id), testFullPath, testThumbnailPath, testResolutionX, testResolutionY, "", "", "", 0, uploaded, 0x336699, "LEHV6nWB2yk8pyo0adR*.7kCMdnj", "")
+		}
+		return rows
+	}
+
+	t.Run("first page", func(t *testing.T) {
 
 		ctx := context.WithValue(context.Background(), "userId", userId)
 		db, mock, err := sqlmock.New()
@@ -302,34 +488,26 @@ func TestImageService_GetAllMetadata(t *testing.T) {
 		}
 		defer db.Close()
 
-		imageIdRows := sqlmock.NewRows([]string{"image_id"})
-		for i := 0; i < noImages; i++ {
-			imageIdRows.AddRow(i)
-		}
-		mock.ExpectQuery("SELECT image_id").WillReturnRows(imageIdRows)
+		mock.ExpectQuery("SELECT (.+) FROM image JOIN user_images (.+) WHERE user_id = \\$1 ORDER BY user_images.created_at DESC, image.id DESC LIMIT \\$2").
+			WithArgs(userId, 3).WillReturnRows(newRows(5, 4, 3))
 
-		imageRows := sqlmock.NewRows([]string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y"})
-		for i := 0; i < noImages; i++ {
-			imageRows.AddRow(i, images[i].Name, images[i].FullPath, images[i].ThumbnailPath, testResolutionX, testResolutionY)
-		}
-		mock.ExpectQuery("SELECT id, name, fullpath, thumbnailpath, resolution_x, resolution_y").WillReturnRows(imageRows)
-
-		service := NewImageService(db)
-		images, errors, err := service.GetAllMetadata(ctx)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		page, err := service.GetAllMetadata(ctx, ImageFilter{}, firstPage)
 		if err != nil {
-			t.Errorf("unexpected error: %s", err)
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(page.Images) != 2 || page.Images[0].Id != 5 || page.Images[1].Id != 4 {
+			t.Errorf("incorrect images on the page")
 		}
-		go func() {
-			for err := range errors {
-				t.Errorf("an error happened in the pipeline: %s", err)
-			}
-		}()
-		counter := 0
-		for range images {
-			counter++
+		if c := page.Images[0].AverageColor; c == nil || c.String() != "#336699" {
+			t.Errorf("incorrect average color: %v", c)
 		}
-		if counter != noImages || len(errors) != 0 {
-			t.Errorf("incorrect number of images")
+		if page.Images[0].BlurHash != "LEHV6nWB2yk8pyo0adR*.7kCMdnj" {
+			t.Errorf("incorrect blurhash: %s", page.Images[0].BlurHash)
+		}
+		cursor, err := DecodeCursor(page.NextCursor)
+		if err != nil || cursor.Id != 4 || !cursor.Time.Equal(uploaded) || cursor.Sort != SortUploaded || !cursor.Desc {
+			t.Errorf("incorrect next cursor: %+v, %v", cursor, err)
 		}
 
 		if err := mock.ExpectationsWereMet(); err != nil {
@@ -337,7 +515,7 @@ func TestImageService_GetAllMetadata(t *testing.T) {
 		}
 	})
 
-	t.Run("get ids fails", func(t *testing.T) {
+	t.Run("last page", func(t *testing.T) {
 
 		ctx := context.WithValue(context.Background(), "userId", userId)
 		db, mock, err := sqlmock.New()
@@ -346,12 +524,17 @@ func TestImageService_GetAllMetadata(t *testing.T) {
 		}
 		defer db.Close()
 
-		mock.ExpectQuery("SELECT image_id").WillReturnError(fmt.Errorf("some error"))
+		page := Page{Limit: 2, Sort: SortName, After: &Cursor{Sort: SortName, Name: "testName4", Id: 4}}
+		mock.ExpectQuery("SELECT (.+) AND \\(image.name, image.id\\) > \\(\\$2, \\$3\\) ORDER BY image.name ASC, image.id ASC LIMIT \\$4").
+			WithArgs(userId, "testName4", 4, 3).WillReturnRows(newRows(5))
 
-		service := NewImageService(db)
-		_, _, err = service.GetAllMetadata(ctx)
-		if err == nil {
-			t.Errorf("should have failed on get ids")
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		result, err := service.GetAllMetadata(ctx, ImageFilter{}, page)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(result.Images) != 1 || result.NextCursor != "" {
+			t.Errorf("should be the last page: %+v", result)
 		}
 
 		if err := mock.ExpectationsWereMet(); err != nil {
@@ -359,7 +542,7 @@ func TestImageService_GetAllMetadata(t *testing.T) {
 		}
 	})
 
-	t.Run("N images don't exist", func(t *testing.T) {
+	t.Run("filtered", func(t *testing.T) {
 
 		ctx := context.WithValue(context.Background(), "userId", userId)
 		db, mock, err := sqlmock.New()
@@ -368,35 +551,57 @@ func TestImageService_GetAllMetadata(t *testing.T) {
 		}
 		defer db.Close()
 
-		imageIdRows := sqlmock.NewRows([]string{"image_id"})
-		for i := 0; i < noImages; i++ {
-			imageIdRows.AddRow(i)
+		after := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+		filter := ImageFilter{Tags: []string{"beach"}, Name: "100%_", UploadedAfter: after, MinWidth: 1920, Format: "png"}
+		mock.ExpectQuery("SELECT (.+) FROM image JOIN user_images (.+) image_tags (.+) name ILIKE (.+)created_at >= (.+) resolution_x >= (.+) format = \\$6 ORDER BY").
+			WithArgs(userId, "beach", `%100\%\_%`, after, 1920, "png", 3).WillReturnRows(newRows())
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		page, err := service.GetAllMetadata(ctx, filter, firstPage)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(page.Images) != 0 || page.NextCursor != "" {
+			t.Errorf("no images expected")
 		}
-		mock.ExpectQuery("SELECT image_id").WillReturnRows(imageIdRows)
 
-		noFails := 3
-		imageRows := sqlmock.NewRows([]string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y"})
-		for i := 0; i < noImages-noFails; i++ {
-			imageRows.AddRow(i, images[i].Name, images[i].FullPath, images[i].ThumbnailPath, testResolutionX, testResolutionY)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
 		}
-		mock.ExpectQuery("SELECT id, name, fullpath, thumbnailpath, resolution_x, resolution_y").WillReturnRows(imageRows)
+	})
+
+	t.Run("query fails", func(t *testing.T) {
 
-		service := NewImageService(db)
-		images, errors, err := service.GetAllMetadata(ctx)
+		ctx := context.WithValue(context.Background(), "userId", userId)
+		db, mock, err := sqlmock.New()
 		if err != nil {
-			t.Errorf("unexpected error: %s", err)
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT").WillReturnError(fmt.Errorf("some error"))
 
-		counterImg := 0
-		for range images {
-			counterImg++
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.GetAllMetadata(ctx, ImageFilter{}, firstPage); err == nil {
+			t.Errorf("should have failed on the query")
 		}
-		counterErr := 0
-		for range errors {
-			counterErr++
+	})
+
+	t.Run("reading fails midway", func(t *testing.T) {
+
+		ctx := context.WithValue(context.Background(), "userId", userId)
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 		}
-		if counterErr != 1 && counterImg != 0 {
-			t.Errorf("incorrect number of images and errors")
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) ORDER BY user_images.created_at DESC, image.id DESC LIMIT \\$2").
+			WithArgs(userId, 3).WillReturnRows(newRows(5, 4, 3).RowError(1, fmt.Errorf("some error")))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.GetAllMetadata(ctx, ImageFilter{}, firstPage); err == nil {
+			t.Errorf("should have failed on reading the rows")
 		}
 
 		if err := mock.ExpectationsWereMet(); err != nil {
@@ -405,94 +610,50 @@ func TestImageService_GetAllMetadata(t *testing.T) {
 	})
 }
 
-func TestDivide(t *testing.T) {
+// NewImageRows makes mock rows with the columns selected by imageColumns
+func NewImageRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y", "hash", "format", "mime_type", "size"})
+}
 
-	t.Run("less than size", func(t *testing.T) {
+type failingBlobStore struct{}
 
-		numberOfIds := 10
-		groupSize := 11
-		ids := make([]int, numberOfIds)
-		divisions := divide(ids, groupSize)
-		if len(divisions) != 1 {
-			t.Errorf("err")
-		}
-		if len(divisions[0]) != numberOfIds {
-			t.Errorf("err")
-		}
-	})
+func (failingBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	return fmt.Errorf("some error")
+}
 
-	t.Run("equal to size", func(t *testing.T) {
+func (failingBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("some error")
+}
 
-		numberOfIds := 10
-		groupSize := 11
-		ids := make([]int, numberOfIds)
-		divisions := divide(ids, groupSize)
-		if len(divisions) != 1 {
-			t.Errorf("err")
-		}
-		if len(divisions[0]) != numberOfIds {
-			t.Errorf("err")
-		}
-	})
+func (failingBlobStore) Delete(ctx context.Context, key string) error {
+	return fmt.Errorf("some error")
+}
 
-	t.Run("more than size last equal to group size", func(t *testing.T) {
-
-		numberOfIds := 15
-		groupSize := 5
-		ids := make([]int, numberOfIds)
-		divisions := divide(ids, groupSize)
-		for i, division := range divisions {
-			if i != len(divisions)-1 && len(division) != groupSize {
-				t.Errorf("err")
-			} else if i == len(divisions)-1 {
-				if int(math.Mod(float64(numberOfIds), float64(groupSize))) == 0 {
-					if len(division) != groupSize {
-						t.Errorf("err")
-					}
-				} else if len(division) != int(math.Mod(float64(numberOfIds), float64(groupSize))) {
-					t.Errorf("err")
-				}
-			}
-		}
-	})
+// StoreTestImage puts the test image into the store and returns its key
+func StoreTestImage(t *testing.T, store BlobStore) string {
 
-	t.Run("more than size last not equal to group size", func(t *testing.T) {
-
-		numberOfIds := 16
-		groupSize := 5
-		ids := make([]int, numberOfIds)
-		divisions := divide(ids, groupSize)
-		for i, division := range divisions {
-			if i != len(divisions)-1 && len(division) != groupSize {
-				t.Errorf("err")
-			} else if i == len(divisions)-1 {
-				fmt.Println(int(math.Mod(float64(numberOfIds), float64(groupSize))))
-				if int(math.Mod(float64(numberOfIds), float64(groupSize))) == 0 {
-					if len(division) != groupSize {
-						t.Errorf("err")
-					}
-				} else if len(division) != int(math.Mod(float64(numberOfIds), float64(groupSize))) {
-					t.Errorf("err")
-				}
-			}
-		}
-	})
+	f, err := os.Open(TestImagePath)
+	if err != nil {
+		t.Fatalf("test image doesn't exist %s", err)
+	}
+	defer f.Close()
+
+	key, _ := NewBlobKey("test", ".jpg")
+	if err := store.Put(context.Background(), key, f); err != nil {
+		t.Fatalf("couldn't store test image: %s", err)
+	}
+	return key
 }
 
 func OpenTestImage(t *testing.T) *Image {
 
-	existingImageFile, err := os.Open(TestImagePath)
+	b, err := ioutil.ReadFile(TestImagePath)
 	if err != nil {
 		t.Errorf("test image doesn't exist %s", err)
 		return nil
 	}
-	if existingImageFile == nil {
-		t.Errorf("image null")
-		return nil
-	}
-	defer existingImageFile.Close()
 
-	imageData, _, err := image.Decode(existingImageFile)
+	imageData, _, err := image.Decode(bytes.NewReader(b))
 	if err != nil {
 		t.Errorf("image failed decoding: %s", err)
 		return nil
@@ -501,5 +662,125 @@ func OpenTestImage(t *testing.T) *Image {
 	return &Image{
 		Full:      imageData,
 		Thumbnail: imageData,
+		Original:  b,
+		Format:    "jpeg",
+		MimeType:  "image/jpeg",
 	}
 }
+
+func TestImageService_Unlink(t *testing.T) {
+
+	userId := 1
+	imageId := 10
+	ctx := context.WithValue(context.Background(), "userId", userId)
+
+	t.Run("last reference purges the image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT fullpath, thumbnailpath FROM image (.+) FOR UPDATE").WithArgs(imageId).
+			WillReturnRows(sqlmock.NewRows([]string{"fullpath", "thumbnailpath"}).AddRow("full/a.jpg", "thumbnail/a.jpg"))
+		mock.ExpectExec("DELETE FROM user_images").WithArgs(userId, imageId).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM album_images").WithArgs(imageId, userId).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT COUNT").WithArgs(imageId).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectQuery("SELECT path FROM image_renditions").WithArgs(imageId).
+			WillReturnRows(sqlmock.NewRows([]string{"path"}).AddRow("renditions/medium/a.jpg"))
+		mock.ExpectExec("DELETE FROM image WHERE").WithArgs(imageId).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		deleted, err := service.Unlink(ctx, imageId)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !deleted.Purged || len(deleted.blobs) != 3 {
+			t.Errorf("image should've been purged with its 3 blobs: %+v", deleted)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("shared image is only unlinked", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT fullpath, thumbnailpath FROM image (.+) FOR UPDATE").WithArgs(imageId).
+			WillReturnRows(sqlmock.NewRows([]string{"fullpath", "thumbnailpath"}).AddRow("full/a.jpg", "thumbnail/a.jpg"))
+		mock.ExpectExec("DELETE FROM user_images").WithArgs(userId, imageId).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM album_images").WithArgs(imageId, userId).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT COUNT").WithArgs(imageId).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectCommit()
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		deleted, err := service.Unlink(ctx, imageId)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if deleted.Purged || len(deleted.blobs) != 0 {
+			t.Errorf("shared image shouldn't be purged: %+v", deleted)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("someone else's image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT fullpath, thumbnailpath FROM image (.+) FOR UPDATE").WithArgs(imageId).
+			WillReturnRows(sqlmock.NewRows([]string{"fullpath", "thumbnailpath"}).AddRow("full/a.jpg", "thumbnail/a.jpg"))
+		mock.ExpectExec("DELETE FROM user_images").WithArgs(userId, imageId).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.Unlink(ctx, imageId); err != ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("image doesn't exist", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT fullpath, thumbnailpath FROM image (.+) FOR UPDATE").WithArgs(imageId).
+			WillReturnRows(sqlmock.NewRows([]string{"fullpath", "thumbnailpath"}))
+		mock.ExpectRollback()
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.Unlink(ctx, imageId); err != ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
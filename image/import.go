@@ -0,0 +1,89 @@
+package image
+
+import (
+	"context"
+	pipe "github.com/ele7ija/pipeline"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ImportFiles lists the regular files under the directory, recursively and in lexical order, as slash separated
+// paths relative to it. Hidden files and directories are left out.
+func ImportFiles(dir string) ([]string, error) {
+
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && hiddenEntry(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// ImportDirectory creates the user's images from the files under the directory, see ImportFiles, through the create pipeline.
+// Files that aren't images are skipped, and so are the ones the user already has. With dryRun nothing is created,
+// the images that would be are UploadPending. progress is called with every result and the number of files, if it's not nil.
+func ImportDirectory(ctx context.Context, service ImageService, pipeline *pipe.Pipeline, dir string, dryRun bool, progress func(result *UploadResult, total int)) ([]*UploadResult, error) {
+
+	files, err := ImportFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	onResult := func(result *UploadResult) {
+		if progress != nil {
+			progress(result, len(files))
+		}
+	}
+
+	feed := func(send func(*Upload) error, done func(*UploadResult)) error {
+		for index, name := range files {
+			result := &UploadResult{Index: index, Name: name}
+			data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				result.fail(UploadCodeUnreadable, err.Error())
+				done(result)
+				continue
+			}
+			if !isImage(data) {
+				result.skip()
+				done(result)
+				continue
+			}
+			has, err := service.HasContent(ctx, HashContent(data))
+			if err != nil {
+				return err
+			}
+			if has {
+				result.Status = UploadExisting
+				done(result)
+				continue
+			}
+			if dryRun {
+				result.Status = UploadPending
+				done(result)
+				continue
+			}
+			if err := send(&Upload{Index: index, Name: name, Data: data}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return CreateUploads(ctx, pipeline, feed, onResult)
+}
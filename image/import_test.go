@@ -0,0 +1,90 @@
+package image
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeImportDir(t *testing.T) string {
+
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	photo, _ := ioutil.ReadFile(TestImagePath)
+	for name, data := range map[string][]byte{
+		"a.jpg":          photo,
+		"notes.txt":      []byte("not an image"),
+		"sub/b.jpg":      photo,
+		".hidden/c.jpg":  photo,
+		"sub/.DS_Store":  []byte("finder"),
+		"sub/deep/d.png": photo,
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	return dir
+}
+
+func TestImportFiles(t *testing.T) {
+
+	files, err := ImportFiles(makeImportDir(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(files) != 4 || files[0] != "a.jpg" || files[1] != "notes.txt" || files[2] != "sub/b.jpg" || files[3] != "sub/deep/d.png" {
+		t.Errorf("incorrect files: %v", files)
+	}
+}
+
+func TestImportDirectory(t *testing.T) {
+
+	userId := 1
+	ctx := context.WithValue(context.Background(), "userId", userId)
+	photo, _ := ioutil.ReadFile(TestImagePath)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	hash := HashContent(photo)
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(hash, userId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(hash, userId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(hash, userId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+	var progressed []string
+	progress := func(result *UploadResult, total int) {
+		if total != 4 {
+			t.Errorf("incorrect total: %d", total)
+		}
+		progressed = append(progressed, result.Status)
+	}
+	results, err := ImportDirectory(ctx, service, MakeCreateImagesPipelineBoundedFilters(service), makeImportDir(t), true, progress)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	expected := []string{UploadPending, UploadSkipped, UploadExisting, UploadPending}
+	if len(results) != len(expected) || len(progressed) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Errorf("%s should be %s, got %s", results[i].Name, status, results[i].Status)
+		}
+	}
+}
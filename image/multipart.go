@@ -0,0 +1,120 @@
+package image
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+)
+
+// MaxMultipartFileSize is the largest file read from a streamed form. A file is held in memory while it's in the pipeline,
+// so a form takes up to MaxUploadsInFlight times as much.
+var MaxMultipartFileSize int64 = 100 << 20
+
+// maxMultipartFieldSize is the largest value of a form field, they're small ids
+const maxMultipartFieldSize = 1 << 10
+
+// MultipartUploads reads the files of a multipart form as they arrive, instead of parsing the whole form first.
+// The fields that come before the first file, e.g. albumId, are read up front into Fields.
+type MultipartUploads struct {
+	Fields url.Values
+	reader *multipart.Reader
+	next   *multipart.Part // The first file, read while looking for the fields
+}
+
+func NewMultipartUploads(reader *multipart.Reader) (*MultipartUploads, error) {
+
+	m := &MultipartUploads{Fields: url.Values{}, reader: reader}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("corrupt form: %w", err)
+		}
+		if part.FileName() != "" {
+			m.next = part
+			return m, nil
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxMultipartFieldSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("corrupt form: %w", err)
+		}
+		if len(value) > maxMultipartFieldSize {
+			return nil, fmt.Errorf("form field %s longer than %d B", part.FormName(), maxMultipartFieldSize)
+		}
+		m.Fields.Add(part.FormName(), string(value))
+	}
+}
+
+// Feed sends the files of the field into the create pipeline one at a time, so only the files in the pipeline,
+// at most MaxUploadsInFlight of them, are held in memory however large the form is. Files of other fields and fields after the first file are skipped.
+// allow is asked before every image with their count and total size so far. Once it says no, the rest of the files
+// are read past and fail, so every file gets a result.
+func (m *MultipartUploads) Feed(field string, allow func(count int, size int64) (bool, error)) UploadFeed {
+
+	return func(send func(*Upload) error, done func(*UploadResult)) error {
+		index, count, size := 0, 0, int64(0)
+		allowed := true
+		for {
+			part, err := m.NextFile(field)
+			if err != nil || part == nil {
+				return err
+			}
+
+			result := &UploadResult{Index: index, Name: part.FileName()}
+			index++
+			if !allowed {
+				// NextPart reads past it
+				done(result.fail(UploadCodeNotAllowed, "over the limits of the upload"))
+				continue
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(part, MaxMultipartFileSize+1))
+			if err != nil {
+				return fmt.Errorf("%s: %w", result.Name, err)
+			}
+			if int64(len(data)) > MaxMultipartFileSize {
+				done(result.fail(UploadCodeTooLarge, fmt.Sprintf("larger than %d B", MaxMultipartFileSize)))
+				continue
+			}
+
+			count++
+			size += int64(len(data))
+			if allowed, err = allow(count, size); !allowed || err != nil {
+				allowed = false
+				done(result.fail(UploadCodeNotAllowed, "over the limits of the upload"))
+				if err != nil {
+					log.Errorf("policy error happened: %s", err)
+				}
+				continue
+			}
+			if err := send(&Upload{Index: result.Index, Name: result.Name, Data: data}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NextFile returns the next file of the field as it streams in, or nil at the end of the form.
+// Feed sends the files of images, it's for the others, e.g. an archive.
+func (m *MultipartUploads) NextFile(field string) (*multipart.Part, error) {
+
+	for {
+		part := m.next
+		m.next = nil
+		if part == nil {
+			var err error
+			if part, err = m.reader.NextPart(); err == io.EOF {
+				return nil, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("corrupt form: %w", err)
+			}
+		}
+		if part.FileName() != "" && part.FormName() == field {
+			return part, nil
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package image
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"testing"
+)
+
+func TestMultipartUploads(t *testing.T) {
+
+	photo, _ := ioutil.ReadFile(TestImagePath)
+	allowAll := func(count int, size int64) (bool, error) { return true, nil }
+
+	t.Run("streams the files", func(t *testing.T) {
+
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		secondFile := make(chan struct{})
+		go func() {
+			mw.WriteField("albumId", "4")
+			f, _ := mw.CreateFormFile("images", "a.jpg")
+			f.Write(photo)
+			mw.WriteField("late", "ignored")
+			f, _ = mw.CreateFormFile("other", "notes.txt")
+			f.Write([]byte("not an image"))
+			// The first file is in the pipeline before the rest of the form is sent
+			<-secondFile
+			f, _ = mw.CreateFormFile("images", "b.jpg")
+			f.Write(photo)
+			mw.Close()
+			pw.Close()
+		}()
+
+		uploads, err := NewMultipartUploads(multipart.NewReader(pr, mw.Boundary()))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if uploads.Fields.Get("albumId") != "4" {
+			t.Errorf("incorrect fields: %v", uploads.Fields)
+		}
+
+		var sent []*Upload
+		send := func(upload *Upload) error {
+			if len(sent) == 0 {
+				close(secondFile)
+			}
+			sent = append(sent, upload)
+			return nil
+		}
+		done := func(result *UploadResult) { t.Errorf("unexpected result: %+v", result) }
+		if err := uploads.Feed("images", allowAll)(send, done); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(sent) != 2 || sent[0].Name != "a.jpg" || sent[1].Name != "b.jpg" || sent[1].Index != 1 || !bytes.Equal(sent[1].Data, photo) {
+			t.Errorf("incorrect uploads: %v", sent)
+		}
+		if uploads.Fields.Get("late") != "" {
+			t.Errorf("fields after the files should be skipped: %v", uploads.Fields)
+		}
+	})
+
+	t.Run("not allowed and too large", func(t *testing.T) {
+
+		defer func(max int64) { MaxMultipartFileSize = max }(MaxMultipartFileSize)
+		MaxMultipartFileSize = int64(len(photo))
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, name := range []string{"a.jpg", "big.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+			f, _ := mw.CreateFormFile("images", name)
+			f.Write(photo)
+			if name == "big.jpg" {
+				f.Write([]byte{0})
+			}
+		}
+		mw.Close()
+
+		uploads, err := NewMultipartUploads(multipart.NewReader(&body, mw.Boundary()))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var sent []*Upload
+		var results []*UploadResult
+		allowTwo := func(count int, size int64) (bool, error) {
+			return count <= 2 && size <= 2*int64(len(photo)), nil
+		}
+		send := func(upload *Upload) error {
+			sent = append(sent, upload)
+			return nil
+		}
+		done := func(result *UploadResult) { results = append(results, result) }
+		if err := uploads.Feed("images", allowTwo)(send, done); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(sent) != 2 || sent[0].Name != "a.jpg" || sent[1].Name != "b.jpg" {
+			t.Errorf("incorrect uploads: %v", sent)
+		}
+		// The files after the first one that isn't allowed are read past
+		if len(results) != 3 {
+			t.Fatalf("incorrect number of results: %d", len(results))
+		}
+		if results[0].Name != "big.jpg" || results[0].Status != UploadFailed || results[0].Code != UploadCodeTooLarge {
+			t.Errorf("incorrect result: %+v", results[0])
+		}
+		for i, name := range []string{"c.jpg", "d.jpg"} {
+			if result := results[i+1]; result.Name != name || result.Index != i+3 || result.Status != UploadFailed || result.Code != UploadCodeNotAllowed {
+				t.Errorf("incorrect result: %+v", result)
+			}
+		}
+	})
+
+	t.Run("corrupt form", func(t *testing.T) {
+
+		body := bytes.NewBufferString("--boundary\r\nContent-Disposition: form-data; name=\"images\"; filename=\"a.jpg\"\r\n\r\nbroken off")
+		uploads, err := NewMultipartUploads(multipart.NewReader(body, "boundary"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		send := func(upload *Upload) error { return nil }
+		done := func(result *UploadResult) {}
+		if err := uploads.Feed("images", allowAll)(send, done); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package image
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Sort orders of the image listing. Ties are broken by the image id, so the order is stable.
+type SortField string
+
+const (
+	SortUploaded SortField = "uploaded" // When the user uploaded the image
+	SortName     SortField = "name"
+	SortTaken    SortField = "taken" // EXIF date taken, images without one are sorted by the upload time
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+var ErrBadCursor = fmt.Errorf("bad cursor")
+
+// Page says which part of the sorted image listing to get
+type Page struct {
+	Limit int
+	Sort  SortField
+	Desc  bool
+	After *Cursor // The page starts after the image of the cursor, nil for the first page
+}
+
+// Cursor points to the last image of a page: its sort key and its id
+type Cursor struct {
+	Sort SortField `json:"s"`
+	Desc bool      `json:"d,omitempty"`
+	Name string    `json:"n,omitempty"`
+	Time time.Time `json:"t,omitempty"`
+	Id   int       `json:"i"`
+}
+
+// ImagePage is a page of the image listing. NextCursor is empty on the last page.
+type ImagePage struct {
+	Images     []*Image
+	NextCursor string
+}
+
+// Encode makes the cursor opaque to the client
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || !c.Sort.valid() {
+		return nil, ErrBadCursor
+	}
+	return &c, nil
+}
+
+// ParsePage reads the page from query parameters: ?limit=50&sort=taken&order=desc&cursor=<nextCursor>.
+// The newest uploads come first by default. A cursor continues with the sort order it was made with.
+func ParsePage(query url.Values) (Page, error) {
+
+	page := Page{Limit: DefaultPageLimit, Sort: SortUploaded, Desc: true}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if page.Limit, err = strconv.Atoi(limit); err != nil || page.Limit < 1 || page.Limit > MaxPageLimit {
+			return page, fmt.Errorf("limit should be between 1 and %d", MaxPageLimit)
+		}
+	}
+	if sort := query.Get("sort"); sort != "" {
+		page.Sort = SortField(sort)
+		if !page.Sort.valid() {
+			return page, fmt.Errorf("sort should be one of %s, %s or %s", SortUploaded, SortName, SortTaken)
+		}
+	}
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		page.Desc = false
+	case "desc":
+		page.Desc = true
+	default:
+		return page, fmt.Errorf("order should be asc or desc")
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		c, err := DecodeCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+		if (query.Get("sort") != "" && c.Sort != page.Sort) || (query.Get("order") != "" && c.Desc != page.Desc) {
+			return page, fmt.Errorf("%w: it was made for a different sort order", ErrBadCursor)
+		}
+		page.Sort, page.Desc, page.After = c.Sort, c.Desc, c
+	}
+	return page, nil
+}
+
+func (s SortField) valid() bool {
+	return s == SortUploaded || s == SortName || s == SortTaken
+}
+
+// key is the SQL expression the images are sorted by, on the image table joined with user_images
+func (s SortField) key() string {
+	switch s {
+	case SortName:
+		return "image.name"
+	case SortTaken:
+		return "COALESCE((SELECT date_taken FROM image_metadata WHERE image_metadata.image_id = image.id), user_images.created_at)"
+	default:
+		return "user_images.created_at"
+	}
+}
+
+// after makes the condition which skips the images up to and including the cursor
+func (p Page) after(args []interface{}) (string, []interface{}) {
+
+	if p.After == nil {
+		return "", args
+	}
+	var value interface{} = p.After.Time
+	if p.Sort == SortName {
+		value = p.After.Name
+	}
+	op := ">"
+	if p.Desc {
+		op = "<"
+	}
+	args = append(args, value, p.After.Id)
+	return fmt.Sprintf(" AND (%s, image.id) %s ($%d, $%d)", p.Sort.key(), op, len(args)-1, len(args)), args
+}
+
+func (p Page) orderBy() string {
+	direction := "ASC"
+	if p.Desc {
+		direction = "DESC"
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, image.id %s", p.Sort.key(), direction, direction)
+}
@@ -0,0 +1,56 @@
+package image
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParsePage(t *testing.T) {
+
+	t.Run("defaults", func(t *testing.T) {
+
+		page, err := ParsePage(url.Values{})
+		if err != nil || page.Limit != DefaultPageLimit || page.Sort != SortUploaded || !page.Desc || page.After != nil {
+			t.Errorf("unexpected default page: %+v, %v", page, err)
+		}
+	})
+
+	t.Run("cursor keeps its sort order", func(t *testing.T) {
+
+		taken := time.Date(2021, 7, 14, 18, 30, 5, 123456000, time.UTC)
+		cursor := Cursor{Sort: SortTaken, Time: taken, Id: 7}
+		page, err := ParsePage(url.Values{"limit": {"10"}, "cursor": {cursor.Encode()}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if page.Limit != 10 || page.Sort != SortTaken || page.Desc || page.After.Id != 7 || !page.After.Time.Equal(taken) {
+			t.Errorf("cursor not decoded well: %+v", page)
+		}
+	})
+
+	t.Run("cursor of another sort order", func(t *testing.T) {
+
+		cursor := Cursor{Sort: SortName, Name: "a.jpg", Id: 7}
+		_, err := ParsePage(url.Values{"sort": {"uploaded"}, "cursor": {cursor.Encode()}})
+		if !errors.Is(err, ErrBadCursor) {
+			t.Errorf("expected ErrBadCursor, got: %v", err)
+		}
+	})
+
+	invalid := map[string]url.Values{
+		"zero limit":     {"limit": {"0"}},
+		"too big limit":  {"limit": {"1000"}},
+		"unknown sort":   {"sort": {"size"}},
+		"unknown order":  {"order": {"random"}},
+		"garbage cursor": {"cursor": {"not a cursor"}},
+	}
+	for name, query := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParsePage(query); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
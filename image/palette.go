@@ -0,0 +1,238 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PaletteSize is how many dominant colors are extracted from an image
+const PaletteSize = 5
+
+// paletteSample is the side of the square the image is shrunk to before its colors are clustered
+const paletteSample = 64
+
+// Color is an opaque RGB color, written as #rrggbb in JSON
+type Color struct {
+	R, G, B uint8
+}
+
+// PaletteColor is one of the dominant colors of an image
+type PaletteColor struct {
+	Color  Color   `json:"color"`
+	Weight float64 `json:"weight"` // The share of the image in this color, from 0 to 1
+}
+
+// ParseColor reads a color written as #rrggbb, the # is optional
+func ParseColor(s string) (Color, error) {
+
+	hex := strings.TrimPrefix(s, "#")
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return Color{}, fmt.Errorf("color %q should be like #rrggbb", s)
+	}
+	return ColorFromInt(int(v)), nil
+}
+
+// ColorFromInt makes the color from its 0xRRGGBB value, the way it's stored
+func ColorFromInt(v int) Color {
+	return Color{uint8(v >> 16), uint8(v >> 8), uint8(v)}
+}
+
+// Int is the 0xRRGGBB value of the color
+func (c Color) Int() int {
+	return int(c.R)<<16 | int(c.G)<<8 | int(c.B)
+}
+
+func (c Color) String() string {
+	return fmt.Sprintf("#%06x", c.Int())
+}
+
+func (c Color) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c *Color) UnmarshalJSON(b []byte) error {
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseColor(s)
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// colorValue maps the color onto an INT column as 0xRRGGBB
+func colorValue(c *Color) interface{} {
+	if c == nil {
+		return nil
+	}
+	return c.Int()
+}
+
+// paletteInsert makes the insert of the palette of the image, in a single statement
+func paletteInsert(imageId int, palette []PaletteColor) (string, []interface{}) {
+
+	var values []string
+	args := []interface{}{imageId}
+	for i, c := range palette {
+		args = append(args, i, int(c.Color.R), int(c.Color.G), int(c.Color.B), c.Weight)
+		n := len(args)
+		values = append(values, fmt.Sprintf("($1, $%d, $%d, $%d, $%d, $%d)", n-4, n-3, n-2, n-1, n))
+	}
+	return "INSERT INTO image_colors (image_id, position, red, green, blue, weight) VALUES " + strings.Join(values, ", "), args
+}
+
+// ColorDistance is the euclidean distance of the colors in the RGB space, from 0 to about 441
+func ColorDistance(a, b Color) float64 {
+	dr, dg, db := float64(a.R)-float64(b.R), float64(a.G)-float64(b.G), float64(a.B)-float64(b.B)
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
+
+// samplePixels shrinks the image and returns its pixels that aren't mostly transparent
+func samplePixels(img image.Image) [][3]float64 {
+
+	small := resize.Resize(paletteSample, paletteSample, img, resize.Bilinear)
+	b := small.Bounds()
+	pixels := make([][3]float64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(small.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			pixels = append(pixels, [3]float64{float64(c.R), float64(c.G), float64(c.B)})
+		}
+	}
+	return pixels
+}
+
+// AverageColor is the mean color of the image, e.g. for a placeholder while the image loads
+func AverageColor(img image.Image) Color {
+
+	pixels := samplePixels(img)
+	if len(pixels) == 0 {
+		return Color{}
+	}
+	var sum [3]float64
+	for _, p := range pixels {
+		for c := range sum {
+			sum[c] += p[c]
+		}
+	}
+	n := float64(len(pixels))
+	return Color{uint8(math.Round(sum[0] / n)), uint8(math.Round(sum[1] / n)), uint8(math.Round(sum[2] / n))}
+}
+
+// Palette returns up to k dominant colors of the image, the most common first.
+// The colors are the centers of k-means clusters of the pixels of a downsampled copy.
+func Palette(img image.Image, k int) []PaletteColor {
+
+	pixels := samplePixels(img)
+	if len(pixels) == 0 || k <= 0 {
+		return nil
+	}
+	centers := initCenters(pixels, k)
+	assignments := make([]int, len(pixels))
+	for iteration := 0; iteration < 20; iteration++ {
+		changed := false
+		for i, p := range pixels {
+			if nearest := nearestCenter(p, centers); nearest != assignments[i] {
+				assignments[i] = nearest
+				changed = true
+			}
+		}
+		if !changed && iteration > 0 {
+			break
+		}
+		sums := make([][3]float64, len(centers))
+		counts := make([]int, len(centers))
+		for i, p := range pixels {
+			for c := range p {
+				sums[assignments[i]][c] += p[c]
+			}
+			counts[assignments[i]]++
+		}
+		for i := range centers {
+			if counts[i] == 0 {
+				continue
+			}
+			for c := range centers[i] {
+				centers[i][c] = sums[i][c] / float64(counts[i])
+			}
+		}
+	}
+
+	counts := make([]int, len(centers))
+	for _, a := range assignments {
+		counts[a]++
+	}
+	var palette []PaletteColor
+	for i, center := range centers {
+		if counts[i] == 0 {
+			continue
+		}
+		palette = append(palette, PaletteColor{
+			Color:  Color{uint8(math.Round(center[0])), uint8(math.Round(center[1])), uint8(math.Round(center[2]))},
+			Weight: float64(counts[i]) / float64(len(pixels)),
+		})
+	}
+	sort.SliceStable(palette, func(i, j int) bool { return palette[i].Weight > palette[j].Weight })
+	return palette
+}
+
+// initCenters picks the starting centers with k-means++, seeded so that the same image always gets the same palette
+func initCenters(pixels [][3]float64, k int) [][3]float64 {
+
+	r := rand.New(rand.NewSource(1))
+	centers := [][3]float64{pixels[r.Intn(len(pixels))]}
+	distances := make([]float64, len(pixels))
+	for len(centers) < k {
+		sum := 0.0
+		for i, p := range pixels {
+			distances[i] = squaredDistance(p, centers[nearestCenter(p, centers)])
+			sum += distances[i]
+		}
+		if sum == 0 {
+			// Fewer distinct colors than k
+			break
+		}
+		target := r.Float64() * sum
+		next := len(pixels) - 1
+		for i, d := range distances {
+			if target -= d; target <= 0 {
+				next = i
+				break
+			}
+		}
+		centers = append(centers, pixels[next])
+	}
+	return centers
+}
+
+func nearestCenter(p [3]float64, centers [][3]float64) int {
+
+	nearest, best := 0, math.Inf(1)
+	for i, c := range centers {
+		if d := squaredDistance(p, c); d < best {
+			nearest, best = i, d
+		}
+	}
+	return nearest
+}
+
+func squaredDistance(a, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
@@ -0,0 +1,113 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestColor(t *testing.T) {
+
+	t.Run("parse", func(t *testing.T) {
+		c, err := ParseColor("#1a2B3c")
+		if err != nil || c != (Color{0x1a, 0x2b, 0x3c}) {
+			t.Errorf("incorrect color %v: %v", c, err)
+		}
+		for _, bad := range []string{"", "#fff", "#12345g", "#1234567"} {
+			if _, err := ParseColor(bad); err == nil {
+				t.Errorf("expected an error for %q", bad)
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		b, err := json.Marshal(PaletteColor{Color: Color{255, 0, 16}, Weight: 0.5})
+		if err != nil || string(b) != `{"color":"#ff0010","weight":0.5}` {
+			t.Fatalf("incorrect json %s: %v", b, err)
+		}
+		var c PaletteColor
+		if err := json.Unmarshal(b, &c); err != nil || c.Color != (Color{255, 0, 16}) {
+			t.Errorf("incorrect color %v: %v", c, err)
+		}
+	})
+}
+
+// twoColors is a picture with the left quarter red and the rest blue
+func twoColors() image.Image {
+
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 50, 100), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	return img
+}
+
+func TestPalette(t *testing.T) {
+
+	t.Run("dominant colors", func(t *testing.T) {
+		palette := Palette(twoColors(), PaletteSize)
+		if len(palette) < 2 {
+			t.Fatalf("expected at least two colors, got %v", palette)
+		}
+		if ColorDistance(palette[0].Color, Color{0, 0, 255}) > 20 || palette[0].Weight < 0.6 {
+			t.Errorf("blue should be the most common color: %v", palette)
+		}
+		sum := 0.0
+		for _, c := range palette {
+			sum += c.Weight
+		}
+		if sum < 0.999 || sum > 1.001 {
+			t.Errorf("weights should add up to 1: %v", palette)
+		}
+	})
+
+	t.Run("single color", func(t *testing.T) {
+		img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+		draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{10, 20, 30, 255}), image.Point{}, draw.Src)
+		palette := Palette(img, PaletteSize)
+		if len(palette) != 1 {
+			t.Errorf("expected a single color, got %v", palette)
+		}
+		if c := AverageColor(img); c != (Color{10, 20, 30}) {
+			t.Errorf("incorrect average color: %v", c)
+		}
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		a, b := Palette(twoColors(), PaletteSize), Palette(twoColors(), PaletteSize)
+		if len(a) != len(b) || a[0] != b[0] {
+			t.Errorf("the same image should get the same palette: %v %v", a, b)
+		}
+	})
+}
+
+func TestPaletteWorker(t *testing.T) {
+
+	img := OpenTestImage(t)
+	out, err := (&PaletteWorker{}).Work(context.Background(), img)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if img = out.(*Image); img.AverageColor == nil || len(img.Palette) == 0 || len(img.Palette) > PaletteSize {
+		t.Errorf("palette not extracted: %v %v", img.AverageColor, img.Palette)
+	}
+
+	deduplicated := OpenTestImage(t)
+	deduplicated.Deduplicated = true
+	if out, _ := (&PaletteWorker{}).Work(context.Background(), deduplicated); out.(*Image).Palette != nil {
+		t.Errorf("deduplicated images already have a palette")
+	}
+}
+
+func TestPaletteInsert(t *testing.T) {
+
+	query, args := paletteInsert(7, []PaletteColor{{Color{1, 2, 3}, 0.75}, {Color{4, 5, 6}, 0.25}})
+	if query != "INSERT INTO image_colors (image_id, position, red, green, blue, weight) VALUES ($1, $2, $3, $4, $5, $6), ($1, $7, $8, $9, $10, $11)" {
+		t.Errorf("incorrect query: %s", query)
+	}
+	if len(args) != 11 || args[0] != 7 || args[6] != 1 || args[10] != 0.25 {
+		t.Errorf("incorrect args: %v", args)
+	}
+}
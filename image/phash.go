@@ -0,0 +1,29 @@
+package image
+
+import (
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+)
+
+// PerceptualHash computes the 64 bit difference hash (dHash) of the image.
+// Visually similar images - re-saved, resized or slightly edited - get hashes with a small Hamming distance.
+func PerceptualHash(img image.Image) uint64 {
+
+	// Shrink to 9x8 so that every row has 8 horizontally adjacent pairs
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	b := small.Bounds()
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y
+			right := color.GrayModel.Convert(small.At(b.Min.X+x+1, b.Min.Y+y)).(color.Gray).Y
+			hash <<= 1
+			if left < right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
@@ -0,0 +1,151 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	pipeline2 "github.com/ele7ija/pipeline"
+	"image"
+	"image/jpeg"
+	"math/bits"
+	"testing"
+)
+
+// distance is the number of bits in which the two hashes differ
+func distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func TestPerceptualHash(t *testing.T) {
+
+	original := OpenTestImage(t).Full
+	hash := PerceptualHash(original)
+
+	t.Run("resized", func(t *testing.T) {
+		if d := distance(hash, PerceptualHash(ResizeTo(original, 160, 120, FitModeFit))); d > 5 {
+			t.Errorf("a resized copy should be similar, distance: %d", d)
+		}
+	})
+
+	t.Run("re-saved", func(t *testing.T) {
+		buff := new(bytes.Buffer)
+		if err := jpeg.Encode(buff, original, &jpeg.Options{Quality: 30}); err != nil {
+			t.Fatalf("error encoding: %s", err)
+		}
+		resaved, err := jpeg.Decode(buff)
+		if err != nil {
+			t.Fatalf("error decoding: %s", err)
+		}
+		if d := distance(hash, PerceptualHash(resaved)); d > 5 {
+			t.Errorf("a re-saved copy should be similar, distance: %d", d)
+		}
+	})
+
+	t.Run("different", func(t *testing.T) {
+		if d := distance(hash, PerceptualHash(FlipHorizontal(original))); d < 20 {
+			t.Errorf("a mirrored image shouldn't be similar, distance: %d", d)
+		}
+	})
+}
+
+func TestImageService_FindSimilar(t *testing.T) {
+
+	ctx := context.WithValue(context.Background(), "userId", 1)
+
+	t.Run("found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT phash FROM image").WithArgs(5, 1).WillReturnRows(sqlmock.NewRows([]string{"phash"}).AddRow(-1))
+		rows := sqlmock.NewRows([]string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y", "hash", "format", "mime_type", "size", "distance"}).
+			AddRow(6, "burst2.jpg", "full/6", "thumbnail/6", 320, 240, "", "jpeg", "image/jpeg", 100, 2).
+			AddRow(7, "burst3.jpg", "full/7", "thumbnail/7", 320, 240, "", "jpeg", "image/jpeg", 100, 7)
+		mock.ExpectQuery("SELECT (.+) AS distance FROM image").WithArgs(1, 5, int64(-1), 10).WillReturnRows(rows)
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		imgs, err := service.FindSimilar(ctx, 5, 10)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(imgs) != 2 || imgs[0].Id != 6 || *imgs[0].Distance != 2 || *imgs[1].Distance != 7 {
+			t.Errorf("similar images not found well: %+v", imgs)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT phash FROM image").WithArgs(5, 1).WillReturnRows(sqlmock.NewRows([]string{"phash"}))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.FindSimilar(ctx, 5, 10); err != ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("no perceptual hash yet", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT phash FROM image").WithArgs(5, 1).WillReturnRows(sqlmock.NewRows([]string{"phash"}).AddRow(nil))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.FindSimilar(ctx, 5, 10); !errors.Is(err, ErrNoPerceptualHash) {
+			t.Errorf("expected ErrNoPerceptualHash, got: %v", err)
+		}
+	})
+}
+
+func TestBackfillPerceptualHashesPipeline(t *testing.T) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := NewMemoryBlobStore()
+	key := StoreTestImage(t, store)
+	want := int64(PerceptualHash(OpenTestImage(t).Full))
+
+	mock.ExpectQuery("SELECT (.+) FROM image_metadata").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"orientation"}))
+	mock.ExpectExec("UPDATE image SET phash").WithArgs(want, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	service := NewImageService(db, store, DefaultRenditions)
+	pipeline := MakeBackfillPerceptualHashesPipeline(service)
+
+	inputChan := make(chan pipeline2.Item, 1)
+	errors := make(chan error, 1)
+	inputChan <- &Image{Id: 1, FullPath: key, Resolution: image.Pt(320, 240)}
+	close(inputChan)
+	items := pipeline.Filter(context.Background(), inputChan, errors)
+	for item := range items {
+		if img := item.(*Image); img.PerceptualHash == nil || img.Full != nil {
+			t.Errorf("hash not saved well")
+		}
+	}
+	close(errors)
+	for err := range errors {
+		t.Errorf("Error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -1,6 +1,7 @@
 package image
 
 import (
+	"fmt"
 	pipe "github.com/ele7ija/pipeline"
 	"time"
 )
@@ -9,16 +10,25 @@ func MakeGetImagePipeline(service ImageService) *pipe.Pipeline {
 	getMetadataWorker := GetMetadataWorker{service}
 	getMetadataFilter := pipe.NewParallelFilter(&getMetadataWorker)
 
+	loadExifWorker := LoadExifWorker{service}
+	loadExifFilter := pipe.NewParallelFilter(&loadExifWorker)
+
 	loadThumbnailWorker := LoadThumbnailWorker{service}
 	loadThumbnailFilter := pipe.NewParallelFilter(&loadThumbnailWorker)
 
 	loadFullWorker := LoadFullWorker{service}
 	loadFullFilter := pipe.NewParallelFilter(&loadFullWorker)
 
+	loadRenditionWorker := LoadRenditionWorker{service}
+	loadRenditionFilter := pipe.NewParallelFilter(&loadRenditionWorker)
+
+	watermarkWorker := WatermarkWorker{WatermarkOnServe}
+	watermarkFilter := pipe.NewParallelFilter(&watermarkWorker)
+
 	base64Encoder := Base64EncodeWorker{}
 	base64EncoderFilter := pipe.NewParallelFilter(&base64Encoder)
 
-	pipeline := pipe.NewPipeline("GetImagePipeline", getMetadataFilter, loadThumbnailFilter, loadFullFilter, base64EncoderFilter)
+	pipeline := pipe.NewPipeline("GetImagePipeline", getMetadataFilter, loadExifFilter, loadThumbnailFilter, loadFullFilter, loadRenditionFilter, watermarkFilter, base64EncoderFilter)
 	//pipeline.StartExtracting(5 * time.Second)
 	return pipeline
 }
@@ -28,22 +38,173 @@ func MakeGetAllImagesPipeline(service ImageService) *pipe.Pipeline {
 	loadThumbnailWorker := LoadThumbnailWorker{service}
 	loadThumbnailFilter := pipe.NewParallelFilter(&loadThumbnailWorker)
 
+	loadRenditionWorker := LoadRenditionWorker{service}
+	loadRenditionFilter := pipe.NewParallelFilter(&loadRenditionWorker)
+
+	watermarkWorker := WatermarkWorker{WatermarkOnServe}
+	watermarkFilter := pipe.NewParallelFilter(&watermarkWorker)
+
 	base64Encoder := Base64EncodeWorker{}
 	base64EncoderFilter := pipe.NewParallelFilter(&base64Encoder)
 
-	pipeline := pipe.NewPipeline("GetAllImagesPipeline", loadThumbnailFilter, base64EncoderFilter)
+	pipeline := pipe.NewPipeline("GetAllImagesPipeline", loadThumbnailFilter, loadRenditionFilter, watermarkFilter, base64EncoderFilter)
 	//pipeline.StartExtracting(5 * time.Second)
 	return pipeline
 }
 
+// MakeGetAllImageUrlsPipeline makes the JSON of the images with urls to their files, nothing is loaded from the store
+func MakeGetAllImageUrlsPipeline(prefix string, service ImageService) *pipe.Pipeline {
+
+	linkWorker := LinkWorker{prefix, service}
+	linkFilter := pipe.NewParallelFilter(&linkWorker)
+
+	pipeline := pipe.NewPipeline("GetAllImageUrlsPipeline", linkFilter)
+	return pipeline
+}
+
+func MakeDeleteImagesPipeline(service ImageService) *pipe.Pipeline {
+
+	unlinkWorker := UnlinkWorker{service}
+	unlinkFilter := pipe.NewBoundedParallelFilter(10, &unlinkWorker)
+
+	deleteBlobsWorker := DeleteBlobsWorker{service}
+	deleteBlobsFilter := pipe.NewBoundedParallelFilter(20, &deleteBlobsWorker)
+
+	pipeline := pipe.NewPipeline("DeleteImagesPipeline", unlinkFilter, deleteBlobsFilter)
+	return pipeline
+}
+
+// MakeExportImagesPipeline opens the originals of the exported images, a few at a time so they don't pile up
+// while the archive is written
+func MakeExportImagesPipeline(service ImageService) *pipe.Pipeline {
+
+	openOriginalWorker := OpenOriginalWorker{service}
+	openOriginalFilter := pipe.NewBoundedParallelFilter(10, &openOriginalWorker)
+
+	pipeline := pipe.NewPipeline("ExportImagesPipeline", openOriginalFilter)
+	return pipeline
+}
+
+// MakeBackfillPerceptualHashesPipeline computes the perceptual hashes of images uploaded before they were introduced
+func MakeBackfillPerceptualHashesPipeline(service ImageService) *pipe.Pipeline {
+
+	loadExifWorker := LoadExifWorker{service}
+	loadExifFilter := pipe.NewBoundedParallelFilter(10, &loadExifWorker)
+
+	loadFullWorker := LoadFullWorker{service}
+	loadFullFilter := pipe.NewBoundedParallelFilter(10, &loadFullWorker)
+
+	perceptualHashWorker := PerceptualHashWorker{}
+	perceptualHashFilter := pipe.NewBoundedParallelFilter(10, &perceptualHashWorker)
+
+	savePerceptualHashWorker := SavePerceptualHashWorker{service}
+	savePerceptualHashFilter := pipe.NewBoundedParallelFilter(10, &savePerceptualHashWorker)
+
+	pipeline := pipe.NewPipeline("BackfillPerceptualHashesPipeline", loadExifFilter, loadFullFilter, perceptualHashFilter, savePerceptualHashFilter)
+	return pipeline
+}
+
+// MakeEditImagesPipeline makes a pipeline that edits the user's images by their ids, doing the operations in order.
+// Every edited image is saved as a new image, or as a new version of the one it was edited from.
+func MakeEditImagesPipeline(service ImageService, ops []EditOperation, saveAs SaveAs) (*pipe.Pipeline, error) {
+
+	if len(ops) == 0 || len(ops) > MaxEditOperations {
+		return nil, fmt.Errorf("%w: there should be 1 to %d operations", ErrBadEdit, MaxEditOperations)
+	}
+	if saveAs != SaveAsImage && saveAs != SaveAsVersion {
+		return nil, fmt.Errorf("%w: save as should be %s or %s", ErrBadEdit, SaveAsImage, SaveAsVersion)
+	}
+
+	getWorker := GetWorker{service}
+	getFilter := pipe.NewBoundedParallelFilter(10, &getWorker)
+
+	loadExifWorker := LoadExifWorker{service}
+	loadExifFilter := pipe.NewBoundedParallelFilter(10, &loadExifWorker)
+
+	loadFullWorker := LoadFullWorker{service}
+	loadFullFilter := pipe.NewBoundedParallelFilter(10, &loadFullWorker)
+
+	filters := []pipe.Filter{getFilter, loadExifFilter, loadFullFilter}
+	for i, op := range ops {
+		worker, err := op.Worker()
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i+1, err)
+		}
+		filters = append(filters, pipe.NewBoundedParallelFilter(10, worker))
+	}
+
+	encodeEditWorker := EncodeEditWorker{}
+	encodeEditFilter := pipe.NewBoundedParallelFilter(10, &encodeEditWorker)
+
+	deduplicateWorker := DeduplicateWorker{service}
+	deduplicateFilter := pipe.NewBoundedParallelFilter(10, &deduplicateWorker)
+
+	perceptualHashWorker := PerceptualHashWorker{}
+	perceptualHashFilter := pipe.NewBoundedParallelFilter(10, &perceptualHashWorker)
+
+	paletteWorker := PaletteWorker{}
+	paletteFilter := pipe.NewBoundedParallelFilter(10, &paletteWorker)
+
+	placeholderWorker := PlaceholderWorker{}
+	placeholderFilter := pipe.NewBoundedParallelFilter(10, &placeholderWorker)
+
+	createThumbnailWorker := CreateThumbnailWorker{service}
+	createThumbnailFilter := pipe.NewBoundedParallelFilter(10, &createThumbnailWorker)
+
+	createRenditionsWorker := CreateRenditionsWorker{service}
+	createRenditionsFilter := pipe.NewBoundedParallelFilter(10, &createRenditionsWorker)
+
+	watermarkWorker := WatermarkWorker{WatermarkOnUpload}
+	watermarkFilter := pipe.NewBoundedParallelFilter(10, &watermarkWorker)
+
+	persistWorker := PersistWorker{service}
+	persistFilter := pipe.NewBoundedParallelFilter(10, &persistWorker)
+
+	saveMetadataWorker := SaveMetadataWorker{service}
+	saveMetadataFilter := pipe.NewBoundedParallelFilter(10, &saveMetadataWorker)
+
+	filters = append(filters, encodeEditFilter, deduplicateFilter, perceptualHashFilter, paletteFilter, placeholderFilter, createThumbnailFilter, createRenditionsFilter, watermarkFilter, persistFilter, saveMetadataFilter)
+	if saveAs == SaveAsVersion {
+		saveVersionWorker := SaveVersionWorker{service}
+		filters = append(filters, pipe.NewBoundedParallelFilter(10, &saveVersionWorker))
+	}
+
+	base64Encoder := Base64EncodeWorker{}
+	base64EncoderFilter := pipe.NewBoundedParallelFilter(10, &base64Encoder)
+	filters = append(filters, base64EncoderFilter)
+
+	return pipe.NewPipeline("EditImagesPipeline", filters...), nil
+}
+
 func MakeCreateImagesPipelineBoundedFilters(service ImageService) *pipe.Pipeline {
 
+	extractExifWorker := ExtractExifWorker{}
+	extractExifFilter := pipe.NewBoundedParallelFilter(30, &extractExifWorker)
+
 	transformFHWorker := TransformFileHeaderWorker{}
 	transformFHFilter := pipe.NewBoundedParallelFilter(30, &transformFHWorker)
 
+	deduplicateWorker := DeduplicateWorker{service}
+	deduplicateFilter := pipe.NewBoundedParallelFilter(10, &deduplicateWorker)
+
+	perceptualHashWorker := PerceptualHashWorker{}
+	perceptualHashFilter := pipe.NewBoundedParallelFilter(30, &perceptualHashWorker)
+
+	paletteWorker := PaletteWorker{}
+	paletteFilter := pipe.NewBoundedParallelFilter(30, &paletteWorker)
+
+	placeholderWorker := PlaceholderWorker{}
+	placeholderFilter := pipe.NewBoundedParallelFilter(30, &placeholderWorker)
+
 	createThumbnailWorker := CreateThumbnailWorker{service}
 	createThumbnailFilter := pipe.NewBoundedParallelFilter(35, &createThumbnailWorker)
 
+	createRenditionsWorker := CreateRenditionsWorker{service}
+	createRenditionsFilter := pipe.NewBoundedParallelFilter(35, &createRenditionsWorker)
+
+	watermarkWorker := WatermarkWorker{WatermarkOnUpload}
+	watermarkFilter := pipe.NewBoundedParallelFilter(35, &watermarkWorker)
+
 	persistWorker := PersistWorker{service}
 	persistFilter := pipe.NewBoundedParallelFilter(40, &persistWorker)
 
@@ -53,19 +214,40 @@ func MakeCreateImagesPipelineBoundedFilters(service ImageService) *pipe.Pipeline
 	base64Encoder := Base64EncodeWorker{}
 	base64EncoderFilter := pipe.NewBoundedParallelFilter(40, &base64Encoder)
 
-	pipeline := pipe.NewPipeline("CreateImagesPipelineBounded3035401040", transformFHFilter, createThumbnailFilter, persistFilter, saveMetadataFilter, base64EncoderFilter)
+	pipeline := pipe.NewPipeline("CreateImagesPipelineBounded3035401040", extractExifFilter, transformFHFilter, deduplicateFilter, perceptualHashFilter, paletteFilter, placeholderFilter, createThumbnailFilter, createRenditionsFilter, watermarkFilter, persistFilter, saveMetadataFilter, base64EncoderFilter)
 	//pipeline.StartExtracting(5 * time.Second)
 	return pipeline
 }
 
 func MakeCreateImagesPipeline1Transform1Filter(service ImageService) *pipe.Pipeline {
 
+	extractExifWorker := ExtractExifWorker{}
+	extractExifFilter := pipe.NewParallelFilter(&extractExifWorker)
+
 	transformFHWorker := TransformFileHeaderWorker{}
 	transformFHFilter := pipe.NewParallelFilter(&transformFHWorker)
 
+	deduplicateWorker := DeduplicateWorker{service}
+	deduplicateFilter := pipe.NewParallelFilter(&deduplicateWorker)
+
+	perceptualHashWorker := PerceptualHashWorker{}
+	perceptualHashFilter := pipe.NewParallelFilter(&perceptualHashWorker)
+
+	paletteWorker := PaletteWorker{}
+	paletteFilter := pipe.NewParallelFilter(&paletteWorker)
+
+	placeholderWorker := PlaceholderWorker{}
+	placeholderFilter := pipe.NewParallelFilter(&placeholderWorker)
+
 	createThumbnailWorker := CreateThumbnailWorker{service}
 	createThumbnailFilter := pipe.NewParallelFilter(&createThumbnailWorker)
 
+	createRenditionsWorker := CreateRenditionsWorker{service}
+	createRenditionsFilter := pipe.NewParallelFilter(&createRenditionsWorker)
+
+	watermarkWorker := WatermarkWorker{WatermarkOnUpload}
+	watermarkFilter := pipe.NewParallelFilter(&watermarkWorker)
+
 	persistWorker := PersistWorker{service}
 	persistFilter := pipe.NewParallelFilter(&persistWorker)
 
@@ -75,20 +257,27 @@ func MakeCreateImagesPipeline1Transform1Filter(service ImageService) *pipe.Pipel
 	base64Encoder := Base64EncodeWorker{}
 	base64EncoderFilter := pipe.NewParallelFilter(&base64Encoder)
 
-	pipeline := pipe.NewPipeline("CreateImagesPipeline1Transform1Filter", transformFHFilter, createThumbnailFilter, persistFilter, saveMetadataFilter, base64EncoderFilter)
+	pipeline := pipe.NewPipeline("CreateImagesPipeline1Transform1Filter", extractExifFilter, transformFHFilter, deduplicateFilter, perceptualHashFilter, paletteFilter, placeholderFilter, createThumbnailFilter, createRenditionsFilter, watermarkFilter, persistFilter, saveMetadataFilter, base64EncoderFilter)
 	pipeline.StartExtracting(5 * time.Second)
 	return pipeline
 }
 
 func MakeCreateImagesPipelineNTransform1Filter(service ImageService) *pipe.Pipeline {
 
+	extractExifWorker := ExtractExifWorker{}
 	transformFHWorker := TransformFileHeaderWorker{}
+	deduplicateWorker := DeduplicateWorker{service}
+	perceptualHashWorker := PerceptualHashWorker{}
+	paletteWorker := PaletteWorker{}
+	placeholderWorker := PlaceholderWorker{}
 	createThumbnailWorker := CreateThumbnailWorker{service}
+	createRenditionsWorker := CreateRenditionsWorker{service}
+	watermarkWorker := WatermarkWorker{WatermarkOnUpload}
 	persistWorker := PersistWorker{service}
 	saveMetadataWorker := SaveMetadataWorker{service}
 	base64Encoder := Base64EncodeWorker{}
 
-	filter := pipe.NewParallelFilter(&transformFHWorker, &createThumbnailWorker, &persistWorker, &saveMetadataWorker, &base64Encoder)
+	filter := pipe.NewParallelFilter(&extractExifWorker, &transformFHWorker, &deduplicateWorker, &perceptualHashWorker, &paletteWorker, &placeholderWorker, &createThumbnailWorker, &createRenditionsWorker, &watermarkWorker, &persistWorker, &saveMetadataWorker, &base64Encoder)
 
 	pipeline := pipe.NewPipeline("CreateImagesPipelineNTransform1Filter", filter)
 	pipeline.StartExtracting(5 * time.Second)
@@ -20,8 +20,9 @@ import (
 func TestGetImagePipeline(t *testing.T) {
 
 	testName := "testName"
-	testFullPath := TestImagePath
-	testThumbnailPath := TestImagePath
+	store := NewMemoryBlobStore()
+	testFullPath := StoreTestImage(t, store)
+	testThumbnailPath := testFullPath
 	imageId := int64(1)
 	testResolutionX, testResolutionY := 0, 0
 
@@ -33,11 +34,12 @@ func TestGetImagePipeline(t *testing.T) {
 		}
 		defer db.Close()
 
-		rows := sqlmock.NewRows([]string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y"}).
-			AddRow(imageId, testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY)
+		rows := NewImageRows().
+			AddRow(imageId, testName, testFullPath, testThumbnailPath, testResolutionX, testResolutionY, "", "", "", 0)
 		mock.ExpectQuery("SELECT").WillReturnRows(rows)
+		mock.ExpectQuery("SELECT (.+) FROM image_metadata").WillReturnRows(sqlmock.NewRows([]string{"orientation"}))
 
-		service := NewImageService(db)
+		service := NewImageService(db, store, DefaultRenditions)
 		pipeline := MakeGetImagePipeline(service)
 
 		inputChan := make(chan pipeline2.Item, 1)
@@ -67,12 +69,13 @@ func TestGetImagePipeline(t *testing.T) {
 }
 
 func TestGetAllImagesPipeline(t *testing.T) {
-	testFullPath := TestImagePath
-	testThumbnailPath := TestImagePath
+	store := NewMemoryBlobStore()
+	testFullPath := StoreTestImage(t, store)
+	testThumbnailPath := testFullPath
 
 	t.Run("default", func(t *testing.T) {
 
-		service := NewImageService(nil)
+		service := NewImageService(nil, store, DefaultRenditions)
 		pipeline := MakeGetAllImagesPipeline(service)
 
 		noItems := 5
@@ -119,17 +122,23 @@ func TestMakeCreateImagesPipeline(t *testing.T) {
 		}
 		defer db.Close()
 
-		service := NewImageService(db)
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
 		pipeline := MakeCreateImagesPipelineBoundedFilters(service)
 
 		noItems := 2
 		items := make(chan pipeline2.Item, noItems)
 		errors := make(chan error, noItems)
 		//Prepare
+		mock.MatchExpectationsInOrder(false)
 		fhs := prepareFileHeaders(noItems, t)
 		for i := 0; i < noItems; i++ {
+			mock.ExpectQuery("SELECT (.+) FROM image WHERE hash").WillReturnRows(NewImageRows())
 			mock.ExpectBegin()
 			mock.ExpectQuery("INSERT INTO image").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(i))
+			for range DefaultRenditions {
+				mock.ExpectExec("INSERT INTO image_renditions").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectExec("INSERT INTO image_colors").WillReturnResult(sqlmock.NewResult(0, PaletteSize))
 			mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, i).WillReturnResult(sqlmock.NewResult(int64(i), 1))
 			mock.ExpectCommit()
 		}
@@ -154,8 +163,57 @@ func TestMakeCreateImagesPipeline(t *testing.T) {
 			if img.Name != "test.jpg" {
 				t.Errorf("not good name")
 			}
+			if img.Hash == "" || img.Deduplicated {
+				t.Errorf("not good hash")
+			}
+		}
+		close(errors)
+	})
+
+	t.Run("deduplicated", func(t *testing.T) {
+
+		ctx := context.WithValue(context.Background(), "userId", userId)
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		store := NewMemoryBlobStore()
+		service := NewImageService(db, store, DefaultRenditions)
+		pipeline := MakeCreateImagesPipelineBoundedFilters(service)
+
+		existingId := 7
+		mock.ExpectQuery("SELECT (.+) FROM image WHERE hash").WillReturnRows(
+			NewImageRows().
+				AddRow(existingId, "test.jpg", "full/existing.jpg", "thumbnail/existing.jpg", 0, 0, "hash", "jpeg", "image/jpeg", 100))
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO user_images").WithArgs(userId, existingId).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		items := make(chan pipeline2.Item, 1)
+		errors := make(chan error, 1)
+		items <- prepareFileHeaders(1, t)[0]
+		close(items)
+		go func() {
+			for err := range errors {
+				t.Errorf("%s", err)
+			}
+		}()
+		for item := range pipeline.Filter(ctx, items, errors) {
+			img := item.(*ImageBase64)
+			if !img.Deduplicated || img.Id != existingId || img.FullPath != "full/existing.jpg" {
+				t.Errorf("image wasn't deduplicated: %+v", img)
+			}
 		}
 		close(errors)
+		if keys := store.Keys(""); len(keys) != 0 {
+			t.Errorf("deduplicated image shouldn't be persisted, got: %v", keys)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
 	})
 }
 
@@ -241,3 +299,59 @@ func ImagesEqual(img1, img2 image.Image) (bool, error) {
 	}
 	return false, nil
 }
+
+func TestDeleteImagesPipeline(t *testing.T) {
+
+	userId := 1
+	ctx := context.WithValue(context.Background(), "userId", userId)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	store := NewMemoryBlobStore()
+	noItems := 3
+	for i := 0; i < noItems; i++ {
+		fullKey, thumbnailKey := StoreTestImage(t, store), StoreTestImage(t, store)
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT fullpath, thumbnailpath FROM image (.+) FOR UPDATE").WithArgs(i).
+			WillReturnRows(sqlmock.NewRows([]string{"fullpath", "thumbnailpath"}).AddRow(fullKey, thumbnailKey))
+		mock.ExpectExec("DELETE FROM user_images").WithArgs(userId, i).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("DELETE FROM album_images").WithArgs(i, userId).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT COUNT").WithArgs(i).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectQuery("SELECT path FROM image_renditions").WithArgs(i).WillReturnRows(sqlmock.NewRows([]string{"path"}))
+		mock.ExpectExec("DELETE FROM image WHERE").WithArgs(i).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	service := NewImageService(db, store, DefaultRenditions)
+	pipeline := MakeDeleteImagesPipeline(service)
+
+	items := make(chan pipeline2.Item, noItems)
+	errors := make(chan error, noItems)
+	for i := 0; i < noItems; i++ {
+		items <- i
+	}
+	close(items)
+
+	counter := 0
+	for item := range pipeline.Filter(ctx, items, errors) {
+		if deleted, ok := item.(*DeletedImage); !ok || !deleted.Purged {
+			t.Errorf("image not purged: %+v", item)
+		}
+		counter++
+	}
+	close(errors)
+	for err := range errors {
+		t.Errorf("%s", err)
+	}
+	if counter != noItems {
+		t.Errorf("got %d deleted images, want %d", counter, noItems)
+	}
+	if keys := store.Keys(""); len(keys) != 0 {
+		t.Errorf("blobs weren't deleted: %v", keys)
+	}
+}
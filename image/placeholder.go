@@ -0,0 +1,142 @@
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"strings"
+)
+
+// BlurHashComponentsX and BlurHashComponentsY are how many horizontal and vertical cosine components the BlurHash has
+const (
+	BlurHashComponentsX = 4
+	BlurHashComponentsY = 3
+)
+
+// LQIPWidth is the width of the low quality placeholder, its height keeps the aspect ratio
+const LQIPWidth = 16
+
+// lqipQuality is the JPEG quality of the low quality placeholder, it's blurred when scaled up anyway
+const lqipQuality = 60
+
+// blurHashSample is the width the image is shrunk to before its BlurHash is computed
+const blurHashSample = 64
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[\\]^_{|}~"
+
+// BlurHash encodes the image as a BlurHash (https://blurha.sh), a short string the UI decodes into a blurred placeholder.
+// x and y are the numbers of components, from 1 to 9.
+func BlurHash(img image.Image, x, y int) string {
+
+	small := resize.Resize(blurHashSample, 0, img, resize.Bilinear)
+	b := small.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+	pixels := make([][3]float64, 0, w*h)
+	for py := b.Min.Y; py < b.Max.Y; py++ {
+		for px := b.Min.X; px < b.Max.X; px++ {
+			c := color.NRGBAModel.Convert(small.At(px, py)).(color.NRGBA)
+			pixels = append(pixels, [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)})
+		}
+	}
+
+	factors := make([][3]float64, 0, x*y)
+	for j := 0; j < y; j++ {
+		for i := 0; i < x; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for py := 0; py < h; py++ {
+				for px := 0; px < w; px++ {
+					basis := math.Cos(math.Pi*float64(i*px)/float64(w)) * math.Cos(math.Pi*float64(j*py)/float64(h))
+					p := pixels[py*w+px]
+					for c := range f {
+						f[c] += basis * p[c]
+					}
+				}
+			}
+			for c := range f {
+				f[c] *= normalisation / float64(w*h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((x-1)+(y-1)*9, 1))
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encode83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encode83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+	for _, f := range factors[1:] {
+		var q [3]int
+		for c, v := range f {
+			q[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encode83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+	return hash.String()
+}
+
+// LQIP makes a tiny JPEG of the image as a data URI, to be inlined and scaled up while the thumbnail loads
+func LQIP(img image.Image) (string, error) {
+
+	small := resize.Resize(LQIPWidth, 0, img, resize.Bilinear)
+	buff := new(bytes.Buffer)
+	if err := jpeg.Encode(buff, small, &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return "", err
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buff.Bytes()), nil
+}
+
+func encode83(value, length int) string {
+
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83[value%83]
+		value /= 83
+	}
+	return string(b)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
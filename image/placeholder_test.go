@@ -0,0 +1,81 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+func TestBlurHash(t *testing.T) {
+
+	t.Run("uniform", func(t *testing.T) {
+		img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+		draw.Draw(img, img.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		// No AC components, so they're all encoded as zero
+		if hash := BlurHash(img, 4, 3); hash != "L00000"+strings.Repeat("fQ", 11) {
+			t.Errorf("incorrect blurhash: %s", hash)
+		}
+	})
+
+	t.Run("length", func(t *testing.T) {
+		img := OpenTestImage(t)
+		for _, size := range [][2]int{{1, 1}, {4, 3}, {9, 9}} {
+			if hash := BlurHash(img.Full, size[0], size[1]); len(hash) != 4+2*size[0]*size[1] {
+				t.Errorf("incorrect length of blurhash %s for %dx%d", hash, size[0], size[1])
+			}
+		}
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		img := OpenTestImage(t)
+		if BlurHash(img.Full, 4, 3) != BlurHash(img.Full, 4, 3) {
+			t.Errorf("the same image should get the same blurhash")
+		}
+	})
+}
+
+func TestLQIP(t *testing.T) {
+
+	lqip, err := LQIP(OpenTestImage(t).Full)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(lqip, "data:image/jpeg;base64,") {
+		t.Fatalf("not a data uri: %s", lqip)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(lqip, "data:image/jpeg;base64,"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// The test image is 320x240
+	if img.Bounds().Dx() != LQIPWidth || img.Bounds().Dy() != 12 {
+		t.Errorf("incorrect size of the placeholder: %v", img.Bounds())
+	}
+}
+
+func TestPlaceholderWorker(t *testing.T) {
+
+	out, err := (&PlaceholderWorker{}).Work(context.Background(), OpenTestImage(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if img := out.(*Image); img.BlurHash == "" || img.LQIP == "" {
+		t.Errorf("placeholders not made: %q %q", img.BlurHash, img.LQIP)
+	}
+
+	deduplicated := OpenTestImage(t)
+	deduplicated.Deduplicated = true
+	if out, _ := (&PlaceholderWorker{}).Work(context.Background(), deduplicated); out.(*Image).BlurHash != "" {
+		t.Errorf("deduplicated images already have placeholders")
+	}
+}
@@ -0,0 +1,161 @@
+package image
+
+import (
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+)
+
+// FitMode says how an image is resized into a target box
+type FitMode string
+
+const (
+	FitModeFit  FitMode = "fit"  // Scale down to fit inside the box, keeping the aspect ratio
+	FitModeFill FitMode = "fill" // Scale to cover the whole box, keeping the aspect ratio. One side may overflow.
+	FitModeCrop FitMode = "crop" // Scale to cover the whole box and cut the overflow, centered
+	FitModePad  FitMode = "pad"  // Scale down to fit inside the box and pad the rest with white, centered
+)
+
+// Rendition is a named, derived version of an image, e.g. a thumbnail
+type Rendition struct {
+	Name    string  `json:"name"`
+	Width   uint    `json:"width"`
+	Height  uint    `json:"height"`
+	Fit     FitMode `json:"fit"`
+	Format  string  `json:"format"`  // One of EncodeFormats
+	Quality int     `json:"quality"` // 1-100, used by lossy formats
+}
+
+// DefaultRenditions are generated for every upload unless configured otherwise
+var DefaultRenditions = []Rendition{
+	{Name: "thumb", Width: 200, Height: 200, Fit: FitModeCrop, Format: "jpeg", Quality: 80},
+	{Name: "medium", Width: 800, Height: 800, Fit: FitModeFit, Format: "jpeg", Quality: 85},
+	{Name: "large", Width: 1600, Height: 1600, Fit: FitModeFit, Format: "jpeg", Quality: 90},
+}
+
+// EncodeFormats are the formats renditions can be encoded in
+var EncodeFormats = []string{"jpeg", "png", "gif"}
+
+// ImageRendition is a rendition generated for a specific image
+type ImageRendition struct {
+	Name     string `json:"name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	Path     string `json:"path"`
+	Data     []byte `json:"-"`
+}
+
+// ValidateRenditions checks the configured renditions before they're used
+func ValidateRenditions(renditions []Rendition) error {
+
+	names := make(map[string]bool)
+	for _, r := range renditions {
+		if r.Name == "" {
+			return fmt.Errorf("rendition without a name")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rendition %s: defined more than once", r.Name)
+		}
+		names[r.Name] = true
+		if r.Width == 0 || r.Height == 0 {
+			return fmt.Errorf("rendition %s: width and height must be positive", r.Name)
+		}
+		switch r.Fit {
+		case FitModeFit, FitModeFill, FitModeCrop, FitModePad:
+		default:
+			return fmt.Errorf("rendition %s: unknown fit mode %q", r.Name, r.Fit)
+		}
+		if !contains(EncodeFormats, r.Format) {
+			return fmt.Errorf("rendition %s: can't encode to %q", r.Name, r.Format)
+		}
+		if r.Quality < 1 || r.Quality > 100 {
+			return fmt.Errorf("rendition %s: quality must be between 1 and 100", r.Name)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ResizeTo resizes the image into the width x height box, keeping the aspect ratio as the fit mode says
+func ResizeTo(img image.Image, width, height uint, fit FitMode) image.Image {
+
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	scaleW, scaleH := float64(width)/w, float64(height)/h
+
+	switch fit {
+	case FitModeFill, FitModeCrop:
+		scale := math.Max(scaleW, scaleH)
+		resized := resize.Resize(scaled(w, scale), scaled(h, scale), img, resize.Lanczos3)
+		if fit == FitModeFill {
+			return resized
+		}
+		return cropCenter(resized, int(width), int(height))
+	default:
+		scale := math.Min(scaleW, scaleH)
+		resized := img
+		if scale < 1 {
+			resized = resize.Resize(scaled(w, scale), scaled(h, scale), img, resize.Lanczos3)
+		}
+		if fit == FitModePad {
+			return padCenter(resized, int(width), int(height))
+		}
+		return resized
+	}
+}
+
+func scaled(side, scale float64) uint {
+	return uint(math.Max(1, math.Round(side*scale)))
+}
+
+func cropCenter(img image.Image, width, height int) image.Image {
+
+	b := img.Bounds()
+	x := b.Min.X + (b.Dx()-width)/2
+	y := b.Min.Y + (b.Dy()-height)/2
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), img, image.Point{X: x, Y: y}, draw.Src)
+	return dst
+}
+
+func padCenter(img image.Image, width, height int) image.Image {
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	offset := image.Point{X: (width - b.Dx()) / 2, Y: (height - b.Dy()) / 2}
+	draw.Draw(dst, b.Sub(b.Min).Add(offset), img, b.Min, draw.Over)
+	return dst
+}
+
+// Encode writes the image in the given format, one of EncodeFormats
+func Encode(w io.Writer, img image.Image, format string, quality int) error {
+
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("can't encode to %q", format)
+	}
+}
@@ -0,0 +1,136 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"image"
+	"testing"
+)
+
+func TestResizeTo(t *testing.T) {
+
+	wide := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	small := image.NewRGBA(image.Rect(0, 0, 40, 20))
+
+	tests := []struct {
+		name  string
+		src   image.Image
+		fit   FitMode
+		wantW int
+		wantH int
+	}{
+		{"fit keeps the aspect ratio", wide, FitModeFit, 100, 50},
+		{"fit doesn't upscale", small, FitModeFit, 40, 20},
+		{"fill covers the box", wide, FitModeFill, 200, 100},
+		{"crop cuts to the box", wide, FitModeCrop, 100, 100},
+		{"crop upscales small images", small, FitModeCrop, 100, 100},
+		{"pad fills the box", wide, FitModePad, 100, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ResizeTo(tt.src, 100, 100, tt.fit).Bounds()
+			if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+				t.Errorf("got %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestValidateRenditions(t *testing.T) {
+
+	if err := ValidateRenditions(DefaultRenditions); err != nil {
+		t.Errorf("default renditions should be valid: %s", err)
+	}
+
+	invalid := map[string][]Rendition{
+		"no name":        {{Width: 1, Height: 1, Fit: FitModeFit, Format: "jpeg", Quality: 80}},
+		"duplicate name": {DefaultRenditions[0], DefaultRenditions[0]},
+		"zero width":     {{Name: "a", Height: 1, Fit: FitModeFit, Format: "jpeg", Quality: 80}},
+		"bad fit":        {{Name: "a", Width: 1, Height: 1, Fit: "stretch", Format: "jpeg", Quality: 80}},
+		"bad format":     {{Name: "a", Width: 1, Height: 1, Fit: FitModeFit, Format: "heic", Quality: 80}},
+		"bad quality":    {{Name: "a", Width: 1, Height: 1, Fit: FitModeFit, Format: "jpeg", Quality: 101}},
+	}
+	for name, renditions := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if err := ValidateRenditions(renditions); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestImageService_CreateRenditions(t *testing.T) {
+
+	testImage := OpenTestImage(t)
+	renditions := []Rendition{
+		{Name: "small", Width: 64, Height: 64, Fit: FitModeFit, Format: "png", Quality: 80},
+		{Name: "square", Width: 50, Height: 50, Fit: FitModeCrop, Format: "jpeg", Quality: 80},
+	}
+
+	service := NewImageService(nil, NewMemoryBlobStore(), renditions)
+	if err := service.CreateRenditions(context.Background(), testImage); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(testImage.Renditions) != len(renditions) {
+		t.Fatalf("got %d renditions, want %d", len(testImage.Renditions), len(renditions))
+	}
+
+	small := testImage.Renditions[0]
+	if small.MimeType != "image/png" || small.Width != 64 || small.Height != 48 {
+		t.Errorf("small rendition not created well: %+v", small)
+	}
+	decoded, format, err := image.Decode(bytes.NewReader(small.Data))
+	if err != nil || format != "png" || decoded.Bounds().Dx() != 64 {
+		t.Errorf("small rendition not encoded well: %s", err)
+	}
+	if square := testImage.Renditions[1]; square.Width != 50 || square.Height != 50 {
+		t.Errorf("square rendition not created well: %+v", square)
+	}
+}
+
+func TestImageService_LoadRendition(t *testing.T) {
+
+	t.Run("found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		store := NewMemoryBlobStore()
+		key := StoreTestImage(t, store)
+		mock.ExpectQuery("SELECT (.+) FROM image_renditions").WithArgs(1, "medium").
+			WillReturnRows(sqlmock.NewRows([]string{"path", "width", "height", "mime_type", "size"}).AddRow(key, 320, 240, "image/jpeg", 100))
+
+		service := NewImageService(db, store, DefaultRenditions)
+		img := &Image{Id: 1}
+		if err := service.LoadRendition(context.Background(), img, "medium"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(img.Renditions) != 1 || img.Renditions[0].Data == nil {
+			t.Errorf("rendition not loaded")
+		}
+		if NewImageBase64(img).Renditions["medium"] == "" {
+			t.Errorf("rendition not encoded")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) FROM image_renditions").
+			WillReturnRows(sqlmock.NewRows([]string{"path", "width", "height", "mime_type", "size"}))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if err := service.LoadRendition(context.Background(), &Image{Id: 1}, "huge"); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrResizeNotAllowed = fmt.Errorf("resize not allowed")
+
+// ResizeConfig limits what images can be resized to, so that clients can't make the server render and cache any size
+type ResizeConfig struct {
+	Sizes     []uint   `json:"sizes"`     // Allowed widths and heights
+	Formats   []string `json:"formats"`   // Some of EncodeFormats
+	Qualities []int    `json:"qualities"` // Allowed qualities, besides the default one
+}
+
+// DefaultResizeConfig covers the common breakpoints of responsive layouts
+var DefaultResizeConfig = ResizeConfig{
+	Sizes:     []uint{64, 128, 200, 256, 320, 400, 480, 640, 800, 1024, 1280, 1600, 1920, 2560},
+	Formats:   append([]string(nil), EncodeFormats...),
+	Qualities: []int{50, 60, 70, 75, 80, 85, 90, 95},
+}
+
+// Copy returns the config with slices of its own, so decoding into the copy leaves the original as it is
+func (c ResizeConfig) Copy() ResizeConfig {
+	return ResizeConfig{
+		Sizes:     append([]uint(nil), c.Sizes...),
+		Formats:   append([]string(nil), c.Formats...),
+		Qualities: append([]int(nil), c.Qualities...),
+	}
+}
+
+const DefaultResizeQuality = 80
+
+// ResizeRenderTimeout is how long a variant can take to render
+var ResizeRenderTimeout = time.Minute
+
+// ResizeParams is a variant of an image rendered on the fly
+type ResizeParams struct {
+	Width   uint // 0 keeps the aspect ratio, only with FitModeFit
+	Height  uint // 0 keeps the aspect ratio, only with FitModeFit
+	Fit     FitMode
+	Format  string
+	Quality int
+
+	Watermark *Watermark // The user's watermark, if the variant should have one
+}
+
+// ParseResizeParams reads the variant from ?w=800&h=600&fit=crop&format=png&q=90 and checks it against the config.
+// fit defaults to fit, format to jpeg and q to DefaultResizeQuality.
+func ParseResizeParams(query url.Values, config ResizeConfig) (ResizeParams, error) {
+
+	params := ResizeParams{Fit: FitModeFit, Format: "jpeg", Quality: DefaultResizeQuality}
+	for param, dest := range map[string]*uint{"w": &params.Width, "h": &params.Height} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		size, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || !containsUint(config.Sizes, uint(size)) {
+			return params, fmt.Errorf("%w: %s should be one of %v", ErrResizeNotAllowed, param, config.Sizes)
+		}
+		*dest = uint(size)
+	}
+	if params.Width == 0 && params.Height == 0 {
+		return params, fmt.Errorf("%w: w or h is needed", ErrResizeNotAllowed)
+	}
+	if fit := query.Get("fit"); fit != "" {
+		params.Fit = FitMode(fit)
+		switch params.Fit {
+		case FitModeFit:
+		case FitModeFill, FitModeCrop, FitModePad:
+			if params.Width == 0 || params.Height == 0 {
+				return params, fmt.Errorf("%w: fit %s needs both w and h", ErrResizeNotAllowed, fit)
+			}
+		default:
+			return params, fmt.Errorf("%w: unknown fit %s", ErrResizeNotAllowed, fit)
+		}
+	}
+	if format := query.Get("format"); format != "" {
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if !contains(config.Formats, format) || !contains(EncodeFormats, format) {
+			return params, fmt.Errorf("%w: format should be one of %v", ErrResizeNotAllowed, config.Formats)
+		}
+		params.Format = format
+	}
+	if q := query.Get("q"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil || (quality != DefaultResizeQuality && !containsInt(config.Qualities, quality)) {
+			return params, fmt.Errorf("%w: q should be one of %v", ErrResizeNotAllowed, config.Qualities)
+		}
+		params.Quality = quality
+	}
+	return params, nil
+}
+
+func containsUint(values []uint, value uint) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Resizer renders variants of the user's images on the fly and caches them.
+// Concurrent requests for the same variant wait for a single render.
+type Resizer struct {
+	db    *sql.DB
+	store BlobStore
+	cache *DiskCache
+
+	mu      sync.Mutex
+	renders map[string]*render
+}
+
+// render is a variant being rendered, the requests for it wait on done
+type render struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+func NewResizer(db *sql.DB, store BlobStore, cache *DiskCache) *Resizer {
+	return &Resizer{
+		db:      db,
+		store:   store,
+		cache:   cache,
+		renders: make(map[string]*render),
+	}
+}
+
+// Resize returns the variant of the user's image, rendered with ResizeTo like the thumbnails and renditions
+func (r *Resizer) Resize(ctx context.Context, imageId int, params ResizeParams) (*Content, error) {
+
+	var fullPath, hash string
+	var orientation int
+	var modTime time.Time
+	err := r.db.QueryRowContext(ctx, "SELECT fullpath, COALESCE(hash, ''), COALESCE((SELECT orientation FROM image_metadata WHERE image_metadata.image_id = id), 0), user_images.created_at FROM image JOIN user_images ON image_id = id WHERE id = $1 AND user_id = $2",
+		imageId, ctx.Value("userId")).Scan(&fullPath, &hash, &orientation, &modTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Variants of the same content are shared between images and users
+	source := hash
+	if source == "" {
+		source = fullPath
+	}
+	variant := fmt.Sprintf("%s|%d|%d|%s|%s|%d", source, params.Width, params.Height, params.Fit, params.Format, params.Quality)
+	if params.Watermark != nil {
+		variant += "|" + params.Watermark.Version
+	}
+	key := HashContent([]byte(variant)) + formatExtension(params.Format)
+	content := &Content{
+		MimeType: "image/" + params.Format,
+		ETag:     fmt.Sprintf("%q", key),
+		ModTime:  modTime,
+	}
+
+	if f, ok := r.cache.Open(key); ok {
+		content.ReadSeeker, content.closer = f, f
+		return content, nil
+	}
+	b, err := r.renderOnce(key, func() ([]byte, error) {
+		// The render is shared by the requests for the variant, the one that started it going away doesn't cancel it
+		ctx, cancel := context.WithTimeout(context.Background(), ResizeRenderTimeout)
+		defer cancel()
+		return r.render(ctx, fullPath, orientation, params)
+	})
+	if err != nil {
+		return nil, err
+	}
+	content.ReadSeeker, content.closer = bytes.NewReader(b), ioutil.NopCloser(nil)
+	content.Size = int64(len(b))
+	return content, nil
+}
+
+// renderOnce renders the variant and caches it, unless it's already being rendered. Then it waits for that render.
+func (r *Resizer) renderOnce(key string, fn func() ([]byte, error)) ([]byte, error) {
+
+	r.mu.Lock()
+	if current, ok := r.renders[key]; ok {
+		r.mu.Unlock()
+		<-current.done
+		return current.b, current.err
+	}
+	current := &render{done: make(chan struct{})}
+	r.renders[key] = current
+	r.mu.Unlock()
+
+	current.b, current.err = fn()
+	if current.err == nil {
+		if err := r.cache.Put(key, current.b); err != nil {
+			log.Warnf("couldn't cache resized image %s: %s", key, err)
+		}
+	}
+	close(current.done)
+
+	r.mu.Lock()
+	delete(r.renders, key)
+	r.mu.Unlock()
+	return current.b, current.err
+}
+
+func (r *Resizer) render(ctx context.Context, fullPath string, orientation int, params ResizeParams) ([]byte, error) {
+
+	f, err := r.store.Get(ctx, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	if orientation > OrientationNormal {
+		img = Orient(img, orientation)
+	}
+
+	// A missing side doesn't limit the fit, the other side does
+	width, height := params.Width, params.Height
+	if width == 0 {
+		width = math.MaxInt32
+	}
+	if height == 0 {
+		height = math.MaxInt32
+	}
+	resized := ResizeTo(img, width, height, params.Fit)
+	if params.Watermark != nil {
+		if resized, err = params.Watermark.Apply(resized); err != nil {
+			return nil, err
+		}
+	}
+	buff := new(bytes.Buffer)
+	if err := Encode(buff, resized, params.Format, params.Quality); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
@@ -0,0 +1,191 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseResizeParams(t *testing.T) {
+
+	tests := []struct {
+		query string
+		want  ResizeParams
+		err   bool
+	}{
+		{"w=800", ResizeParams{Width: 800, Fit: FitModeFit, Format: "jpeg", Quality: DefaultResizeQuality}, false},
+		{"w=800&h=640&fit=crop&format=png&q=90", ResizeParams{Width: 800, Height: 640, Fit: FitModeCrop, Format: "png", Quality: 90}, false},
+		{"h=400&format=jpg", ResizeParams{Height: 400, Fit: FitModeFit, Format: "jpeg", Quality: DefaultResizeQuality}, false},
+		{"", ResizeParams{}, true},
+		{"w=801", ResizeParams{}, true},
+		{"w=-1", ResizeParams{}, true},
+		{"w=800&fit=crop", ResizeParams{}, true},
+		{"w=800&fit=stretch", ResizeParams{}, true},
+		{"w=800&format=bmp", ResizeParams{}, true},
+		{"w=800&q=42", ResizeParams{}, true},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := ParseResizeParams(query, DefaultResizeConfig)
+		if tt.err {
+			if !errors.Is(err, ErrResizeNotAllowed) {
+				t.Errorf("%q: expected ErrResizeNotAllowed, got: %v", tt.query, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestResizeConfig_Copy(t *testing.T) {
+
+	config := DefaultResizeConfig.Copy()
+	if err := json.Unmarshal([]byte(`{"formats":["png"],"qualities":[1,2,3,4,5,6,7,8,9]}`), &config); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(config.Formats) != 1 || len(config.Sizes) != len(DefaultResizeConfig.Sizes) {
+		t.Errorf("incorrect config: %+v", config)
+	}
+	if DefaultResizeConfig.Formats[0] != "jpeg" || DefaultResizeConfig.Qualities[0] != 50 {
+		t.Errorf("the defaults should be left as they are: %+v", DefaultResizeConfig)
+	}
+	if EncodeFormats[0] != "jpeg" {
+		t.Errorf("the encode formats should be left as they are: %v", EncodeFormats)
+	}
+}
+
+func TestResizer_Resize(t *testing.T) {
+
+	userId := 1
+	imageId := 10
+	ctx := context.WithValue(context.Background(), "userId", userId)
+	uploaded := time.Date(2021, 7, 14, 18, 30, 5, 0, time.UTC)
+	columns := []string{"fullpath", "hash", "orientation", "created_at"}
+	params := ResizeParams{Width: 64, Fit: FitModeFit, Format: "png", Quality: DefaultResizeQuality}
+
+	dir, err := ioutil.TempDir("", "resized")
+	if err != nil {
+		t.Fatalf("couldn't make a temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Run("rendered and cached", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		store := NewMemoryBlobStore()
+		key := StoreTestImage(t, store)
+		for i := 0; i < 2; i++ {
+			mock.ExpectQuery("SELECT fullpath, (.+) FROM image JOIN user_images").WithArgs(imageId, userId).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(key, "abc", 0, uploaded))
+		}
+
+		resizer := NewResizer(db, store, cache)
+		content, err := resizer.Resize(ctx, imageId, params)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		b, _ := ioutil.ReadAll(content)
+		content.Close()
+		img, format, err := Decode(b)
+		if err != nil || format != "png" || img.Bounds().Dx() != 64 {
+			t.Errorf("not resized well: %v, %s, %v", img.Bounds(), format, err)
+		}
+		if content.MimeType != "image/png" || !content.ModTime.Equal(uploaded) {
+			t.Errorf("content not made well: %+v", content)
+		}
+		if cache.Size() != int64(len(b)) {
+			t.Errorf("resized image not cached")
+		}
+
+		// Served from the cache, the blob isn't needed anymore
+		store.Delete(context.Background(), key)
+		cached, err := resizer.Resize(ctx, imageId, params)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer cached.Close()
+		if cached.ETag != content.ETag {
+			t.Errorf("got ETag %s, want %s", cached.ETag, content.ETag)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("someone else's image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT fullpath, (.+) FROM image JOIN user_images").WithArgs(imageId, userId).
+			WillReturnRows(sqlmock.NewRows(columns))
+
+		resizer := NewResizer(db, NewMemoryBlobStore(), cache)
+		if _, err := resizer.Resize(ctx, imageId, params); err != ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+	})
+}
+
+func TestResizer_renderOnce(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "resized")
+	if err != nil {
+		t.Fatalf("couldn't make a temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resizer := NewResizer(nil, NewMemoryBlobStore(), cache)
+
+	var renders int32
+	release := make(chan struct{})
+	render := func() ([]byte, error) {
+		atomic.AddInt32(&renders, 1)
+		<-release
+		return []byte("resized"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b, err := resizer.renderOnce("key", render); err != nil || string(b) != "resized" {
+				t.Errorf("got %q, %v", b, err)
+			}
+		}()
+	}
+	// Let the requests pile up behind the first render
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if renders != 1 {
+		t.Errorf("rendered %d times, want once", renders)
+	}
+}
@@ -0,0 +1,371 @@
+package image
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUploadNotFound = fmt.Errorf("upload not found")
+	ErrUploadOffset   = fmt.Errorf("upload offset doesn't match")
+	ErrUploadTooLarge = fmt.Errorf("upload too large")
+	ErrUploadComplete = fmt.Errorf("upload already complete")
+	ErrUploadCreating = fmt.Errorf("upload's image is being created")
+	ErrUploadLocked   = fmt.Errorf("upload's chunk is being written")
+)
+
+// ResumableUpload is a file uploaded in chunks, e.g. with the tus protocol, which can go on after an interruption
+type ResumableUpload struct {
+	Id       string            `json:"id"`
+	UserId   int               `json:"userId"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"` // How much of it is uploaded
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Expires  time.Time         `json:"expires"` // Incomplete uploads are removed after it
+	Result   *UploadResult     `json:"result,omitempty"`
+}
+
+// Complete is true once all of the file is uploaded
+func (u *ResumableUpload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// Name is the name of the uploaded file as the client gave it, or the id
+func (u *ResumableUpload) Name() string {
+	if name := u.Metadata["filename"]; name != "" {
+		return name
+	}
+	return u.Id
+}
+
+// ResumableUploads keeps the uploads in a directory, the data of an upload in a file named by its id and the rest
+// in a .json file next to it, so they can be resumed after a restart too.
+type ResumableUploads struct {
+	dir     string
+	maxSize int64
+	expiry  time.Duration  // Since the last chunk
+	locks   [64]sync.Mutex // Guard the info of the uploads, which are spread over the locks by their id
+
+	mu        sync.Mutex
+	appending map[string]bool // The uploads whose chunks are being written, one at a time
+	creating  map[string]bool // The complete uploads whose images are being created, see Claim
+}
+
+func NewResumableUploads(dir string, maxSize int64, expiry time.Duration) (*ResumableUploads, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating upload directory: %s", err)
+	}
+	return &ResumableUploads{dir: dir, maxSize: maxSize, expiry: expiry, appending: make(map[string]bool), creating: make(map[string]bool)}, nil
+}
+
+// lock locks the upload and returns the unlock
+func (s *ResumableUploads) lock(id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	l := &s.locks[h.Sum32()%uint32(len(s.locks))]
+	l.Lock()
+	return l.Unlock
+}
+
+// MaxSize is the largest file that can be uploaded
+func (s *ResumableUploads) MaxSize() int64 {
+	return s.maxSize
+}
+
+// Create starts the user's upload of a file of the given length
+func (s *ResumableUploads) Create(ctx context.Context, length int64, metadata map[string]string) (*ResumableUpload, error) {
+
+	if length > s.maxSize {
+		return nil, fmt.Errorf("%w: %d B, at most %d B", ErrUploadTooLarge, length, s.maxSize)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	upload := &ResumableUpload{
+		Id:       hex.EncodeToString(b),
+		UserId:   ctx.Value("userId").(int),
+		Length:   length,
+		Metadata: metadata,
+		Expires:  time.Now().Add(s.expiry),
+	}
+	if err := ioutil.WriteFile(s.dataPath(upload.Id), nil, 0644); err != nil {
+		return nil, err
+	}
+	if err := s.save(upload); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// Get returns the user's upload
+func (s *ResumableUploads) Get(ctx context.Context, id string) (*ResumableUpload, error) {
+
+	defer s.lock(id)()
+	return s.get(ctx, id)
+}
+
+// Append writes the chunk at the offset, which has to be where the upload is. When the chunk breaks off,
+// the bytes received are kept and the upload is resumed from there. It fails with ErrUploadLocked while
+// another chunk of the upload is being written.
+func (s *ResumableUploads) Append(ctx context.Context, id string, offset int64, chunk io.Reader) (*ResumableUpload, error) {
+
+	upload, err := s.startAppend(ctx, id, offset)
+	if err != nil {
+		return upload, err
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.appending, id)
+		s.mu.Unlock()
+	}()
+
+	// The chunk is written without the lock, the others wait only for the info of the upload
+	n, copyErr := s.write(upload, chunk)
+	if n < 0 {
+		return nil, copyErr
+	}
+
+	defer s.lock(id)()
+	saved, err := s.load(id)
+	if os.IsNotExist(err) {
+		// Deleted while the chunk was being written
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved.Offset = upload.Offset + n
+	saved.Expires = time.Now().Add(s.expiry)
+	if err := s.save(saved); err != nil {
+		return nil, err
+	}
+	return saved, copyErr
+}
+
+// startAppend marks the upload as being appended to, once the chunk is at its offset
+func (s *ResumableUploads) startAppend(ctx context.Context, id string, offset int64) (*ResumableUpload, error) {
+
+	defer s.lock(id)()
+	upload, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Complete() {
+		return upload, ErrUploadComplete
+	}
+	if offset != upload.Offset {
+		return upload, fmt.Errorf("%w: the upload is at %d", ErrUploadOffset, upload.Offset)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.appending[id] {
+		return nil, ErrUploadLocked
+	}
+	s.appending[id] = true
+	return upload, nil
+}
+
+// write writes the chunk into the data of the upload at its offset and returns how much of it was written,
+// or -1 when nothing could be
+func (s *ResumableUploads) write(upload *ResumableUpload, chunk io.Reader) (int64, error) {
+
+	f, err := os.OpenFile(s.dataPath(upload.Id), os.O_WRONLY, 0644)
+	if err != nil {
+		return -1, err
+	}
+	// The saved offset decides where the chunk goes, the bytes written past it before e.g. a crash are dropped
+	if err := f.Truncate(upload.Offset); err != nil {
+		f.Close()
+		return -1, err
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return -1, err
+	}
+	// Anything past the length is left out
+	n, err := io.Copy(f, io.LimitReader(chunk, upload.Length-upload.Offset))
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// Data reads the uploaded file
+func (s *ResumableUploads) Data(upload *ResumableUpload) ([]byte, error) {
+	return ioutil.ReadFile(s.dataPath(upload.Id))
+}
+
+// Claim lets the caller create the image of the complete upload, until it calls Release. It fails with
+// ErrUploadCreating while another request is creating it, and with ErrUploadComplete once it's created.
+func (s *ResumableUploads) Claim(ctx context.Context, id string) (*ResumableUpload, error) {
+
+	defer s.lock(id)()
+	upload, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Result != nil {
+		return upload, ErrUploadComplete
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.creating[id] {
+		return upload, ErrUploadCreating
+	}
+	s.creating[id] = true
+	return upload, nil
+}
+
+func (s *ResumableUploads) Release(id string) {
+	s.mu.Lock()
+	delete(s.creating, id)
+	s.mu.Unlock()
+}
+
+// Finish keeps the result of the complete upload and removes its data
+func (s *ResumableUploads) Finish(upload *ResumableUpload, result *UploadResult) error {
+
+	defer s.lock(upload.Id)()
+	upload.Result = result
+	if err := s.save(upload); err != nil {
+		return err
+	}
+	if err := os.Remove(s.dataPath(upload.Id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Delete removes the user's upload
+func (s *ResumableUploads) Delete(ctx context.Context, id string) error {
+
+	defer s.lock(id)()
+	if _, err := s.get(ctx, id); err != nil {
+		return err
+	}
+	return s.remove(id)
+}
+
+// RemoveExpired removes the uploads that expired before now, and returns how many there were
+func (s *ResumableUploads) RemoveExpired(now time.Time) (int, error) {
+
+	infos, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, info := range infos {
+		expired, err := s.removeExpired(strings.TrimSuffix(filepath.Base(info), ".json"), now)
+		if err != nil {
+			return removed, err
+		}
+		if expired {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *ResumableUploads) removeExpired(id string, now time.Time) (bool, error) {
+
+	defer s.lock(id)()
+	upload, err := s.load(id)
+	if os.IsNotExist(err) {
+		// Removed in the meantime
+		return false, nil
+	}
+	if err != nil {
+		log.Warnf("couldn't read upload %s: %s", id, err)
+		return false, nil
+	}
+	s.mu.Lock()
+	appending := s.appending[id]
+	s.mu.Unlock()
+	if upload.Expires.After(now) || appending {
+		return false, nil
+	}
+	return true, s.remove(id)
+}
+
+func (s *ResumableUploads) get(ctx context.Context, id string) (*ResumableUpload, error) {
+
+	upload, err := s.load(id)
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if upload.UserId != ctx.Value("userId").(int) || upload.Expires.Before(time.Now()) {
+		return nil, ErrUploadNotFound
+	}
+	return upload, nil
+}
+
+func (s *ResumableUploads) load(id string) (*ResumableUpload, error) {
+
+	if !validUploadId(id) {
+		return nil, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var upload ResumableUpload
+	if err := json.Unmarshal(b, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// save writes the info of the upload into a temporary file first, so it's never read half written
+func (s *ResumableUploads) save(upload *ResumableUpload) error {
+
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(upload.Id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(upload.Id))
+}
+
+func (s *ResumableUploads) remove(id string) error {
+
+	for _, p := range []string{s.dataPath(id), s.infoPath(id)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ResumableUploads) dataPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *ResumableUploads) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// validUploadId keeps the ids from the client out of other directories
+func validUploadId(id string) bool {
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil
+}
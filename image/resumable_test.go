@@ -0,0 +1,236 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func makeResumableUploads(t *testing.T, maxSize int64, expiry time.Duration) *ResumableUploads {
+
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	uploads, err := NewResumableUploads(dir, maxSize, expiry)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return uploads
+}
+
+func TestResumableUploads(t *testing.T) {
+
+	ctx := context.WithValue(context.Background(), "userId", 1)
+	otherCtx := context.WithValue(context.Background(), "userId", 2)
+
+	t.Run("resumes after an interruption", func(t *testing.T) {
+
+		uploads := makeResumableUploads(t, 100, time.Hour)
+		upload, err := uploads.Create(ctx, 10, map[string]string{"filename": "beach.jpg"})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if upload.Name() != "beach.jpg" || upload.Offset != 0 || upload.Complete() {
+			t.Errorf("incorrect upload: %+v", upload)
+		}
+
+		// The connection breaks off after 4 bytes
+		broken := io.MultiReader(strings.NewReader("0123"), iotest.ErrReader(fmt.Errorf("connection reset")))
+		upload, err = uploads.Append(ctx, upload.Id, 0, broken)
+		if err == nil {
+			t.Errorf("expected the error of the chunk")
+		}
+		if upload.Offset != 4 {
+			t.Errorf("incorrect offset: %d", upload.Offset)
+		}
+
+		if _, err := uploads.Append(ctx, upload.Id, 0, strings.NewReader("0123456789")); !errors.Is(err, ErrUploadOffset) {
+			t.Errorf("expected ErrUploadOffset, got: %v", err)
+		}
+		got, err := uploads.Get(ctx, upload.Id)
+		if err != nil || got.Offset != 4 {
+			t.Errorf("incorrect upload: %+v, %v", got, err)
+		}
+
+		// Whatever is past the length is left out
+		upload, err = uploads.Append(ctx, upload.Id, 4, strings.NewReader("456789extra"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !upload.Complete() {
+			t.Errorf("expected a complete upload: %+v", upload)
+		}
+		data, err := uploads.Data(upload)
+		if err != nil || !bytes.Equal(data, []byte("0123456789")) {
+			t.Errorf("incorrect data: %q, %v", data, err)
+		}
+		if _, err := uploads.Append(ctx, upload.Id, 10, strings.NewReader("more")); !errors.Is(err, ErrUploadComplete) {
+			t.Errorf("expected ErrUploadComplete, got: %v", err)
+		}
+
+		result := &UploadResult{Name: upload.Name(), Status: UploadSuccess}
+		if err := uploads.Finish(upload, result); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got, err = uploads.Get(ctx, upload.Id)
+		if err != nil || got.Result == nil || got.Result.Status != UploadSuccess {
+			t.Errorf("incorrect upload: %+v, %v", got, err)
+		}
+		if _, err := uploads.Data(upload); !os.IsNotExist(err) {
+			t.Errorf("expected the data to be removed, got: %v", err)
+		}
+	})
+
+	t.Run("bytes past the saved offset", func(t *testing.T) {
+
+		uploads := makeResumableUploads(t, 100, time.Hour)
+		upload, err := uploads.Create(ctx, 10, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := uploads.Append(ctx, upload.Id, 0, strings.NewReader("0123")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The server stopped after writing a chunk, before saving the offset
+		f, _ := os.OpenFile(uploads.dataPath(upload.Id), os.O_WRONLY|os.O_APPEND, 0644)
+		f.Write([]byte("45"))
+		f.Close()
+
+		upload, err = uploads.Append(ctx, upload.Id, 4, strings.NewReader("456789"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		data, err := uploads.Data(upload)
+		if err != nil || !bytes.Equal(data, []byte("0123456789")) {
+			t.Errorf("incorrect data: %q, %v", data, err)
+		}
+	})
+
+	t.Run("one chunk at a time", func(t *testing.T) {
+
+		uploads := makeResumableUploads(t, 100, time.Hour)
+		upload, err := uploads.Create(ctx, 10, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The first chunk is still coming in
+		pr, pw := io.Pipe()
+		appended := make(chan error)
+		go func() {
+			_, err := uploads.Append(ctx, upload.Id, 0, pr)
+			appended <- err
+		}()
+		pw.Write([]byte("0123"))
+
+		if got, err := uploads.Get(ctx, upload.Id); err != nil || got.Offset != 0 {
+			t.Errorf("the upload should be read while the chunk is written, got: %+v, %v", got, err)
+		}
+		if _, err := uploads.Append(ctx, upload.Id, 0, strings.NewReader("0123456789")); !errors.Is(err, ErrUploadLocked) {
+			t.Errorf("expected ErrUploadLocked, got: %v", err)
+		}
+
+		pw.Close()
+		if err := <-appended; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		upload, err = uploads.Append(ctx, upload.Id, 4, strings.NewReader("456789"))
+		if err != nil || !upload.Complete() {
+			t.Errorf("the upload should be complete, got: %+v, %v", upload, err)
+		}
+	})
+
+	t.Run("one claim at a time", func(t *testing.T) {
+
+		uploads := makeResumableUploads(t, 100, time.Hour)
+		upload, err := uploads.Create(ctx, 4, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := uploads.Append(ctx, upload.Id, 0, strings.NewReader("0123")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		claimed, err := uploads.Claim(ctx, upload.Id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := uploads.Claim(ctx, upload.Id); !errors.Is(err, ErrUploadCreating) {
+			t.Errorf("expected ErrUploadCreating, got: %v", err)
+		}
+		if err := uploads.Finish(claimed, &UploadResult{Status: UploadSuccess}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		uploads.Release(upload.Id)
+		if _, err := uploads.Claim(ctx, upload.Id); !errors.Is(err, ErrUploadComplete) {
+			t.Errorf("expected ErrUploadComplete, got: %v", err)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+
+		uploads := makeResumableUploads(t, 100, time.Hour)
+		if _, err := uploads.Create(ctx, 101, nil); !errors.Is(err, ErrUploadTooLarge) {
+			t.Errorf("expected ErrUploadTooLarge, got: %v", err)
+		}
+	})
+
+	t.Run("other users and bad ids", func(t *testing.T) {
+
+		uploads := makeResumableUploads(t, 100, time.Hour)
+		upload, err := uploads.Create(ctx, 10, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if upload.Name() != upload.Id {
+			t.Errorf("incorrect name: %s", upload.Name())
+		}
+		if _, err := uploads.Get(otherCtx, upload.Id); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("expected ErrUploadNotFound, got: %v", err)
+		}
+		if _, err := uploads.Append(otherCtx, upload.Id, 0, strings.NewReader("0123")); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("expected ErrUploadNotFound, got: %v", err)
+		}
+		if err := uploads.Delete(otherCtx, upload.Id); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("expected ErrUploadNotFound, got: %v", err)
+		}
+		if _, err := uploads.Get(ctx, "../../etc/passwd"); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("expected ErrUploadNotFound, got: %v", err)
+		}
+
+		if err := uploads.Delete(ctx, upload.Id); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := uploads.Get(ctx, upload.Id); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("expected ErrUploadNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+
+		uploads := makeResumableUploads(t, 100, time.Hour)
+		upload, err := uploads.Create(ctx, 10, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		removed, err := uploads.RemoveExpired(time.Now())
+		if err != nil || removed != 0 {
+			t.Errorf("expected nothing removed, got: %d, %v", removed, err)
+		}
+		removed, err = uploads.RemoveExpired(time.Now().Add(2 * time.Hour))
+		if err != nil || removed != 1 {
+			t.Errorf("expected one removed, got: %d, %v", removed, err)
+		}
+		if _, err := uploads.Get(ctx, upload.Id); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("expected ErrUploadNotFound, got: %v", err)
+		}
+	})
+}
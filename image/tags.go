@@ -0,0 +1,111 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MaxTagLength is the longest tag allowed, in characters
+const MaxTagLength = 64
+
+var ErrInvalidTag = fmt.Errorf("invalid tag")
+
+var ErrTagNotFound = fmt.Errorf("tag not found")
+
+// NormalizeTag trims and lowercases the tag, so that "Beach " and "beach" are the same tag
+func NormalizeTag(tag string) (string, error) {
+
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len([]rune(tag)) > MaxTagLength {
+		return "", fmt.Errorf("%w: tags should have 1 to %d characters", ErrInvalidTag, MaxTagLength)
+	}
+	return tag, nil
+}
+
+// GetTags returns the tags the user gave to the image, sorted
+func (i *imageService) GetTags(ctx context.Context, imageId int) ([]string, error) {
+
+	if err := i.checkOwner(ctx, imageId); err != nil {
+		return nil, err
+	}
+	rows, err := i.db.QueryContext(ctx, "SELECT tag FROM image_tags WHERE user_id = $1 AND image_id = $2 ORDER BY tag", ctx.Value("userId"), imageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// AddTags tags the user's image, tags it already has are skipped
+func (i *imageService) AddTags(ctx context.Context, imageId int, tags []string) (err error) {
+
+	normalized := make([]string, len(tags))
+	for j, tag := range tags {
+		if normalized[j], err = NormalizeTag(tag); err != nil {
+			return
+		}
+	}
+	if err = i.checkOwner(ctx, imageId); err != nil {
+		return
+	}
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	for _, tag := range normalized {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO image_tags (user_id, image_id, tag) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", ctx.Value("userId"), imageId, tag); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (i *imageService) RemoveTag(ctx context.Context, imageId int, tag string) error {
+
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return err
+	}
+	res, err := i.db.ExecContext(ctx, "DELETE FROM image_tags WHERE user_id = $1 AND image_id = $2 AND tag = $3", ctx.Value("userId"), imageId, tag)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTagNotFound
+	}
+	return nil
+}
+
+// checkOwner returns ErrImageNotFound if the image isn't in the user's gallery
+func (i *imageService) checkOwner(ctx context.Context, imageId int) error {
+
+	var exists bool
+	err := i.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM user_images WHERE user_id = $1 AND image_id = $2)", ctx.Value("userId"), imageId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrImageNotFound
+	}
+	return nil
+}
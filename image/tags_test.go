@@ -0,0 +1,65 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+
+	if tag, err := NormalizeTag("  Beach "); err != nil || tag != "beach" {
+		t.Errorf("got %q, %v", tag, err)
+	}
+	if _, err := NormalizeTag(strings.Repeat("a", MaxTagLength+1)); !errors.Is(err, ErrInvalidTag) {
+		t.Errorf("expected ErrInvalidTag, got: %v", err)
+	}
+}
+
+func TestImageService_AddTags(t *testing.T) {
+
+	userId := 1
+	imageId := 10
+	ctx := context.WithValue(context.Background(), "userId", userId)
+
+	t.Run("default", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT EXISTS").WithArgs(userId, imageId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO image_tags").WithArgs(userId, imageId, "beach").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO image_tags").WithArgs(userId, imageId, "sunset").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if err := service.AddTags(ctx, imageId, []string{"Beach", "sunset"}); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("someone else's image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT EXISTS").WithArgs(userId, imageId).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if err := service.AddTags(ctx, imageId, []string{"beach"}); err != ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package image
+
+import (
+	"image"
+	"image/draw"
+)
+
+// EXIF orientations, the way the camera was held
+const (
+	OrientationNormal     = 1
+	OrientationFlipH      = 2
+	OrientationRotate180  = 3
+	OrientationFlipV      = 4
+	OrientationTranspose  = 5
+	OrientationRotate90   = 6 // Needs a 90° clockwise rotation to be upright
+	OrientationTransverse = 7
+	OrientationRotate270  = 8 // Needs a 90° counterclockwise rotation to be upright
+)
+
+// Orient rotates and flips the image so that an image with the given EXIF orientation becomes upright
+func Orient(img image.Image, orientation int) image.Image {
+
+	switch orientation {
+	case OrientationFlipH:
+		return FlipHorizontal(img)
+	case OrientationRotate180:
+		return Rotate180(img)
+	case OrientationFlipV:
+		return FlipVertical(img)
+	case OrientationTranspose:
+		return transform(img, true, func(x, y, w, h int) (int, int) { return y, x })
+	case OrientationRotate90:
+		return Rotate90(img)
+	case OrientationTransverse:
+		return transform(img, true, func(x, y, w, h int) (int, int) { return h - 1 - y, w - 1 - x })
+	case OrientationRotate270:
+		return Rotate270(img)
+	default:
+		return img
+	}
+}
+
+// Rotate90 rotates the image 90° clockwise
+func Rotate90(img image.Image) image.Image {
+	return transform(img, true, func(x, y, w, h int) (int, int) { return h - 1 - y, x })
+}
+
+// Rotate180 rotates the image 180°
+func Rotate180(img image.Image) image.Image {
+	return transform(img, false, func(x, y, w, h int) (int, int) { return w - 1 - x, h - 1 - y })
+}
+
+// Rotate270 rotates the image 90° counterclockwise
+func Rotate270(img image.Image) image.Image {
+	return transform(img, true, func(x, y, w, h int) (int, int) { return y, w - 1 - x })
+}
+
+// FlipHorizontal mirrors the image left to right
+func FlipHorizontal(img image.Image) image.Image {
+	return transform(img, false, func(x, y, w, h int) (int, int) { return w - 1 - x, y })
+}
+
+// FlipVertical mirrors the image top to bottom
+func FlipVertical(img image.Image) image.Image {
+	return transform(img, false, func(x, y, w, h int) (int, int) { return x, h - 1 - y })
+}
+
+// transform moves every pixel of the image to where the mapping says. swap says whether width and height swap places.
+func transform(img image.Image, swap bool, mapping func(x, y, w, h int) (int, int)) image.Image {
+
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if swap {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := mapping(x, y, w, h)
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// toRGBA converts the image to RGBA with bounds starting at 0,0, so its pixels can be accessed directly
+func toRGBA(img image.Image) *image.RGBA {
+
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// Crop cuts the rectangle out of the image. The rectangle is relative to the top left corner of the image.
+func Crop(img image.Image, rect image.Rectangle) image.Image {
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min.Add(rect.Min), draw.Src)
+	return dst
+}
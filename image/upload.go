@@ -0,0 +1,230 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	pipe "github.com/ele7ija/pipeline"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"sort"
+	"sync"
+)
+
+// Upload is a file to create an image from that doesn't come as a part of a parsed form, e.g. an entry of an archive.
+// It goes into the create pipelines like a *multipart.FileHeader does.
+type Upload struct {
+	Index int    // Position of the file in the request, to tie the results to it
+	Name  string // Path of the file in the request
+	Data  []byte
+	Exif  *Exif // Parsed from the data before it's decoded, see ExtractExifWorker
+}
+
+// UploadError is an error of the create pipelines tied to the upload it happened to
+type UploadError struct {
+	Index int
+	Name  string
+	Code  string // One of the upload error codes, which stage failed
+	Err   error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// Upload statuses of UploadResult
+const (
+	UploadSuccess      = "success"
+	UploadDeduplicated = "deduplicated" // The same content was already uploaded, it's only linked
+	UploadSkipped      = "skipped"      // It isn't an image, e.g. a text file in an archive, so it's left out
+	UploadFailed       = "failed"
+	UploadExisting     = "existing" // The user already has an image with the same content
+	UploadPending      = "pending"  // Would be created, in a dry run, or will be in a job
+)
+
+// Upload error codes of UploadResult, so clients can tell the failures apart without parsing the messages
+const (
+	UploadCodeInvalidImage = "invalidImage" // Not an image of a supported format, or a corrupt one
+	UploadCodeNotAnImage   = "notAnImage"   // It isn't meant to be an image, e.g. a text file in an archive
+	UploadCodeTooLarge     = "tooLarge"
+	UploadCodeNotAllowed   = "notAllowed" // Over the limits of the policy
+	UploadCodeUnreadable   = "unreadable" // The file couldn't be read
+	UploadCodeProcessing   = "processing" // Making the thumbnail, the renditions or the placeholders failed
+	UploadCodeStorage      = "storage"    // Storing the files failed
+	UploadCodeDatabase     = "database"
+	UploadCodeCanceled     = "canceled" // The request ended before the file was done
+	UploadCodeInternal     = "internal"
+)
+
+// UploadResult says what happened to an uploaded file
+type UploadResult struct {
+	Index  int          `json:"index"`
+	Name   string       `json:"name"`
+	Status string       `json:"status"`
+	Image  *ImageBase64 `json:"image,omitempty"`
+	Code   string       `json:"code,omitempty"` // Why it failed or was skipped, with the Error
+	Error  string       `json:"error,omitempty"`
+}
+
+// fail fails the file with the code and the message of why
+func (r *UploadResult) fail(code, message string) *UploadResult {
+	r.Status, r.Code, r.Error = UploadFailed, code, message
+	return r
+}
+
+// skip leaves out the file that isn't an image, it isn't a failure
+func (r *UploadResult) skip() *UploadResult {
+	r.Status, r.Code, r.Error = UploadSkipped, UploadCodeNotAnImage, "not an image"
+	return r
+}
+
+// UploadSummary counts the results of an upload by their status
+type UploadSummary struct {
+	Total        int `json:"total"`
+	Succeeded    int `json:"succeeded"`
+	Deduplicated int `json:"deduplicated"`
+	Skipped      int `json:"skipped"`
+	Failed       int `json:"failed"`
+}
+
+func SummarizeUploads(results []*UploadResult) UploadSummary {
+
+	summary := UploadSummary{Total: len(results)}
+	for _, result := range results {
+		switch result.Status {
+		case UploadSuccess:
+			summary.Succeeded++
+		case UploadDeduplicated:
+			summary.Deduplicated++
+		case UploadSkipped:
+			summary.Skipped++
+		case UploadFailed:
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+// uploadError ties the error to the upload the image was made from, if there was one
+func (img *Image) uploadError(code string, err error) error {
+	if err == nil || img.Upload == nil {
+		return err
+	}
+	return &UploadError{img.Upload.Index, img.Upload.Name, code, err}
+}
+
+// isImage is true when the data starts like an image of a supported format, it isn't decoded
+func isImage(data []byte) bool {
+	_, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return err != image.ErrFormat
+}
+
+// MaxUploadsInFlight is how many files are in the create pipeline at once, each of them held in memory.
+// The feed waits in send for one of them to be done before it sends another.
+var MaxUploadsInFlight = 8
+
+// UploadFeed sends uploads into the create pipeline with send, and gives the results of the files it doesn't send,
+// e.g. the skipped ones, to done. The Index of the uploads and of the results numbers the files.
+type UploadFeed func(send func(*Upload) error, done func(*UploadResult)) error
+
+// CreateUploads creates the images of the uploads while the feed is still sending them, and returns the result of every file
+// by its index along with the error of the feed. progress is called with every result as it becomes known, if it's not nil.
+func CreateUploads(ctx context.Context, pipeline *pipe.Pipeline, feed UploadFeed, progress func(*UploadResult)) ([]*UploadResult, error) {
+
+	var mu sync.Mutex
+	results := make(map[int]*UploadResult)
+	slots := make(chan struct{}, MaxUploadsInFlight)
+	inFlight := make(map[int]bool) // The uploads holding a slot
+	setResult := func(result *UploadResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results[result.Index] = result
+		if result.Status == "" {
+			return
+		}
+		if inFlight[result.Index] {
+			delete(inFlight, result.Index)
+			<-slots
+		}
+		if progress != nil {
+			progress(result)
+		}
+	}
+
+	startingItems := make(chan pipe.Item)
+	feedErr := make(chan error, 1)
+	go func() {
+		defer close(startingItems)
+		send := func(upload *Upload) error {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				setResult((&UploadResult{Index: upload.Index, Name: upload.Name}).fail(UploadCodeCanceled, ctx.Err().Error()))
+				return ctx.Err()
+			}
+			// Set before it's sent, the pipeline sets the status
+			mu.Lock()
+			results[upload.Index] = &UploadResult{Index: upload.Index, Name: upload.Name}
+			inFlight[upload.Index] = true
+			mu.Unlock()
+			select {
+			case startingItems <- upload:
+				return nil
+			case <-ctx.Done():
+				setResult((&UploadResult{Index: upload.Index, Name: upload.Name}).fail(UploadCodeCanceled, ctx.Err().Error()))
+				return ctx.Err()
+			}
+		}
+		feedErr <- feed(send, setResult)
+	}()
+
+	errs := make(chan error)
+	errsDone := make(chan struct{})
+	go func() {
+		for err := range errs {
+			if uploadErr, ok := err.(*UploadError); ok {
+				code := uploadErr.Code
+				if ctx.Err() != nil {
+					code = UploadCodeCanceled
+				}
+				setResult((&UploadResult{Index: uploadErr.Index, Name: uploadErr.Name}).fail(code, uploadErr.Err.Error()))
+				continue
+			}
+			log.Errorf("Error in the CreateImagesPipeline: %v", err)
+			// Its upload left the pipeline, though it isn't known which one it was
+			<-slots
+		}
+		close(errsDone)
+	}()
+
+	for item := range pipeline.Filter(ctx, startingItems, errs) {
+		img := item.(*ImageBase64)
+		status := UploadSuccess
+		if img.Deduplicated {
+			status = UploadDeduplicated
+		}
+		// Thousands of originals would make a huge response, they're served from /original
+		img.FullBase64 = ""
+		setResult(&UploadResult{Index: img.Upload.Index, Name: img.Upload.Name, Status: status, Image: img})
+	}
+	close(errs)
+	<-errsDone
+
+	list := make([]*UploadResult, 0, len(results))
+	for _, result := range results {
+		if result.Status == "" {
+			// Its error wasn't tied to it
+			result.fail(UploadCodeInternal, "internal error")
+			if progress != nil {
+				progress(result)
+			}
+		}
+		list = append(list, result)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	return list, <-feedErr
+}
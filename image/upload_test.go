@@ -0,0 +1,54 @@
+package image
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"sync"
+	"testing"
+)
+
+func TestCreateUploads(t *testing.T) {
+
+	ctx := context.WithValue(context.Background(), "userId", 1)
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	pipeline := MakeCreateImagesPipelineBoundedFilters(NewImageService(db, NewMemoryBlobStore(), DefaultRenditions))
+
+	t.Run("holds at most MaxUploadsInFlight files", func(t *testing.T) {
+
+		defer func(max int) { MaxUploadsInFlight = max }(MaxUploadsInFlight)
+		MaxUploadsInFlight = 2
+
+		var mu sync.Mutex
+		known := 0
+		progress := func(result *UploadResult) {
+			mu.Lock()
+			known++
+			mu.Unlock()
+		}
+		feed := func(send func(*Upload) error, done func(*UploadResult)) error {
+			for i := 0; i < 6; i++ {
+				if err := send(&Upload{Index: i, Name: "broken.jpg", Data: []byte("not an image")}); err != nil {
+					return err
+				}
+				mu.Lock()
+				inFlight := i + 1 - known
+				mu.Unlock()
+				if inFlight > MaxUploadsInFlight {
+					t.Errorf("%d files in the pipeline", inFlight)
+				}
+			}
+			return nil
+		}
+		results, err := CreateUploads(ctx, pipeline, feed, progress)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if summary := SummarizeUploads(results); summary != (UploadSummary{Total: 6, Failed: 6}) {
+			t.Errorf("incorrect summary: %+v", summary)
+		}
+	})
+}
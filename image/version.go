@@ -0,0 +1,55 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// SaveVersion makes the edited image a version of the image it was edited from. All versions point to the first one,
+// so editing a version makes another version of the same image. Versions are the user's, like tags.
+func (i *imageService) SaveVersion(ctx context.Context, img *Image) error {
+
+	if img.EditedFrom == 0 || img.EditedFrom == img.Id {
+		// The edit came out the same as the image
+		return nil
+	}
+	var versionOf int
+	err := i.db.QueryRowContext(ctx, "UPDATE user_images SET version_of = COALESCE((SELECT version_of FROM user_images WHERE user_id = $1 AND image_id = $2), $2) WHERE user_id = $1 AND image_id = $3 RETURNING version_of",
+		ctx.Value("userId"), img.EditedFrom, img.Id).Scan(&versionOf)
+	if err != nil {
+		return err
+	}
+	img.VersionOf = &versionOf
+	log.Printf("saved image %d as a version of image %d", img.Id, versionOf)
+	return nil
+}
+
+// GetVersions returns all versions of the user's image, the first one first
+func (i *imageService) GetVersions(ctx context.Context, imageId int) ([]*Image, error) {
+
+	rows, err := i.db.QueryContext(ctx, fmt.Sprintf(`SELECT %s, version_of FROM image JOIN user_images ON image_id = id
+		WHERE user_id = $1 AND (SELECT COALESCE(version_of, image_id) FROM user_images WHERE user_id = $1 AND image_id = $2) IN (id, version_of)
+		ORDER BY version_of IS NOT NULL, created_at, id`, imageColumns), ctx.Value("userId"), imageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	imgs := []*Image{}
+	for rows.Next() {
+		var versionOf *int
+		img, err := scanImage(rows, &versionOf)
+		if err != nil {
+			return nil, err
+		}
+		img.VersionOf = versionOf
+		imgs = append(imgs, img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(imgs) == 0 {
+		return nil, ErrImageNotFound
+	}
+	return imgs, nil
+}
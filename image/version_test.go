@@ -0,0 +1,85 @@
+package image
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"testing"
+)
+
+func TestImageService_GetVersions(t *testing.T) {
+
+	userId := 1
+	ctx := context.WithValue(context.Background(), "userId", userId)
+	columns := []string{"id", "name", "fullpath", "thumbnailpath", "resolution_x", "resolution_y", "hash", "format", "mime_type", "size", "version_of"}
+
+	t.Run("found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+), version_of FROM image JOIN user_images").WithArgs(userId, 2).WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, "test.jpg", "full/1", "thumbnail/1", 320, 240, "", "jpeg", "image/jpeg", 100, nil).
+			AddRow(2, "test.jpg", "full/2", "thumbnail/2", 240, 320, "", "jpeg", "image/jpeg", 100, 1))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		imgs, err := service.GetVersions(ctx, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(imgs) != 2 || imgs[0].VersionOf != nil || imgs[1].VersionOf == nil || *imgs[1].VersionOf != 1 {
+			t.Errorf("versions not found well: %+v", imgs)
+		}
+	})
+
+	t.Run("someone else's image", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+), version_of FROM image JOIN user_images").WithArgs(userId, 2).WillReturnRows(sqlmock.NewRows(columns))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if _, err := service.GetVersions(ctx, 2); err != ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %v", err)
+		}
+	})
+}
+
+func TestImageService_SaveVersion(t *testing.T) {
+
+	userId := 1
+	ctx := context.WithValue(context.Background(), "userId", userId)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// A version of a version is a version of the first one
+	mock.ExpectQuery("UPDATE user_images SET version_of").WithArgs(userId, 2, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"version_of"}).AddRow(1))
+
+	service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+	img := &Image{Id: 3, EditedFrom: 2}
+	if err := service.SaveVersion(ctx, img); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if img.VersionOf == nil || *img.VersionOf != 1 {
+		t.Errorf("got version of %v, want 1", img.VersionOf)
+	}
+
+	// The edit came out the same, nothing to save
+	if err := service.SaveVersion(ctx, &Image{Id: 2, EditedFrom: 2}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
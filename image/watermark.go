@@ -0,0 +1,299 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// ErrBadWatermark is returned for watermarks that can't be applied
+var ErrBadWatermark = fmt.Errorf("bad watermark")
+
+// WatermarkQuality is the JPEG quality watermarked renditions are encoded with
+const WatermarkQuality = 90
+
+// MaxWatermarkLogoSize is the size of the largest logo, in bytes
+const MaxWatermarkLogoSize = 1 << 20
+
+// Where the watermark is put
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkCenter      = "center"
+)
+
+// When the watermark is applied. The originals always stay clean.
+const (
+	WatermarkOnServe  = "serve"  // Renditions are watermarked when they're served
+	WatermarkOnUpload = "upload" // Renditions are watermarked when they're made, the upload isn't deduplicated then
+)
+
+// Watermark is the user's watermark, either a text or a PNG logo
+type Watermark struct {
+	Text     string  `json:"text,omitempty"`
+	Logo     []byte  `json:"logo,omitempty"`    // A PNG, base64 encoded in JSON
+	Position string  `json:"position"`          // Bottom right by default
+	Opacity  float64 `json:"opacity"`           // From 0 to 1, 0.5 by default
+	Scale    float64 `json:"scale"`             // Width of the watermark relative to the image, 0.2 by default
+	ApplyOn  string  `json:"applyOn"`           // WatermarkOnServe by default
+	Version  string  `json:"version,omitempty"` // Changes with the watermark, for the ETags of watermarked files
+}
+
+// Validate checks the watermark and fills in the defaults
+func (w *Watermark) Validate() error {
+
+	w.Text = strings.TrimSpace(w.Text)
+	if (w.Text == "") == (w.Logo == nil) {
+		return fmt.Errorf("%w: it should be either a text or a logo", ErrBadWatermark)
+	}
+	if len(w.Text) > 100 {
+		return fmt.Errorf("%w: text is longer than 100 characters", ErrBadWatermark)
+	}
+	if w.Logo != nil {
+		if len(w.Logo) > MaxWatermarkLogoSize {
+			return fmt.Errorf("%w: logo is bigger than %d bytes", ErrBadWatermark, MaxWatermarkLogoSize)
+		}
+		if _, err := png.DecodeConfig(bytes.NewReader(w.Logo)); err != nil {
+			return fmt.Errorf("%w: logo should be a PNG: %s", ErrBadWatermark, err)
+		}
+	}
+	switch w.Position {
+	case "":
+		w.Position = WatermarkBottomRight
+	case WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight, WatermarkCenter:
+	default:
+		return fmt.Errorf("%w: unknown position %q", ErrBadWatermark, w.Position)
+	}
+	if w.Opacity == 0 {
+		w.Opacity = 0.5
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return fmt.Errorf("%w: opacity should be from 0 to 1", ErrBadWatermark)
+	}
+	if w.Scale == 0 {
+		w.Scale = 0.2
+	}
+	if w.Scale < 0 || w.Scale > 1 {
+		return fmt.Errorf("%w: scale should be from 0 to 1", ErrBadWatermark)
+	}
+	switch w.ApplyOn {
+	case "":
+		w.ApplyOn = WatermarkOnServe
+	case WatermarkOnServe, WatermarkOnUpload:
+	default:
+		return fmt.Errorf("%w: apply on should be %s or %s", ErrBadWatermark, WatermarkOnServe, WatermarkOnUpload)
+	}
+	b, _ := json.Marshal(struct {
+		Text, Position, ApplyOn string
+		Logo                    []byte
+		Opacity, Scale          float64
+	}{w.Text, w.Position, w.ApplyOn, w.Logo, w.Opacity, w.Scale})
+	w.Version = HashContent(b)[:16]
+	return nil
+}
+
+// Apply draws the watermark over a copy of the image
+func (w *Watermark) Apply(img image.Image) (image.Image, error) {
+
+	b := img.Bounds()
+	width := int(math.Max(1, math.Round(float64(b.Dx())*w.Scale)))
+	var mark image.Image
+	var err error
+	if w.Logo != nil {
+		mark, err = w.logo(width)
+	} else {
+		mark, err = w.text(width)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	at := w.position(dst.Bounds().Size(), mark.Bounds().Size())
+	opacity := image.NewUniform(color.Alpha{A: uint8(math.Round(w.Opacity * 255))})
+	draw.DrawMask(dst, mark.Bounds().Sub(mark.Bounds().Min).Add(at), mark, mark.Bounds().Min, opacity, image.Point{}, draw.Over)
+	return dst, nil
+}
+
+func (w *Watermark) logo(width int) (image.Image, error) {
+
+	logo, err := png.Decode(bytes.NewReader(w.Logo))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadWatermark, err)
+	}
+	size := logo.Bounds().Size()
+	height := int(math.Max(1, math.Round(float64(size.Y)*float64(width)/float64(size.X))))
+	return ResizeTo(logo, uint(width), uint(height), FitModeFill), nil
+}
+
+// text renders the text in white with a dark outline, so that it shows on both light and dark images
+func (w *Watermark) text(width int) (image.Image, error) {
+
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+	// Measure at a known size, then pick the size that makes the text as wide as asked
+	const measureSize = 100
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: measureSize, DPI: 72})
+	if err != nil {
+		return nil, err
+	}
+	advance := font.MeasureString(face, w.Text).Round()
+	face.Close()
+	size := math.Max(4, measureSize*float64(width)/float64(advance))
+	face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	outline := int(math.Max(1, size/20))
+	textWidth := font.MeasureString(face, w.Text).Ceil()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+	mark := image.NewRGBA(image.Rect(0, 0, textWidth+2*outline, height+2*outline))
+	drawer := &font.Drawer{Dst: mark, Face: face}
+	for _, d := range []struct {
+		src    image.Image
+		offset []image.Point
+	}{
+		{image.NewUniform(color.RGBA{A: 160}), []image.Point{{-outline, 0}, {outline, 0}, {0, -outline}, {0, outline}}},
+		{image.White, []image.Point{{}}},
+	} {
+		drawer.Src = d.src
+		for _, o := range d.offset {
+			drawer.Dot = fixed.P(outline+o.X, outline+o.Y+metrics.Ascent.Ceil())
+			drawer.DrawString(w.Text)
+		}
+	}
+	return mark, nil
+}
+
+// position returns where the top left corner of the mark goes, a margin away from the edges
+func (w *Watermark) position(img, mark image.Point) image.Point {
+
+	margin := int(math.Round(math.Min(float64(img.X), float64(img.Y)) * 0.03))
+	left, top := margin, margin
+	right, bottom := img.X-mark.X-margin, img.Y-mark.Y-margin
+	switch w.Position {
+	case WatermarkTopLeft:
+		return image.Pt(left, top)
+	case WatermarkTopRight:
+		return image.Pt(right, top)
+	case WatermarkBottomLeft:
+		return image.Pt(left, bottom)
+	case WatermarkCenter:
+		return image.Pt((img.X-mark.X)/2, (img.Y-mark.Y)/2)
+	default:
+		return image.Pt(right, bottom)
+	}
+}
+
+// WatermarkData watermarks an encoded image, keeping its format
+func (w *Watermark) WatermarkData(b []byte, quality int) ([]byte, error) {
+
+	img, format, err := Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	watermarked, err := w.Apply(img)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(EncodeFormats, format) {
+		format = "jpeg"
+	}
+	buff := new(bytes.Buffer)
+	if err := Encode(buff, watermarked, format, quality); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// WatermarkContent watermarks a file being served. The ETag changes with the watermark.
+func (w *Watermark) WatermarkContent(content *Content, quality int) (*Content, error) {
+
+	defer content.Close()
+	b, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	watermarked, err := w.WatermarkData(b, quality)
+	if err != nil {
+		return nil, err
+	}
+	etag := strings.TrimSuffix(content.ETag, `"`) + "-" + w.Version + `"`
+	return &Content{
+		ReadSeeker: bytes.NewReader(watermarked),
+		closer:     ioutil.NopCloser(nil),
+		MimeType:   content.MimeType,
+		Size:       int64(len(watermarked)),
+		ETag:       etag,
+		ModTime:    content.ModTime,
+	}, nil
+}
+
+// GetWatermark returns the user's watermark, nil if there isn't one
+func (i *imageService) GetWatermark(ctx context.Context) (*Watermark, error) {
+
+	var w Watermark
+	var text sql.NullString
+	err := i.db.QueryRowContext(ctx, "SELECT text, logo, position, opacity, scale, apply_on FROM user_watermark WHERE user_id = $1", ctx.Value("userId")).
+		Scan(&text, &w.Logo, &w.Position, &w.Opacity, &w.Scale, &w.ApplyOn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.Text = text.String
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// SaveWatermark sets the user's watermark. Renditions already watermarked on upload keep the old one.
+func (i *imageService) SaveWatermark(ctx context.Context, w *Watermark) error {
+
+	if err := w.Validate(); err != nil {
+		return err
+	}
+	var logo interface{}
+	if w.Logo != nil {
+		logo = w.Logo
+	}
+	_, err := i.db.ExecContext(ctx, `INSERT INTO user_watermark (user_id, text, logo, position, opacity, scale, apply_on) VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id) DO UPDATE SET text = EXCLUDED.text, logo = EXCLUDED.logo, position = EXCLUDED.position, opacity = EXCLUDED.opacity, scale = EXCLUDED.scale, apply_on = EXCLUDED.apply_on`,
+		ctx.Value("userId"), w.Text, logo, w.Position, w.Opacity, w.Scale, w.ApplyOn)
+	if err != nil {
+		return err
+	}
+	log.Printf("saved the watermark of user %v", ctx.Value("userId"))
+	return nil
+}
+
+// DeleteWatermark removes the user's watermark
+func (i *imageService) DeleteWatermark(ctx context.Context) error {
+
+	_, err := i.db.ExecContext(ctx, "DELETE FROM user_watermark WHERE user_id = $1", ctx.Value("userId"))
+	return err
+}
@@ -0,0 +1,273 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+func testLogo(t *testing.T) []byte {
+
+	logo := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for i := 0; i < len(logo.Pix); i += 4 {
+		logo.Pix[i], logo.Pix[i+3] = 255, 255
+	}
+	buff := new(bytes.Buffer)
+	if err := png.Encode(buff, logo); err != nil {
+		t.Fatalf("error encoding: %s", err)
+	}
+	return buff.Bytes()
+}
+
+func TestWatermark_Validate(t *testing.T) {
+
+	w := Watermark{Text: " © Studio "}
+	if err := w.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if w.Text != "© Studio" || w.Position != WatermarkBottomRight || w.Opacity != 0.5 || w.Scale != 0.2 || w.ApplyOn != WatermarkOnServe || w.Version == "" {
+		t.Errorf("defaults not filled in: %+v", w)
+	}
+
+	changed := Watermark{Text: "© Studio", Position: WatermarkCenter}
+	changed.Validate()
+	if changed.Version == w.Version {
+		t.Errorf("version should change with the watermark")
+	}
+
+	invalid := []Watermark{
+		{},
+		{Text: "both", Logo: testLogo(t)},
+		{Logo: []byte("not a png")},
+		{Text: "a", Position: "middle"},
+		{Text: "a", Opacity: 1.5},
+		{Text: "a", Scale: -1},
+		{Text: "a", ApplyOn: "always"},
+	}
+	for _, w := range invalid {
+		if err := w.Validate(); !errors.Is(err, ErrBadWatermark) {
+			t.Errorf("%+v: expected ErrBadWatermark, got: %v", w, err)
+		}
+	}
+}
+
+func TestWatermark_Apply(t *testing.T) {
+
+	gray := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+	src := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for i := 0; i < len(src.Pix); i += 4 {
+		copy(src.Pix[i:i+4], []uint8{gray.R, gray.G, gray.B, gray.A})
+	}
+
+	t.Run("text", func(t *testing.T) {
+
+		w := Watermark{Text: "© Studio"}
+		w.Validate()
+		got, err := w.Apply(src)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got.Bounds() != src.Bounds() {
+			t.Errorf("got bounds %v", got.Bounds())
+		}
+		if got.At(10, 10) != gray {
+			t.Errorf("top left should stay clean")
+		}
+		changed := false
+		for y := 200; y < 300 && !changed; y++ {
+			for x := 300; x < 400 && !changed; x++ {
+				changed = got.At(x, y) != gray
+			}
+		}
+		if !changed {
+			t.Errorf("bottom right isn't watermarked")
+		}
+		if src.At(390, 290) != gray {
+			t.Errorf("the source shouldn't change")
+		}
+	})
+
+	t.Run("logo", func(t *testing.T) {
+
+		w := Watermark{Logo: testLogo(t), Position: WatermarkTopLeft, Opacity: 1, Scale: 0.1}
+		w.Validate()
+		got, err := w.Apply(src)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The logo is 40x20 after scaling, 9 pixels from the edges
+		if r, g, _, _ := got.At(20, 15).RGBA(); r>>8 != 255 || g>>8 != 0 {
+			t.Errorf("logo not drawn")
+		}
+		if got.At(60, 15) != gray {
+			t.Errorf("logo is too big")
+		}
+	})
+}
+
+func TestWatermarkWorker(t *testing.T) {
+
+	w := &Watermark{Text: "© Studio", ApplyOn: WatermarkOnUpload}
+	w.Validate()
+	ctx := context.WithValue(context.Background(), "watermark", w)
+
+	newImage := func() *Image {
+		img := OpenTestImage(t)
+		imageService := NewImageService(nil, NewMemoryBlobStore(), DefaultRenditions)
+		imageService.CreateRenditions(context.Background(), img)
+		return img
+	}
+
+	t.Run("applied on upload", func(t *testing.T) {
+		img := newImage()
+		clean := img.Renditions[0].Data
+		original := img.Original
+		worker := WatermarkWorker{WatermarkOnUpload}
+		if _, err := worker.Work(ctx, img); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if bytes.Equal(img.Renditions[0].Data, clean) || img.Renditions[0].Size != int64(len(img.Renditions[0].Data)) {
+			t.Errorf("rendition not watermarked")
+		}
+		if !bytes.Equal(img.Original, original) {
+			t.Errorf("original should stay clean")
+		}
+	})
+
+	t.Run("not on serve", func(t *testing.T) {
+		img := newImage()
+		clean := img.Renditions[0].Data
+		worker := WatermarkWorker{WatermarkOnServe}
+		worker.Work(ctx, img)
+		if !bytes.Equal(img.Renditions[0].Data, clean) {
+			t.Errorf("the watermark is applied on upload only")
+		}
+	})
+
+	t.Run("no watermark", func(t *testing.T) {
+		img := newImage()
+		clean := img.Renditions[0].Data
+		worker := WatermarkWorker{WatermarkOnUpload}
+		worker.Work(context.Background(), img)
+		if !bytes.Equal(img.Renditions[0].Data, clean) {
+			t.Errorf("nothing should be watermarked")
+		}
+	})
+
+	t.Run("not deduplicated", func(t *testing.T) {
+		// No queries are expected, the image isn't looked up by its hash
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		img := &Image{Hash: "abc"}
+		worker := DeduplicateWorker{NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)}
+		if _, err := worker.Work(ctx, img); err != nil || img.Deduplicated || !img.Watermarked || img.Hash != "abc" {
+			t.Errorf("watermarked uploads shouldn't be shared: %+v, %v", img, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+func TestWatermark_WatermarkContent(t *testing.T) {
+
+	w := &Watermark{Text: "© Studio"}
+	w.Validate()
+	b, _ := ioutil.ReadFile(TestImagePath)
+	content := &Content{ReadSeeker: bytes.NewReader(b), closer: ioutil.NopCloser(nil), MimeType: "image/jpeg", Size: int64(len(b)), ETag: `"abc"`}
+
+	watermarked, err := w.WatermarkContent(content, WatermarkQuality)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if watermarked.ETag != `"abc-`+w.Version+`"` || watermarked.MimeType != "image/jpeg" {
+		t.Errorf("content not made well: %+v", watermarked)
+	}
+	got, _ := ioutil.ReadAll(watermarked)
+	if bytes.Equal(got, b) || int64(len(got)) != watermarked.Size {
+		t.Errorf("content not watermarked")
+	}
+}
+
+func TestImageService_Watermark(t *testing.T) {
+
+	userId := 1
+	ctx := context.WithValue(context.Background(), "userId", userId)
+	columns := []string{"text", "logo", "position", "opacity", "scale", "apply_on"}
+
+	t.Run("saved", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("INSERT INTO user_watermark").WithArgs(userId, "© Studio", nil, WatermarkTopLeft, 0.5, 0.2, WatermarkOnUpload).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		w := &Watermark{Text: "© Studio", Position: WatermarkTopLeft, ApplyOn: WatermarkOnUpload}
+		if err := service.SaveWatermark(ctx, w); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+
+		service := NewImageService(nil, NewMemoryBlobStore(), DefaultRenditions)
+		if err := service.SaveWatermark(ctx, &Watermark{}); !errors.Is(err, ErrBadWatermark) {
+			t.Errorf("expected ErrBadWatermark, got: %v", err)
+		}
+	})
+
+	t.Run("found", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) FROM user_watermark").WithArgs(userId).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow("© Studio", nil, WatermarkCenter, 0.3, 0.25, WatermarkOnServe))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		w, err := service.GetWatermark(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if w == nil || w.Text != "© Studio" || w.Position != WatermarkCenter || w.Opacity != 0.3 || w.Version == "" {
+			t.Errorf("watermark not loaded well: %+v", w)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) FROM user_watermark").WithArgs(userId).WillReturnRows(sqlmock.NewRows(columns))
+
+		service := NewImageService(db, NewMemoryBlobStore(), DefaultRenditions)
+		if w, err := service.GetWatermark(ctx); w != nil || err != nil {
+			t.Errorf("expected no watermark and no error, got: %+v, %v", w, err)
+		}
+	})
+}
@@ -1,11 +1,15 @@
 package image
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	pipe "github.com/ele7ija/pipeline"
-	"image/jpeg"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"io/ioutil"
 	"mime/multipart"
+	"path"
 )
 
 type GetMetadataWorker struct {
@@ -34,6 +38,42 @@ func (worker *GetMetadataWorker) Work(ctx context.Context, in pipe.Item) (pipe.I
 	return imgs[0], nil
 }
 
+type GetWorker struct {
+	ImageService
+}
+
+// Work expects the input item to be the id of one of the user's images
+func (worker *GetWorker) Work(ctx context.Context, in pipe.Item) (pipe.Item, error) {
+
+	var imageId int
+	var ok bool
+	if imageId, ok = in.(int); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	img, err := worker.Get(ctx, imageId)
+	if err != nil {
+		return nil, fmt.Errorf("image %d: %w", imageId, err)
+	}
+	return img, nil
+}
+
+type LoadExifWorker struct {
+	ImageService
+}
+
+func (worker *LoadExifWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	err = worker.LoadExif(ctx, img)
+	return img, err
+}
+
 type LoadThumbnailWorker struct {
 	ImageService
 }
@@ -81,6 +121,173 @@ func (worker *Base64EncodeWorker) Work(ctx context.Context, in pipe.Item) (out p
 	return imgBase64, err
 }
 
+type LinkWorker struct {
+	Prefix string
+	ImageService
+}
+
+// Work makes the JSON of the image with urls of its files instead of their base64 encodings.
+// Only the renditions stored for the image are linked.
+func (worker *LinkWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	renditions, err := worker.GetRenditionNames(ctx, img.Id)
+	if err != nil {
+		return nil, fmt.Errorf("image %d: %w", img.Id, err)
+	}
+	imgBase64 := NewImageBase64(img)
+	imgBase64.Urls = NewImageUrls(worker.Prefix, img.Id, renditions)
+	return imgBase64, nil
+}
+
+type ExtractExifWorker struct {
+}
+
+// Work parses the EXIF data from the uploaded bytes, before they're decoded. TransformFileHeaderWorker then turns
+// the image upright as the EXIF orientation says. Other items, e.g. form files, are passed on as they are.
+func (worker *ExtractExifWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	if upload, ok := in.(*Upload); ok {
+		upload.Exif = parseExif(upload.Name, upload.Data)
+	}
+	return in, nil
+}
+
+// parseExif parses the EXIF data of the uploaded bytes, nil when there isn't any.
+// Broken EXIF data doesn't fail the upload, it's only logged.
+func parseExif(name string, b []byte) *Exif {
+
+	x, err := ParseExif(b)
+	if err == ErrNoExif {
+		return nil
+	}
+	if err != nil {
+		log.Warnf("%s: couldn't parse exif: %s", name, err)
+		return nil
+	}
+	return x
+}
+
+// orient keeps the EXIF data with the image and turns it upright as the orientation says
+func (img *Image) orient(x *Exif) {
+
+	img.Exif = x
+	if x != nil && x.Orientation > OrientationNormal {
+		img.Full = Orient(img.Full, x.Orientation)
+		img.Resolution = img.Full.Bounds().Size()
+	}
+}
+
+type PerceptualHashWorker struct {
+}
+
+// Work computes the perceptual hash of the upright full image, see PerceptualHash
+func (worker *PerceptualHashWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	if img.Deduplicated || img.Full == nil {
+		return img, nil
+	}
+	phash := PerceptualHash(img.Full)
+	img.PerceptualHash = &phash
+	return img, nil
+}
+
+type PaletteWorker struct {
+}
+
+// Work extracts the dominant colors and the average color of the upright full image, see Palette
+func (worker *PaletteWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	if img.Deduplicated || img.Full == nil {
+		return img, nil
+	}
+	average := AverageColor(img.Full)
+	img.AverageColor = &average
+	img.Palette = Palette(img.Full, PaletteSize)
+	return img, nil
+}
+
+type PlaceholderWorker struct {
+}
+
+// Work computes the BlurHash and the low quality placeholder of the upright full image, see BlurHash and LQIP
+func (worker *PlaceholderWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	if img.Deduplicated || img.Full == nil {
+		return img, nil
+	}
+	img.BlurHash = BlurHash(img.Full, BlurHashComponentsX, BlurHashComponentsY)
+	if img.LQIP, err = LQIP(img.Full); err != nil {
+		return nil, img.uploadError(UploadCodeProcessing, err)
+	}
+	return img, nil
+}
+
+type OpenOriginalWorker struct {
+	ImageService
+}
+
+// Work opens the original of the image for the export, the caller closes it
+func (worker *OpenOriginalWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	content, err := worker.OpenOriginal(ctx, img.Id)
+	if err != nil {
+		return nil, fmt.Errorf("image %d: %w", img.Id, err)
+	}
+	return &ExportFile{img, content}, nil
+}
+
+type SavePerceptualHashWorker struct {
+	ImageService
+}
+
+func (worker *SavePerceptualHashWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	err = worker.SavePerceptualHash(ctx, img)
+	if err != nil {
+		return nil, fmt.Errorf("image %d: %w", img.Id, err)
+	}
+	// The full image is no longer needed, free it
+	img.Full = nil
+	img.Original = nil
+	return img, nil
+}
+
 type CreateThumbnailWorker struct {
 	ImageService
 }
@@ -93,10 +300,85 @@ func (worker *CreateThumbnailWorker) Work(ctx context.Context, in pipe.Item) (ou
 		return nil, fmt.Errorf("incorrect input parameter")
 	}
 
+	if img.Deduplicated {
+		return img, nil
+	}
 	err = worker.CreateThumbnail(ctx, img)
+	return img, img.uploadError(UploadCodeProcessing, err)
+}
+
+type CreateRenditionsWorker struct {
+	ImageService
+}
+
+func (worker *CreateRenditionsWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	if img.Deduplicated {
+		return img, nil
+	}
+	err = worker.CreateRenditions(ctx, img)
+	return img, img.uploadError(UploadCodeProcessing, err)
+}
+
+type LoadRenditionWorker struct {
+	ImageService
+}
+
+// Work loads the rendition named by the "rendition" context value, if there is one
+func (worker *LoadRenditionWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	name, _ := ctx.Value("rendition").(string)
+	if name == "" {
+		return img, nil
+	}
+	err = worker.LoadRendition(ctx, img, name)
 	return img, err
 }
 
+type WatermarkWorker struct {
+	ApplyOn string // The stage of the pipeline, WatermarkOnUpload or WatermarkOnServe
+}
+
+// Work watermarks the renditions in memory with the "watermark" context value, if that watermark is applied on this stage.
+// The original is never watermarked.
+func (worker *WatermarkWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	w, _ := ctx.Value("watermark").(*Watermark)
+	if w == nil || w.ApplyOn != worker.ApplyOn || img.Deduplicated {
+		return img, nil
+	}
+	for _, r := range img.Renditions {
+		if r.Data == nil {
+			continue
+		}
+		watermarked, err := w.WatermarkData(r.Data, WatermarkQuality)
+		if err != nil {
+			return nil, img.uploadError(UploadCodeProcessing, fmt.Errorf("%s: rendition %s: %w", img.Name, r.Name, err))
+		}
+		r.Data = watermarked
+		r.Size = int64(len(watermarked))
+	}
+	return img, nil
+}
+
 type PersistWorker struct {
 	ImageService
 }
@@ -109,8 +391,11 @@ func (worker *PersistWorker) Work(ctx context.Context, in pipe.Item) (out pipe.I
 		return nil, fmt.Errorf("incorrect input parameter")
 	}
 
+	if img.Deduplicated {
+		return img, nil
+	}
 	err = worker.Persist(ctx, img)
-	return img, err
+	return img, img.uploadError(UploadCodeStorage, err)
 }
 
 type SaveMetadataWorker struct {
@@ -126,7 +411,7 @@ func (worker *SaveMetadataWorker) Work(ctx context.Context, in pipe.Item) (out p
 	}
 
 	err = worker.SaveMetadata(ctx, img)
-	return img, err
+	return img, img.uploadError(UploadCodeDatabase, err)
 }
 
 type RemoveFullImageWorker struct {
@@ -147,8 +432,19 @@ func (worker *RemoveFullImageWorker) Work(ctx context.Context, in pipe.Item) (ou
 type TransformFileHeaderWorker struct {
 }
 
+// Work decodes a part of the form or an Upload into an image
 func (worker *TransformFileHeaderWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
 
+	if upload, ok := in.(*Upload); ok {
+		img, err := NewImageFromBytes(path.Base(upload.Name), upload.Data)
+		if err != nil {
+			return nil, &UploadError{upload.Index, upload.Name, UploadCodeInvalidImage, err}
+		}
+		img.orient(upload.Exif)
+		img.Upload = &Upload{Index: upload.Index, Name: upload.Name}
+		return img, nil
+	}
+
 	var fh *multipart.FileHeader
 	var ok bool
 	if fh, ok = in.(*multipart.FileHeader); ok == false {
@@ -157,12 +453,258 @@ func (worker *TransformFileHeaderWorker) Work(ctx context.Context, in pipe.Item)
 
 	f, err := fh.Open()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", fh.Filename, err)
 	}
-	rawimg, err := jpeg.Decode(f)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", fh.Filename, err)
 	}
-	img := NewImage(fh.Filename, rawimg)
-	return img, err
+	x := parseExif(fh.Filename, b)
+	img, err := NewImageFromBytes(fh.Filename, b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fh.Filename, err)
+	}
+	img.orient(x)
+	return img, nil
+}
+
+type DeduplicateWorker struct {
+	ImageService
+}
+
+// Work marks the image as deduplicated if the same content was already uploaded.
+// Deduplicated images skip the thumbnail and persist stages and only get linked to the user.
+func (worker *DeduplicateWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	if w, _ := ctx.Value("watermark").(*Watermark); w != nil && w.ApplyOn == WatermarkOnUpload {
+		// The renditions will be watermarked for this user only, so the image can't be shared.
+		// It keeps the hash of the original, so the user's uploads of it are still found by it.
+		img.Watermarked = true
+		return img, nil
+	}
+	if img.Hash == "" {
+		return img, nil
+	}
+	existing, err := worker.FindByHash(ctx, img.Hash)
+	if err == ErrImageNotFound {
+		return img, nil
+	}
+	if err != nil {
+		return nil, img.uploadError(UploadCodeDatabase, err)
+	}
+	img.Id = existing.Id
+	img.FullPath = existing.FullPath
+	img.ThumbnailPath = existing.ThumbnailPath
+	img.Deduplicated = true
+	return img, nil
+}
+
+type UnlinkWorker struct {
+	ImageService
+}
+
+// Work expects the input item to be the id of the image to delete
+func (worker *UnlinkWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var imageId int
+	var ok bool
+	if imageId, ok = in.(int); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	deleted, err := worker.Unlink(ctx, imageId)
+	if err != nil {
+		return nil, fmt.Errorf("image %d: %w", imageId, err)
+	}
+	return deleted, nil
+}
+
+type DeleteBlobsWorker struct {
+	ImageService
+}
+
+func (worker *DeleteBlobsWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var deleted *DeletedImage
+	var ok bool
+	if deleted, ok = in.(*DeletedImage); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	if err := worker.DeleteBlobs(ctx, deleted); err != nil {
+		// The rows are already gone, so the image counts as deleted. The files are only left behind.
+		log.Errorf("image %d: files weren't deleted: %s", deleted.Id, err)
+	}
+	return deleted, nil
+}
+
+// editFull replaces the full image of the input with its edit, the image has to be loaded first
+func editFull(in pipe.Item, edit func(full image.Image) (image.Image, error)) (pipe.Item, error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	if img.Full == nil {
+		return nil, fmt.Errorf("image %d: full image not loaded", img.Id)
+	}
+	full, err := edit(img.Full)
+	if err != nil {
+		return nil, fmt.Errorf("image %d: %w", img.Id, err)
+	}
+	img.Full = full
+	img.Resolution = full.Bounds().Size()
+	return img, nil
+}
+
+type CropWorker struct {
+	Rect image.Rectangle // Relative to the top left corner of the image
+}
+
+func (worker *CropWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+	return editFull(in, func(full image.Image) (image.Image, error) {
+		size := full.Bounds().Size()
+		if !worker.Rect.In(image.Rect(0, 0, size.X, size.Y)) {
+			return nil, fmt.Errorf("%w: crop %v is outside of the %dx%d image", ErrBadEdit, worker.Rect, size.X, size.Y)
+		}
+		return Crop(full, worker.Rect), nil
+	})
+}
+
+type RotateWorker struct {
+	Angle int // 90, 180 or 270 degrees clockwise
+}
+
+func (worker *RotateWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+	return editFull(in, func(full image.Image) (image.Image, error) {
+		switch worker.Angle {
+		case 90:
+			return Rotate90(full), nil
+		case 180:
+			return Rotate180(full), nil
+		case 270:
+			return Rotate270(full), nil
+		default:
+			return nil, fmt.Errorf("%w: can't rotate by %d degrees", ErrBadEdit, worker.Angle)
+		}
+	})
+}
+
+type FlipWorker struct {
+	Vertical bool // Top to bottom, otherwise left to right
+}
+
+func (worker *FlipWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+	return editFull(in, func(full image.Image) (image.Image, error) {
+		if worker.Vertical {
+			return FlipVertical(full), nil
+		}
+		return FlipHorizontal(full), nil
+	})
+}
+
+type GrayscaleWorker struct {
+}
+
+func (worker *GrayscaleWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+	return editFull(in, func(full image.Image) (image.Image, error) {
+		return Grayscale(full), nil
+	})
+}
+
+type AdjustWorker struct {
+	Brightness float64 // From -100 to 100
+	Contrast   float64 // From -100 to 100
+}
+
+func (worker *AdjustWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+	return editFull(in, func(full image.Image) (image.Image, error) {
+		return Adjust(full, worker.Brightness, worker.Contrast), nil
+	})
+}
+
+type SharpenWorker struct {
+	Amount float64 // From 0 to 5
+}
+
+func (worker *SharpenWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+	return editFull(in, func(full image.Image) (image.Image, error) {
+		return Sharpen(full, worker.Amount), nil
+	})
+}
+
+type BlurWorker struct {
+	Radius float64 // In pixels
+}
+
+func (worker *BlurWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+	return editFull(in, func(full image.Image) (image.Image, error) {
+		return Blur(full, worker.Radius), nil
+	})
+}
+
+type EncodeEditWorker struct {
+}
+
+// Work turns the edited image into a new upload: the full image is encoded as the original,
+// in the same format if it can be encoded, otherwise as a JPEG. The rest of the create stages save it as a new image.
+func (worker *EncodeEditWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	format := img.Format
+	if !contains(EncodeFormats, format) {
+		format = "jpeg"
+	}
+	buff := new(bytes.Buffer)
+	if err := Encode(buff, img.Full, format, EditQuality); err != nil {
+		return nil, fmt.Errorf("image %d: %w", img.Id, err)
+	}
+
+	edited := NewImage(img.Name, img.Full)
+	edited.Original = buff.Bytes()
+	edited.Format = format
+	edited.MimeType = "image/" + format
+	edited.Size = int64(buff.Len())
+	edited.Hash = HashContent(edited.Original)
+	edited.EditedFrom = img.Id
+	if img.Exif != nil {
+		// The pixels are upright now
+		exif := *img.Exif
+		exif.Orientation = OrientationNormal
+		edited.Exif = &exif
+	}
+	return edited, nil
+}
+
+type SaveVersionWorker struct {
+	ImageService
+}
+
+func (worker *SaveVersionWorker) Work(ctx context.Context, in pipe.Item) (out pipe.Item, err error) {
+
+	var img *Image
+	var ok bool
+	if img, ok = in.(*Image); ok == false {
+		return nil, fmt.Errorf("incorrect input parameter")
+	}
+
+	err = worker.SaveVersion(ctx, img)
+	if err != nil {
+		return nil, fmt.Errorf("image %d: %w", img.Id, err)
+	}
+	return img, nil
 }
@@ -0,0 +1,229 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/ele7ija/go-pipelines/image"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var (
+	ErrJobNotFound = fmt.Errorf("job not found")
+	ErrNoFiles     = fmt.Errorf("the upload has no files")
+)
+
+// Job statuses
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed" // It couldn't go on, the files not processed yet stay pending
+)
+
+// Job creates the images of an upload in the background, after the upload itself is over
+type Job struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"-"`
+	AlbumId   *int      `json:"albumId,omitempty"` // The images land in it
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Progress  Progress  `json:"progress"`
+	Files     []*File   `json:"files"`
+}
+
+// File is the result of a file of the job, image.UploadPending until it's processed
+type File struct {
+	Index   int    `json:"index"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+	ImageId int    `json:"imageId,omitempty"`
+}
+
+func NewFile(result *image.UploadResult) *File {
+
+	file := &File{Index: result.Index, Name: result.Name, Status: result.Status, Code: result.Code, Error: result.Error}
+	if result.Image != nil {
+		file.ImageId = result.Image.Id
+	}
+	return file
+}
+
+// Progress counts the files of the job by their status
+type Progress struct {
+	image.UploadSummary
+	Processed int `json:"processed"`
+}
+
+func (job *Job) summarize() {
+
+	job.Progress = Progress{UploadSummary: image.UploadSummary{Total: len(job.Files)}}
+	for _, file := range job.Files {
+		switch file.Status {
+		case image.UploadPending:
+			continue
+		case image.UploadSuccess:
+			job.Progress.Succeeded++
+		case image.UploadDeduplicated:
+			job.Progress.Deduplicated++
+		case image.UploadSkipped:
+			job.Progress.Skipped++
+		default:
+			job.Progress.Failed++
+		}
+		job.Progress.Processed++
+	}
+}
+
+// Service keeps the jobs and the results of their files
+type Service interface {
+	// Create saves the job of the user from the context with its files
+	Create(ctx context.Context, job *Job) error
+	// Get returns the job of the user from the context
+	Get(ctx context.Context, jobId int) (*Job, error)
+	// GetUnfinished returns the queued and the running jobs of all the users, to resume them
+	GetUnfinished(ctx context.Context) ([]*Job, error)
+	SetStatus(ctx context.Context, jobId int, status string, errMsg string) error
+	SaveFile(ctx context.Context, jobId int, file *File) error
+}
+
+func NewService(db *sql.DB) Service {
+	return service{db: db}
+}
+
+type service struct {
+	db *sql.DB
+}
+
+const jobQuery = "SELECT id, user_id, album_id, status, COALESCE(error, ''), created_at, updated_at FROM job"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row scanner) (*Job, error) {
+
+	var job Job
+	var albumId sql.NullInt64
+	if err := row.Scan(&job.Id, &job.UserId, &albumId, &job.Status, &job.Error, &job.CreatedAt, &job.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if albumId.Valid {
+		id := int(albumId.Int64)
+		job.AlbumId = &id
+	}
+	return &job, nil
+}
+
+func (s service) Create(ctx context.Context, job *Job) (err error) {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+
+	job.UserId = ctx.Value("userId").(int)
+	err = tx.QueryRowContext(ctx, "INSERT INTO job (user_id, album_id, status) VALUES ($1, $2, $3) RETURNING id, created_at, updated_at",
+		job.UserId, job.AlbumId, job.Status).Scan(&job.Id, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return
+	}
+	for _, file := range job.Files {
+		_, err = tx.ExecContext(ctx, "INSERT INTO job_files (job_id, position, name, status, code, error, image_id) VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, 0))",
+			job.Id, file.Index, file.Name, file.Status, file.Code, file.Error, file.ImageId)
+		if err != nil {
+			return
+		}
+	}
+	job.summarize()
+	log.Infof("created job %d with %d files", job.Id, len(job.Files))
+	return
+}
+
+func (s service) Get(ctx context.Context, jobId int) (*Job, error) {
+
+	job, err := scanJob(s.db.QueryRowContext(ctx, jobQuery+" WHERE id = $1 AND user_id = $2", jobId, ctx.Value("userId")))
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, s.getFiles(ctx, job)
+}
+
+func (s service) GetUnfinished(ctx context.Context) ([]*Job, error) {
+
+	rows, err := s.db.QueryContext(ctx, jobQuery+" WHERE status IN ($1, $2) ORDER BY id", JobQueued, JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if err := s.getFiles(ctx, job); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+func (s service) getFiles(ctx context.Context, job *Job) error {
+
+	rows, err := s.db.QueryContext(ctx, "SELECT position, name, status, COALESCE(code, ''), COALESCE(error, ''), COALESCE(image_id, 0) FROM job_files WHERE job_id = $1 ORDER BY position", job.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	job.Files = []*File{}
+	for rows.Next() {
+		var file File
+		if err := rows.Scan(&file.Index, &file.Name, &file.Status, &file.Code, &file.Error, &file.ImageId); err != nil {
+			return err
+		}
+		job.Files = append(job.Files, &file)
+	}
+	job.summarize()
+	return rows.Err()
+}
+
+func (s service) SetStatus(ctx context.Context, jobId int, status string, errMsg string) error {
+
+	_, err := s.db.ExecContext(ctx, "UPDATE job SET status = $2, error = NULLIF($3, ''), updated_at = now() WHERE id = $1", jobId, status, errMsg)
+	if err == nil {
+		log.Infof("job %d is %s", jobId, status)
+	}
+	return err
+}
+
+func (s service) SaveFile(ctx context.Context, jobId int, file *File) error {
+
+	_, err := s.db.ExecContext(ctx, `WITH file AS (
+		UPDATE job_files SET status = $3, code = NULLIF($4, ''), error = NULLIF($5, ''), image_id = NULLIF($6, 0) WHERE job_id = $1 AND position = $2)
+		UPDATE job SET updated_at = now() WHERE id = $1`,
+		jobId, file.Index, file.Status, file.Code, file.Error, file.ImageId)
+	return err
+}
@@ -0,0 +1,281 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ele7ija/go-pipelines/image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var jobColumns = []string{"id", "user_id", "album_id", "status", "error", "created_at", "updated_at"}
+
+func TestService(t *testing.T) {
+
+	ctx := context.WithValue(context.Background(), "userId", 1)
+	now := time.Now()
+
+	t.Run("create", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		albumId := 4
+		job := &Job{AlbumId: &albumId, Status: JobQueued, Files: []*File{
+			{Index: 0, Name: "a.jpg", Status: image.UploadPending},
+			{Index: 1, Name: "b.jpg", Status: image.UploadFailed, Code: image.UploadCodeNotAllowed, Error: "not allowed"},
+		}}
+		mock.ExpectBegin()
+		mock.ExpectQuery("INSERT INTO job").WithArgs(1, 4, JobQueued).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(7, now, now))
+		mock.ExpectExec("INSERT INTO job_files").WithArgs(7, 0, "a.jpg", image.UploadPending, "", "", 0).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO job_files").WithArgs(7, 1, "b.jpg", image.UploadFailed, image.UploadCodeNotAllowed, "not allowed", 0).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := NewService(db).Create(ctx, job); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		if job.Id != 7 || job.UserId != 1 {
+			t.Errorf("incorrect job: %+v", job)
+		}
+		if job.Progress != (Progress{UploadSummary: image.UploadSummary{Total: 2, Failed: 1}, Processed: 1}) {
+			t.Errorf("incorrect progress: %+v", job.Progress)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) FROM job WHERE id").WithArgs(7, 1).
+			WillReturnRows(sqlmock.NewRows(jobColumns).AddRow(7, 1, nil, JobRunning, "", now, now))
+		mock.ExpectQuery("SELECT (.+) FROM job_files").WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"position", "name", "status", "code", "error", "image_id"}).
+				AddRow(0, "a.jpg", image.UploadSuccess, "", "", 3).
+				AddRow(1, "b.jpg", image.UploadDeduplicated, "", "", 2).
+				AddRow(2, "c.jpg", image.UploadPending, "", "", 0))
+
+		job, err := NewService(db).Get(ctx, 7)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		if job.AlbumId != nil || job.Status != JobRunning || len(job.Files) != 3 || job.Files[0].ImageId != 3 {
+			t.Errorf("incorrect job: %+v", job)
+		}
+		if job.Progress != (Progress{UploadSummary: image.UploadSummary{Total: 3, Succeeded: 1, Deduplicated: 1}, Processed: 2}) {
+			t.Errorf("incorrect progress: %+v", job.Progress)
+		}
+	})
+
+	t.Run("get someone else's job", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT (.+) FROM job WHERE id").WithArgs(8, 1).WillReturnRows(sqlmock.NewRows(jobColumns))
+		if _, err := NewService(db).Get(ctx, 8); !errors.Is(err, ErrJobNotFound) {
+			t.Errorf("expected ErrJobNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("save file", func(t *testing.T) {
+
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("UPDATE job_files (.+) UPDATE job").WithArgs(7, 1, image.UploadSuccess, "", "", 3).WillReturnResult(sqlmock.NewResult(0, 1))
+		if err := NewService(db).SaveFile(ctx, 7, &File{Index: 1, Name: "b.jpg", Status: image.UploadSuccess, ImageId: 3}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+// memoryService keeps the jobs in memory
+type memoryService struct {
+	sync.Mutex
+	jobs map[int]*Job
+}
+
+func (s *memoryService) Create(ctx context.Context, job *Job) error {
+	s.Lock()
+	defer s.Unlock()
+	job.Id = len(s.jobs) + 1
+	job.UserId = ctx.Value("userId").(int)
+	s.jobs[job.Id] = job
+	return nil
+}
+
+func (s *memoryService) Get(ctx context.Context, jobId int) (*Job, error) {
+	s.Lock()
+	defer s.Unlock()
+	job, ok := s.jobs[jobId]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (s *memoryService) GetUnfinished(ctx context.Context) ([]*Job, error) {
+	return []*Job{}, nil
+}
+
+func (s *memoryService) SetStatus(ctx context.Context, jobId int, status string, errMsg string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.jobs[jobId].Status, s.jobs[jobId].Error = status, errMsg
+	return nil
+}
+
+func (s *memoryService) SaveFile(ctx context.Context, jobId int, file *File) error {
+	s.Lock()
+	defer s.Unlock()
+	for i, f := range s.jobs[jobId].Files {
+		if f.Index == file.Index {
+			s.jobs[jobId].Files[i] = file
+		}
+	}
+	return nil
+}
+
+func TestRunner(t *testing.T) {
+
+	ctx := context.WithValue(context.Background(), "userId", 1)
+	dir, err := ioutil.TempDir("", "staging")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	images := image.NewImageService(db, image.NewMemoryBlobStore(), image.DefaultRenditions)
+	service := &memoryService{jobs: make(map[int]*Job)}
+	runner, err := NewRunner(service, images, image.MakeCreateImagesPipelineBoundedFilters(images), dir, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Run("stages the files and runs the job", func(t *testing.T) {
+
+		feed := func(send func(*image.Upload) error, done func(*image.UploadResult)) error {
+			send(&image.Upload{Index: 0, Name: "broken.jpg", Data: []byte("not an image")})
+			send(&image.Upload{Index: 1, Name: "gone.jpg", Data: []byte("removed before the job runs")})
+			done(&image.UploadResult{Index: 2, Name: "c.jpg", Status: image.UploadFailed, Code: image.UploadCodeNotAllowed})
+			return nil
+		}
+		job, err := runner.Stage(ctx, feed, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if job.Status != JobQueued || len(job.Files) != 3 || job.Files[0].Status != image.UploadPending || job.Files[2].Code != image.UploadCodeNotAllowed {
+			t.Errorf("incorrect job: %+v", job)
+		}
+		if err := os.Remove(filepath.Join(dir, "1", "1")); err != nil {
+			t.Fatalf("the file should be staged: %s", err)
+		}
+
+		mock.ExpectQuery("SELECT (.+) FROM user_watermark").WillReturnRows(sqlmock.NewRows([]string{"text", "logo", "position", "opacity", "scale", "apply_on"}))
+		runner.run(job)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+
+		job, _ = service.Get(ctx, job.Id)
+		if job.Status != JobDone {
+			t.Errorf("incorrect status: %s", job.Status)
+		}
+		expected := []string{image.UploadCodeInvalidImage, image.UploadCodeUnreadable, image.UploadCodeNotAllowed}
+		for i, code := range expected {
+			if job.Files[i].Status != image.UploadFailed || job.Files[i].Code != code {
+				t.Errorf("incorrect file %d: %+v", i, job.Files[i])
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "1")); !os.IsNotExist(err) {
+			t.Errorf("the staged files should be removed, got: %v", err)
+		}
+	})
+
+	t.Run("failed job", func(t *testing.T) {
+
+		feed := func(send func(*image.Upload) error, done func(*image.UploadResult)) error {
+			return send(&image.Upload{Index: 0, Name: "a.jpg", Data: []byte("staged")})
+		}
+		job, err := runner.Stage(ctx, feed, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		mock.ExpectQuery("SELECT (.+) FROM user_watermark").WillReturnError(fmt.Errorf("connection refused"))
+		runner.run(job)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+
+		job, _ = service.Get(ctx, job.Id)
+		if job.Status != JobFailed || job.Error == "" {
+			t.Errorf("incorrect job: %+v", job)
+		}
+		if _, err := os.Stat(filepath.Join(dir, strconv.Itoa(job.Id))); !os.IsNotExist(err) {
+			t.Errorf("the staged files should be removed, got: %v", err)
+		}
+	})
+
+	t.Run("no files", func(t *testing.T) {
+
+		feed := func(send func(*image.Upload) error, done func(*image.UploadResult)) error { return nil }
+		if _, err := runner.Stage(ctx, feed, nil); !errors.Is(err, ErrNoFiles) {
+			t.Errorf("expected ErrNoFiles, got: %v", err)
+		}
+		if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("nothing should be staged, got %d entries", len(entries))
+		}
+	})
+
+	t.Run("resume removes the files of the jobs that are over", func(t *testing.T) {
+
+		for _, name := range []string{incomingPrefix + "1", "7"} {
+			if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if resumed, err := runner.Resume(ctx); err != nil || resumed != 0 {
+			t.Errorf("expected no jobs resumed, got: %d, %v", resumed, err)
+		}
+		if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("the incoming files should be removed, got %d entries", len(entries))
+		}
+	})
+}
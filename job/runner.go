@@ -0,0 +1,195 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"github.com/ele7ija/go-pipelines/image"
+	pipe "github.com/ele7ija/pipeline"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// incomingPrefix is of the staging directories of the uploads still coming in, they get the id of their job once it's created
+const incomingPrefix = "incoming-"
+
+// Runner creates the images of the jobs in the background, from their files staged on disk in a directory per job.
+// The staged files of a job are removed once it's over.
+type Runner struct {
+	service  Service
+	images   image.ImageService
+	pipeline *pipe.Pipeline
+	dir      string
+	slots    chan struct{} // At most this many jobs run at once, the rest wait for a slot
+}
+
+func NewRunner(service Service, images image.ImageService, pipeline *pipe.Pipeline, dir string, workers int) (*Runner, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %s", err)
+	}
+	return &Runner{
+		service:  service,
+		images:   images,
+		pipeline: pipeline,
+		dir:      dir,
+		slots:    make(chan struct{}, workers),
+	}, nil
+}
+
+// Stage writes the files of the feed into the staging directory as they come, and creates the queued job of the user
+// from the context for them. The files the feed is done with, e.g. the ones the policy didn't allow, are saved with their results.
+// Nothing is kept when the feed fails or has no files.
+func (r *Runner) Stage(ctx context.Context, feed image.UploadFeed, albumId *int) (*Job, error) {
+
+	incoming, err := ioutil.TempDir(r.dir, incomingPrefix)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{AlbumId: albumId, Status: JobQueued}
+	send := func(upload *image.Upload) error {
+		if err := ioutil.WriteFile(filepath.Join(incoming, strconv.Itoa(upload.Index)), upload.Data, 0644); err != nil {
+			return err
+		}
+		job.Files = append(job.Files, &File{Index: upload.Index, Name: upload.Name, Status: image.UploadPending})
+		return nil
+	}
+	done := func(result *image.UploadResult) {
+		job.Files = append(job.Files, NewFile(result))
+	}
+	if err := feed(send, done); err != nil {
+		os.RemoveAll(incoming)
+		return nil, err
+	}
+	if len(job.Files) == 0 {
+		os.RemoveAll(incoming)
+		return nil, ErrNoFiles
+	}
+
+	if err := r.service.Create(ctx, job); err != nil {
+		os.RemoveAll(incoming)
+		return nil, err
+	}
+	if err := os.Rename(incoming, r.jobDir(job.Id)); err != nil {
+		os.RemoveAll(incoming)
+		r.fail(ctx, job, err)
+		return nil, err
+	}
+	return job, nil
+}
+
+// Submit runs the job in the background once there's a free slot
+func (r *Runner) Submit(job *Job) {
+
+	go func() {
+		r.slots <- struct{}{}
+		defer func() { <-r.slots }()
+		r.run(job)
+	}()
+}
+
+// Resume submits the jobs left unfinished, e.g. when the server stopped while they were running, and returns how many there were.
+// The files being processed then are processed again. The staged files of the uploads that didn't make it to a job, and of
+// the jobs that are over but whose files weren't removed, are removed.
+func (r *Runner) Resume(ctx context.Context) (int, error) {
+
+	jobs, err := r.service.GetUnfinished(ctx)
+	if err != nil {
+		return 0, err
+	}
+	unfinished := make(map[string]bool)
+	for _, job := range jobs {
+		unfinished[strconv.Itoa(job.Id)] = true
+	}
+	infos, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range infos {
+		if !unfinished[info.Name()] {
+			os.RemoveAll(filepath.Join(r.dir, info.Name()))
+		}
+	}
+
+	for _, job := range jobs {
+		r.Submit(job)
+	}
+	return len(jobs), nil
+}
+
+// run creates the images of the pending files of the job with the create pipeline, saving every result as it's known
+func (r *Runner) run(job *Job) {
+
+	ctx := context.WithValue(context.Background(), "userId", job.UserId)
+	if job.AlbumId != nil {
+		ctx = context.WithValue(ctx, "albumId", *job.AlbumId)
+	}
+	// The user's watermark is applied like it is on the uploads
+	watermark, err := r.images.GetWatermark(ctx)
+	if err != nil {
+		r.fail(ctx, job, fmt.Errorf("couldn't get the watermark: %w", err))
+		return
+	}
+	if watermark != nil {
+		ctx = context.WithValue(ctx, "watermark", watermark)
+	}
+	if err := r.service.SetStatus(ctx, job.Id, JobRunning, ""); err != nil {
+		log.Errorf("couldn't start job %d: %s", job.Id, err)
+		return
+	}
+
+	feed := func(send func(*image.Upload) error, done func(*image.UploadResult)) error {
+		for _, file := range job.Files {
+			if file.Status != image.UploadPending {
+				continue
+			}
+			data, err := ioutil.ReadFile(r.stagedPath(job.Id, file.Index))
+			if err != nil {
+				done(&image.UploadResult{Index: file.Index, Name: file.Name, Status: image.UploadFailed, Code: image.UploadCodeUnreadable, Error: err.Error()})
+				continue
+			}
+			if err := send(&image.Upload{Index: file.Index, Name: file.Name, Data: data}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	progress := func(result *image.UploadResult) {
+		if err := r.service.SaveFile(ctx, job.Id, NewFile(result)); err != nil {
+			log.Errorf("couldn't save the result of %s in job %d: %s", result.Name, job.Id, err)
+		}
+	}
+	if _, err := image.CreateUploads(ctx, r.pipeline, feed, progress); err != nil {
+		r.fail(ctx, job, err)
+		return
+	}
+	if err := r.service.SetStatus(ctx, job.Id, JobDone, ""); err != nil {
+		log.Errorf("couldn't finish job %d: %s", job.Id, err)
+		return
+	}
+	if err := os.RemoveAll(r.jobDir(job.Id)); err != nil {
+		log.Warnf("couldn't remove the staged files of job %d: %s", job.Id, err)
+	}
+}
+
+func (r *Runner) fail(ctx context.Context, job *Job, err error) {
+
+	log.Errorf("job %d failed: %s", job.Id, err)
+	if err := r.service.SetStatus(ctx, job.Id, JobFailed, err.Error()); err != nil {
+		log.Errorf("couldn't fail job %d: %s", job.Id, err)
+	}
+	// A failed job isn't resumed, its files would never be processed
+	if err := os.RemoveAll(r.jobDir(job.Id)); err != nil {
+		log.Warnf("couldn't remove the staged files of job %d: %s", job.Id, err)
+	}
+}
+
+func (r *Runner) jobDir(jobId int) string {
+	return filepath.Join(r.dir, strconv.Itoa(jobId))
+}
+
+func (r *Runner) stagedPath(jobId int, index int) string {
+	return filepath.Join(r.jobDir(jobId), strconv.Itoa(index))
+}
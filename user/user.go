@@ -27,6 +27,7 @@ type Service interface {
 	Login(ctx context.Context, user User) (jwt.JWT, error)
 	GetUser(ctx context.Context, receivedJwt jwt.JWT) (User, error)
 	IsAdmin(ctx context.Context, username string) (bool, error)
+	GetByUsername(ctx context.Context, username string) (User, error)
 }
 
 func NewService(db *sql.DB, regoPath string) Service {
@@ -90,6 +91,17 @@ func (s service) GetUser(ctx context.Context, receivedJwt jwt.JWT) (User, error)
 
 }
 
+// GetByUsername finds the user without authenticating them, e.g. for the commands run on the server
+func (s service) GetByUsername(ctx context.Context, username string) (User, error) {
+
+	row := s.db.QueryRowContext(ctx, "SELECT id FROM \"user\" WHERE username = $1", username)
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return User{}, err
+	}
+	return User{ID: id, Username: username}, nil
+}
+
 func (s service) IsAdmin(ctx context.Context, username string) (bool, error) {
 
 	query, err := rego.New(